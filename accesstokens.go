@@ -0,0 +1,109 @@
+package main
+
+/*
+Project and group access tokens configured per project or group, used for the
+API calls of the matching projects instead of the global private token. The
+file maps project IDs or paths, and group paths, to tokens:
+
+	{
+	  "projects": {"42": "glpat-...", "team-a/service": "glpat-..."},
+	  "groups": {"team-b": "glpat-...", "team-b/mobile": "glpat-..."}
+	}
+
+Projects are matched by ID or path first, then by the closest enclosing group.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+var accessTokensFile = flag.String("access-tokens-file", "", "JSON file with project and group access tokens to be used for the API calls of the matching projects instead of --private-token")
+
+type accessTokensConfig struct {
+	Projects map[string]string `json:"projects"`
+	Groups   map[string]string `json:"groups"`
+}
+
+var accessTokens = struct {
+	sync.RWMutex
+	config accessTokensConfig
+	// paths of the projects, learned from the webhooks
+	paths map[int64]string
+}{paths: make(map[int64]string)}
+
+func loadAccessTokens() error {
+	if *accessTokensFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(*accessTokensFile)
+	if err != nil {
+		return err
+	}
+	var config accessTokensConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %s", *accessTokensFile, err)
+	}
+
+	for _, token := range config.Projects {
+		registerSecrets(token)
+	}
+	for _, token := range config.Groups {
+		registerSecrets(token)
+	}
+
+	accessTokens.Lock()
+	defer accessTokens.Unlock()
+	accessTokens.config = config
+	log.Println("[ACCESS-TOKEN]", "loaded tokens of", len(config.Projects), "projects and", len(config.Groups), "groups")
+	return nil
+}
+
+func rememberProjectPath(projectID int64, path string) {
+	if projectID == 0 || path == "" {
+		return
+	}
+
+	accessTokens.Lock()
+	defer accessTokens.Unlock()
+	accessTokens.paths[projectID] = path
+}
+
+// rememberedProjectPath returns the path of the project seen in its webhooks, if any
+func rememberedProjectPath(projectID int64) string {
+	accessTokens.RLock()
+	defer accessTokens.RUnlock()
+	return accessTokens.paths[projectID]
+}
+
+// configuredAccessToken returns the token configured for the project and
+// what it was matched by, or an empty token when none is configured.
+func configuredAccessToken(projectID int64) (token, matchedBy string) {
+	accessTokens.RLock()
+	defer accessTokens.RUnlock()
+
+	config := accessTokens.config
+	if token, ok := config.Projects[fmt.Sprint(projectID)]; ok {
+		return token, "project " + fmt.Sprint(projectID)
+	}
+	path, ok := accessTokens.paths[projectID]
+	if !ok {
+		return "", ""
+	}
+	if token, ok := config.Projects[path]; ok {
+		return token, "project " + path
+	}
+	for group := path; strings.Contains(group, "/"); {
+		group = group[:strings.LastIndex(group, "/")]
+		if token, ok := config.Groups[group]; ok {
+			return token, "group " + group
+		}
+	}
+	return "", ""
+}
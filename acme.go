@@ -0,0 +1,31 @@
+//go:build acme
+// +build acme
+
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeBuilt = true
+
+func acmeTLSConfig() (*tls.Config, error) {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(acmeHosts()...),
+		Cache:      autocert.DirCache(*acmeCacheDir),
+		Email:      *acmeEmail,
+	}
+
+	if *acmeHTTPListen != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*acmeHTTPListen, manager.HTTPHandler(nil)))
+		}()
+	}
+
+	return manager.TLSConfig(), nil
+}
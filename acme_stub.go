@@ -0,0 +1,15 @@
+//go:build !acme
+// +build !acme
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+const acmeBuilt = false
+
+func acmeTLSConfig() (*tls.Config, error) {
+	return nil, errors.New("built without ACME support, rebuild with -tags acme")
+}
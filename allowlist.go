@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var allowCIDR = flag.String("allow-cidr", "", "Comma separated CIDR ranges allowed to deliver webhooks, eg. the GitLab server addresses (all when empty)")
+var trustedProxies = flag.String("trusted-proxies", "", "Comma separated CIDR ranges of reverse proxies whose X-Forwarded-For header is trusted")
+
+var allowedNets []*net.IPNet
+var trustedProxyNets []*net.IPNet
+
+func parseCIDRList(list string) (nets []*net.IPNet, err error) {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.New("invalid CIDR " + item + ": " + err.Error())
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+func loadAllowlist() (err error) {
+	if allowedNets, err = parseCIDRList(*allowCIDR); err != nil {
+		return
+	}
+	trustedProxyNets, err = parseCIDRList(*trustedProxies)
+	return
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client, following X-Forwarded-For
+// from the right for as long as the hops are trusted proxies.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !netsContain(trustedProxyNets, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !netsContain(trustedProxyNets, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func withSourceAllowlist(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(allowedNets) > 0 {
+			ip := clientIP(r)
+			if ip == nil || !netsContain(allowedNets, ip) {
+				httpError(w, r, "source address "+ip.String()+" is not allowed", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
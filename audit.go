@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var auditLogFile = flag.String("audit-log", "", "File where every decision (events received, skipped, triggered, builds cancelled, MRs updated) is appended as JSON lines (disabled when empty)")
+var auditLogMaxSize = flag.Int64("audit-log-max-size", 100<<20, "Size in bytes after which the audit log is rotated")
+var auditLogMaxFiles = flag.Int("audit-log-max-files", 5, "Rotated audit log files kept, as <audit-log>.1 (newest) to <audit-log>.<n>")
+
+type auditEntry struct {
+	Time time.Time   `json:"time"`
+	Kind string      `json:"kind"`
+	Data interface{} `json:"data"`
+}
+
+var auditLog = struct {
+	sync.Mutex
+	file *os.File
+	size int64
+}{}
+
+func rotatedAuditLog(n int) string {
+	return fmt.Sprintf("%s.%d", *auditLogFile, n)
+}
+
+func openAuditLogLocked() error {
+	f, err := os.OpenFile(*auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	auditLog.file, auditLog.size = f, info.Size()
+	return nil
+}
+
+func rotateAuditLogLocked() error {
+	auditLog.file.Close()
+	auditLog.file = nil
+
+	os.Remove(rotatedAuditLog(*auditLogMaxFiles))
+	for n := *auditLogMaxFiles - 1; n >= 1; n-- {
+		os.Rename(rotatedAuditLog(n), rotatedAuditLog(n+1))
+	}
+	if *auditLogMaxFiles > 0 {
+		if err := os.Rename(*auditLogFile, rotatedAuditLog(1)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(*auditLogFile)
+	}
+	return openAuditLogLocked()
+}
+
+// writeAudit appends the decision to the audit log
+func writeAudit(kind string, data interface{}) {
+	if *auditLogFile == "" {
+		return
+	}
+	line, err := json.Marshal(auditEntry{Time: time.Now(), Kind: kind, Data: data})
+	if err != nil {
+		return
+	}
+	line = append([]byte(redact(string(line))), '\n')
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	if auditLog.file == nil {
+		err = openAuditLogLocked()
+	} else if auditLog.size+int64(len(line)) > *auditLogMaxSize {
+		err = rotateAuditLogLocked()
+	}
+	if err == nil {
+		_, err = auditLog.file.Write(line)
+		auditLog.size += int64(len(line))
+	}
+	if err != nil {
+		log.Println("[AUDIT] ERROR writing", *auditLogFile, ":", err)
+	}
+}
+
+// handlerAdminAudit exports the audit log, including the rotated files,
+// oldest first as JSON lines, optionally only the entries since the since
+// parameter (RFC 3339)
+func handlerAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if *auditLogFile == "" {
+		httpError(w, r, "audit log is disabled, see -audit-log", http.StatusNotFound)
+		return
+	}
+	var since time.Time
+	if value := r.FormValue("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			httpError(w, r, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	files := []string{}
+	for n := *auditLogMaxFiles; n >= 1; n-- {
+		files = append(files, rotatedAuditLog(n))
+	}
+	for _, name := range append(files, *auditLogFile) {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var entry struct {
+				Time time.Time `json:"time"`
+			}
+			if !since.IsZero() && (json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Time.Before(since)) {
+				continue
+			}
+			w.Write(append(scanner.Bytes(), '\n'))
+		}
+		f.Close()
+	}
+}
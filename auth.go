@@ -0,0 +1,88 @@
+package main
+
+/*
+Authentication of the endpoints not meant for GitLab: the admin APIs and the
+debug endpoints accept -admin-token as a bearer token (or as the password of
+basic auth, for browsers) and the -admin-basic-auth user and password, and
+/metrics the -metrics-token and -metrics-basic-auth ones as well as the admin
+credentials, when any of them is set.
+*/
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var adminBasicAuth = flag.String("admin-basic-auth", "", "user:password accepted by the admin and debug endpoints with HTTP basic auth, besides -admin-token")
+var metricsToken = flag.String("metrics-token", "", "Bearer token required by /metrics, besides the admin credentials (open when neither this nor -metrics-basic-auth is set)")
+var metricsBasicAuth = flag.String("metrics-basic-auth", "", "user:password required by /metrics with HTTP basic auth, besides the admin credentials")
+
+type endpointCredentials struct {
+	token     *string
+	basicAuth *string
+}
+
+var adminCredentials = endpointCredentials{token: adminToken, basicAuth: adminBasicAuth}
+var metricsCredentials = endpointCredentials{token: metricsToken, basicAuth: metricsBasicAuth}
+
+func validateAuthFlags() error {
+	for name, value := range map[string]string{"-admin-basic-auth": secretValue(adminBasicAuth), "-metrics-basic-auth": secretValue(metricsBasicAuth)} {
+		i := strings.Index(value, ":")
+		if value != "" && i < 0 {
+			return errors.New(name + ": expected user:password")
+		}
+		if i >= 0 {
+			registerSecrets(value[i+1:])
+		}
+	}
+	return nil
+}
+
+func (c endpointCredentials) configured() bool {
+	return secretValue(c.token) != "" || secretValue(c.basicAuth) != ""
+}
+
+func (c endpointCredentials) allow(r *http.Request) bool {
+	user, password, basic := r.BasicAuth()
+	if token := secretValue(c.token); token != "" {
+		// browsers can authenticate with the token as basic auth password
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if basic {
+			presented = password
+		}
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+			return true
+		}
+	}
+	if credentials := secretValue(c.basicAuth); credentials != "" && basic {
+		if subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(credentials)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// withAuth serves the request when it presents any of the credentials
+func withAuth(realm string, next http.HandlerFunc, accepted ...endpointCredentials) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, credentials := range accepted {
+			if credentials.allow(r) {
+				next(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// withMetricsAuth protects /metrics once its credentials are set
+func withMetricsAuth(next http.HandlerFunc) http.HandlerFunc {
+	if !metricsCredentials.configured() {
+		return next
+	}
+	return withAuth("metrics", next, metricsCredentials, adminCredentials)
+}
@@ -0,0 +1,470 @@
+package main
+
+/*
+Bootstrap sets up the projects to be served: a merge request webhook pointing
+at the service and a trigger token. The setup is computed as a JSON plan, which
+can be reviewed before it is applied.
+
+GitLab disables hooks failing repeatedly, temporarily and then for good. A
+disabled hook of the service is enabled again by a test delivery of a merge
+request event (GitLab 16.11, group hooks 17.1): GitLab enables the hook once
+it gets a 2xx response. The test delivery carries a real MR of the project, so
+it is ignored by the service: GitLab delivers it while the test request is in
+flight.
+
+GitLab does not return the secret of a hook. The hook carries the fingerprint
+of the secret in its description instead (GitLab 17.1), so a changed secret is
+found also after a restart; before that, only the secrets set since the start
+of the service are known.
+
+References:
+ - https://docs.gitlab.com/ee/api/projects.html#hooks
+ - https://docs.gitlab.com/ee/api/groups.html#list-a-groups-projects
+ - https://docs.gitlab.com/ee/api/groups.html#hooks
+ - https://docs.gitlab.com/ee/user/project/integrations/webhooks.html#auto-disabled-webhooks
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var bootstrapProjects = flag.String("bootstrap-projects", "", "Comma separated IDs or paths of projects to set up")
+var bootstrapGroups = flag.String("bootstrap-groups", "", "Comma separated IDs or paths of groups whose projects to set up")
+var webhookURL = flag.String("webhook-url", "", "Public URL of the webhook endpoint of the service, eg. https://mr-trigger.example.com/webhook.json")
+var bootstrapPlanFile = flag.String("bootstrap-plan", "", "Write the setup of the bootstrap projects as a JSON plan to this file (- for stdout) and exit")
+var bootstrapApplyFile = flag.String("bootstrap-apply", "", "Apply the JSON plan from this file and exit")
+var bootstrapGroupHooks = flag.Bool("bootstrap-group-hooks", false, "Set up a webhook on each -bootstrap-groups group (GitLab Premium), covering also the projects created later, instead of webhooks on their projects")
+var reconcileWebhooks = flag.Duration("reconcile-webhooks", 0, "Set up the bootstrap projects at this interval while serving, creating or fixing their webhooks (disabled when 0)")
+
+type projectHook struct {
+	ID                    int    `json:"id,omitempty"`
+	URL                   string `json:"url"`
+	Description           string `json:"description,omitempty"`
+	MergeRequestsEvents   bool   `json:"merge_requests_events"`
+	PushEvents            bool   `json:"push_events"`
+	EnableSSLVerification bool   `json:"enable_ssl_verification"`
+	// Token is the webhook secret, it is only sent, GitLab does not return it
+	Token string `json:"token,omitempty"`
+	// AlertStatus is executable, temporarily_disabled or disabled, it is only
+	// returned by GitLab
+	AlertStatus string `json:"alert_status,omitempty"`
+}
+
+var hooksEnabledCounter = newCounter("webhooks_reenabled_total", "Webhooks disabled by GitLab which were enabled again, by resource")
+
+func (h projectHook) disabled() bool {
+	return h.AlertStatus == "disabled" || h.AlertStatus == "temporarily_disabled"
+}
+
+// hookSecrets are the webhook secrets set on the hooks by the service, as
+// GitLab does not return them to be compared
+var hookSecrets = struct {
+	sync.Mutex
+	applied map[string]string
+}{applied: make(map[string]string)}
+
+// hookKey identifies the hook, as project and group hooks have IDs of their own
+func hookKey(resource string, hookID int) string {
+	return fmt.Sprint(resource, ":", hookID)
+}
+
+func hookSecretApplied(key string) bool {
+	hookSecrets.Lock()
+	defer hookSecrets.Unlock()
+	return hookSecrets.applied[key] == secretValue(webhookSecret)
+}
+
+func setHookSecretApplied(key, secret string) {
+	hookSecrets.Lock()
+	defer hookSecrets.Unlock()
+	hookSecrets.applied[key] = secret
+}
+
+// hookDescription returns the description of the hook of the service, with
+// the fingerprint of the webhook secret
+func hookDescription(secret string) string {
+	if secret == "" {
+		return "gitlab-merge-request-trigger"
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return fmt.Sprintf("gitlab-merge-request-trigger, secret sha256:%x", sum[:6])
+}
+
+// hookSecretSet reports whether the hook has the webhook secret: by the
+// fingerprint in its description, or by the secrets set since the start
+func hookSecretSet(key string, hook projectHook) bool {
+	if gitlabSupports("hook_description") {
+		return hook.Description == hookDescription(secretValue(webhookSecret))
+	}
+	return hookSecretApplied(key)
+}
+
+// hookTests counts the test deliveries in flight per project, 0 standing for
+// any project (of a group hook)
+var hookTests = struct {
+	sync.Mutex
+	inFlight map[int64]int
+}{inFlight: make(map[int64]int)}
+
+// testingHook marks the test delivery of the hook of the project in flight
+// until the returned function is called
+func testingHook(projectID int64) func() {
+	hookTests.Lock()
+	hookTests.inFlight[projectID]++
+	hookTests.Unlock()
+	return func() {
+		hookTests.Lock()
+		defer hookTests.Unlock()
+		if hookTests.inFlight[projectID]--; hookTests.inFlight[projectID] == 0 {
+			delete(hookTests.inFlight, projectID)
+		}
+	}
+}
+
+// hookTestSkip returns why the webhook is ignored when it is a test delivery
+// requested by the service to enable the hook, if so
+func hookTestSkip(webhook webhookRequest) (string, int) {
+	hookTests.Lock()
+	defer hookTests.Unlock()
+
+	if hookTests.inFlight[webhook.Attributes.TargetProjectID] > 0 || hookTests.inFlight[0] > 0 {
+		return "ignored test delivery of the webhook", http.StatusOK
+	}
+	return "", 0
+}
+
+type planAction struct {
+	ProjectID int64        `json:"project_id,omitempty"`
+	Project   string       `json:"project,omitempty"`
+	Group     string       `json:"group,omitempty"`
+	Resource  string       `json:"resource"`
+	Action    string       `json:"action"`
+	Hook      *projectHook `json:"hook,omitempty"`
+}
+
+type bootstrapPlan struct {
+	WebhookURL string       `json:"webhook_url"`
+	Actions    []planAction `json:"actions"`
+}
+
+func projectPathID(project string) string {
+	return url.QueryEscape(strings.TrimSpace(project))
+}
+
+func getProjectByPath(ctx context.Context, project string) (details projectDetails, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%s", *gitlabURL, projectPathID(project))
+	_, err = doJsonRequest(ctx, "GET", reqURL, "", nil, &details)
+	return
+}
+
+func listGroupProjects(ctx context.Context, group string) (projects []projectDetails, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/groups/%s/projects?include_subgroups=true&archived=false", *gitlabURL, projectPathID(group))
+	err = getAllPages(ctx, 0, reqURL, &projects)
+	return
+}
+
+func listProjectHooks(ctx context.Context, projectID int64) (hooks []projectHook, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/hooks", *gitlabURL, projectID)
+	err = getAllPages(ctx, projectID, reqURL, &hooks)
+	return
+}
+
+func saveProjectHook(ctx context.Context, projectID int64, hook projectHook) (saved projectHook, err error) {
+	jsonStr, _ := json.Marshal(hook)
+
+	method, reqURL := "POST", fmt.Sprintf("%s/api/v4/projects/%d/hooks", *gitlabURL, projectID)
+	if hook.ID != 0 {
+		method, reqURL = "PUT", fmt.Sprintf("%s/api/v4/projects/%d/hooks/%d", *gitlabURL, projectID, hook.ID)
+	}
+	_, err = doProjectRequest(ctx, projectID, method, reqURL, "application/json", bytes.NewBuffer(jsonStr), &saved)
+	return
+}
+
+// testProjectHook delivers a test merge request event to the hook, which
+// enables it when it was disabled
+func testProjectHook(ctx context.Context, projectID int64, hookID int) error {
+	defer testingHook(projectID)()
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/hooks/%d/test/merge_requests_events", *gitlabURL, projectID, hookID)
+	_, err := doProjectRequest(ctx, projectID, "POST", reqURL, "", nil, nil)
+	return err
+}
+
+func listGroupHooks(ctx context.Context, group string) (hooks []projectHook, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/groups/%s/hooks", *gitlabURL, projectPathID(group))
+	err = getAllPages(ctx, 0, reqURL, &hooks)
+	return
+}
+
+func saveGroupHook(ctx context.Context, group string, hook projectHook) (saved projectHook, err error) {
+	jsonStr, _ := json.Marshal(hook)
+
+	method, reqURL := "POST", fmt.Sprintf("%s/api/v4/groups/%s/hooks", *gitlabURL, projectPathID(group))
+	if hook.ID != 0 {
+		method, reqURL = "PUT", fmt.Sprintf("%s/api/v4/groups/%s/hooks/%d", *gitlabURL, projectPathID(group), hook.ID)
+	}
+	_, err = doJsonRequest(ctx, method, reqURL, "application/json", bytes.NewBuffer(jsonStr), &saved)
+	return
+}
+
+func testGroupHook(ctx context.Context, group string, hookID int) error {
+	defer testingHook(0)()
+	reqURL := fmt.Sprintf("%s/api/v4/groups/%s/hooks/%d/test/merge_requests_events", *gitlabURL, projectPathID(group), hookID)
+	_, err := doJsonRequest(ctx, "POST", reqURL, "", nil, nil)
+	return err
+}
+
+func desiredHook() projectHook {
+	return projectHook{
+		URL:                   *webhookURL,
+		Description:           hookDescription(secretValue(webhookSecret)),
+		MergeRequestsEvents:   true,
+		PushEvents:            *retriggerOnTargetPush,
+		EnableSSLVerification: true,
+	}
+}
+
+// bootstrapTargets resolves the configured projects and groups to projects
+func bootstrapTargets(ctx context.Context) (projects []projectDetails, err error) {
+	for _, project := range splitList(*bootstrapProjects) {
+		details, err := getProjectByPath(ctx, project)
+		if err != nil {
+			return nil, fmt.Errorf("project %s: %s", project, err)
+		}
+		projects = append(projects, details)
+	}
+	for _, group := range splitList(*bootstrapGroups) {
+		if *bootstrapGroupHooks {
+			// the projects of the group are covered by the group hook
+			continue
+		}
+		groupProjects, err := listGroupProjects(ctx, group)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %s", group, err)
+		}
+		projects = append(projects, groupProjects...)
+	}
+	return
+}
+
+// planHook returns the actions needed to set up the webhook of the service
+// among the hooks, if any
+func planHook(resource string, hooks []projectHook) (actions []planAction) {
+	desired := desiredHook()
+	var existing *projectHook
+	for i := range hooks {
+		if hooks[i].URL == desired.URL {
+			existing = &hooks[i]
+			break
+		}
+	}
+	if existing == nil {
+		return []planAction{{Resource: resource, Action: "create", Hook: &desired}}
+	}
+	desired.ID = existing.ID
+	if !existing.MergeRequestsEvents || !existing.EnableSSLVerification || desired.PushEvents != existing.PushEvents ||
+		secretValue(webhookSecret) != "" && !hookSecretSet(hookKey(resource, existing.ID), *existing) {
+		actions = append(actions, planAction{Resource: resource, Action: "update", Hook: &desired})
+	}
+	test := "hook_test"
+	if resource == "group_webhook" {
+		test = "group_hook_test"
+	}
+	if existing.disabled() && !gitlabSupports(test) {
+		log.Println("[BOOTSTRAP] WARNING", resource, existing.ID, "is", existing.AlertStatus, "- enable it by a test delivery in GitLab, its API requires", capabilities[test].requirement())
+	} else if existing.disabled() {
+		// the merge request events have to be enabled for the test delivery
+		actions = append(actions, planAction{Resource: resource, Action: "enable",
+			Hook: &projectHook{ID: existing.ID, URL: existing.URL, AlertStatus: existing.AlertStatus}})
+	}
+	return
+}
+
+// planProject returns the actions needed to set up the project
+func planProject(ctx context.Context, project projectDetails) (actions []planAction, err error) {
+	hooks, err := listProjectHooks(ctx, project.ID)
+	if err != nil {
+		return nil, err
+	}
+	actions = planHook("webhook", hooks)
+
+	if secretValue(triggerToken) == "" && !*createPipelines {
+		tokens, err := listTokens(ctx, project.ID)
+		if err != nil {
+			return nil, err
+		}
+		usable := false
+		for _, token := range tokens {
+			usable = usable || token.DeletedAt == "" && token.Token != ""
+		}
+		if !usable {
+			actions = append(actions, planAction{Resource: "trigger_token", Action: "create"})
+		}
+	}
+
+	for i := range actions {
+		actions[i].ProjectID = project.ID
+		actions[i].Project = project.PathWithNamespace
+	}
+	return
+}
+
+func makeBootstrapPlan(ctx context.Context) (plan bootstrapPlan, err error) {
+	if *webhookURL == "" {
+		return plan, errors.New("specify -webhook-url")
+	}
+
+	projects, err := bootstrapTargets(ctx)
+	if err != nil {
+		return plan, err
+	}
+
+	plan = bootstrapPlan{WebhookURL: *webhookURL, Actions: []planAction{}}
+	for _, project := range projects {
+		actions, err := planProject(ctx, project)
+		if err != nil {
+			return plan, fmt.Errorf("project %s: %s", project.PathWithNamespace, err)
+		}
+		plan.Actions = append(plan.Actions, actions...)
+	}
+
+	if *bootstrapGroupHooks {
+		for _, group := range splitList(*bootstrapGroups) {
+			hooks, err := listGroupHooks(ctx, group)
+			if err != nil {
+				return plan, fmt.Errorf("group %s: %s", group, err)
+			}
+			for _, action := range planHook("group_webhook", hooks) {
+				action.Group = group
+				plan.Actions = append(plan.Actions, action)
+			}
+		}
+	}
+	return
+}
+
+func applyPlanAction(ctx context.Context, action planAction) error {
+	switch {
+	case action.Action == "enable" && action.Hook != nil && (action.Resource == "webhook" || action.Resource == "group_webhook"):
+		name, hook := action.Project, "the webhook"
+		var err error
+		if action.Resource == "group_webhook" {
+			name, hook = "group "+action.Group, "the webhook of group "+action.Group
+			err = testGroupHook(ctx, action.Group, action.Hook.ID)
+		} else {
+			err = testProjectHook(ctx, action.ProjectID, action.Hook.ID)
+		}
+		if err != nil {
+			return err
+		}
+		hooksEnabledCounter.inc(labels("resource", action.Resource))
+		log.Println("[BOOTSTRAP]", name, "webhook enabled again - id:", action.Hook.ID, "was:", action.Hook.AlertStatus)
+		notify(notification{Kind: notifyHookDisabled, ProjectID: action.ProjectID, Project: action.Project,
+			Message: fmt.Sprintf("%s was %s by GitLab after failed deliveries, it was enabled again", hook, strings.Replace(action.Hook.AlertStatus, "_", " ", -1))})
+		return nil
+	case action.Resource == "webhook" && action.Hook != nil:
+		secret := secretValue(webhookSecret)
+		desired := *action.Hook
+		desired.Token = secret
+		hook, err := saveProjectHook(ctx, action.ProjectID, desired)
+		if err == nil {
+			setHookSecretApplied(hookKey(action.Resource, hook.ID), secret)
+			log.Println("[BOOTSTRAP]", action.Project, "webhook", action.Action, "- id:", hook.ID)
+		}
+		return err
+	case action.Resource == "group_webhook" && action.Hook != nil:
+		secret := secretValue(webhookSecret)
+		desired := *action.Hook
+		desired.Token = secret
+		hook, err := saveGroupHook(ctx, action.Group, desired)
+		if err == nil {
+			setHookSecretApplied(hookKey(action.Resource, hook.ID), secret)
+			log.Println("[BOOTSTRAP] group", action.Group, "webhook", action.Action, "- id:", hook.ID)
+		}
+		return err
+	case action.Resource == "trigger_token":
+		token, err := createToken(ctx, action.ProjectID)
+		if err == nil {
+			log.Println("[BOOTSTRAP]", action.Project, "trigger token created - id:", token.ID)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown action: %s %s", action.Action, action.Resource)
+}
+
+func applyBootstrapPlan(ctx context.Context, plan bootstrapPlan) (err error) {
+	for _, action := range plan.Actions {
+		if actionErr := applyPlanAction(ctx, action); actionErr != nil {
+			log.Println("[BOOTSTRAP] ERROR", action.Project, action.Action, action.Resource, ":", actionErr)
+			err = errors.New("some actions of the plan failed")
+		}
+	}
+	return
+}
+
+// runBootstrap handles -bootstrap-plan and -bootstrap-apply, it reports
+// whether one of them was requested.
+func runBootstrap() (bool, error) {
+	ctx := context.Background()
+
+	if *bootstrapPlanFile != "" {
+		plan, err := makeBootstrapPlan(ctx)
+		if err != nil {
+			return true, err
+		}
+		data, _ := json.MarshalIndent(plan, "", "  ")
+		if *bootstrapPlanFile == "-" {
+			_, err = os.Stdout.Write(append(data, '\n'))
+			return true, err
+		}
+		log.Println("[BOOTSTRAP]", len(plan.Actions), "actions planned, written to", *bootstrapPlanFile)
+		return true, ioutil.WriteFile(*bootstrapPlanFile, data, 0644)
+	}
+
+	if *bootstrapApplyFile != "" {
+		data, err := ioutil.ReadFile(*bootstrapApplyFile)
+		if err != nil {
+			return true, err
+		}
+		var plan bootstrapPlan
+		if err := json.Unmarshal(data, &plan); err != nil {
+			return true, err
+		}
+		return true, applyBootstrapPlan(ctx, plan)
+	}
+
+	return false, nil
+}
+
+// runWebhookReconciliation keeps the bootstrap projects set up while serving,
+// so hooks which were removed or changed are fixed
+func runWebhookReconciliation() {
+	for ; ; time.Sleep(*reconcileWebhooks) {
+		if !isLeader() {
+			continue
+		}
+		ctx := context.Background()
+		plan, err := makeBootstrapPlan(ctx)
+		if err != nil {
+			log.Println("[BOOTSTRAP] ERROR planning reconciliation:", err)
+		} else if len(plan.Actions) > 0 {
+			log.Println("[BOOTSTRAP] reconciling", len(plan.Actions), "actions")
+			if err := applyBootstrapPlan(ctx, plan); err != nil {
+				log.Println("[BOOTSTRAP] ERROR", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPlanHookComparesTheSecretOfTheHook(t *testing.T) {
+	defer func(hookURL, secret, version string) {
+		*webhookURL, *webhookSecret, gitlabServerVersion = hookURL, secret, version
+	}(*webhookURL, *webhookSecret, gitlabServerVersion)
+	*webhookURL, *webhookSecret = "https://mrt.example/webhook.json", "webhook-s3cr3t"
+
+	hook := desiredHook()
+	hook.ID = 7
+	stale := hook
+	stale.Description = hookDescription("previous-s3cr3t")
+	disabled := hook
+	disabled.AlertStatus = "disabled"
+
+	tests := []struct {
+		version string
+		hook    projectHook
+		actions []string
+	}{
+		{"17.5.0", hook, nil},
+		{"17.5.0", stale, []string{"update"}},
+		{"17.5.0", disabled, []string{"enable"}},
+		// the secret set before the start is not known without the fingerprint
+		{"16.0.0", disabled, []string{"update"}},
+	}
+	for _, test := range tests {
+		gitlabServerVersion = test.version
+		var actions []string
+		for _, action := range planHook("webhook", []projectHook{test.hook}) {
+			actions = append(actions, action.Action)
+		}
+		if len(actions) != len(test.actions) || len(actions) > 0 && actions[0] != test.actions[0] {
+			t.Errorf("GitLab %s, hook %+v: %v, expected %v", test.version, test.hook, actions, test.actions)
+		}
+	}
+}
+
+func TestTestDeliveryOfTheHookIsIgnored(t *testing.T) {
+	var webhook webhookRequest
+	webhook.Attributes.TargetProjectID = 42
+
+	var delivered string
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// GitLab delivers the test event before answering
+		delivered, _ = hookTestSkip(webhook)
+		w.Write([]byte("{}"))
+	}))
+	defer gitlab.Close()
+	defer func(gitlab, token string) { *gitlabURL, *privateToken = gitlab, token }(*gitlabURL, *privateToken)
+	*gitlabURL, *privateToken = gitlab.URL, "private-token"
+
+	if err := testProjectHook(context.Background(), 42, 7); err != nil {
+		t.Fatal(err)
+	}
+	if delivered == "" {
+		t.Error("test delivery of the hook was processed")
+	}
+	if message, _ := hookTestSkip(webhook); message != "" {
+		t.Errorf("delivery after the test ignored: %s", message)
+	}
+}
+
+func TestPlanHookMatchesPushEvents(t *testing.T) {
+	defer func(hookURL string, retrigger bool) {
+		*webhookURL, *retriggerOnTargetPush = hookURL, retrigger
+	}(*webhookURL, *retriggerOnTargetPush)
+	*webhookURL = "https://mrt.example/webhook.json"
+
+	for _, retrigger := range []bool{true, false} {
+		*retriggerOnTargetPush = retrigger
+		hook := desiredHook()
+		hook.ID = 7
+		hook.PushEvents = !retrigger
+		actions := planHook("webhook", []projectHook{hook})
+		if len(actions) != 1 || actions[0].Action != "update" || actions[0].Hook.PushEvents != retrigger {
+			t.Errorf("-retrigger-on-target-push=%v, push events of the hook %v: %+v, expected an update", retrigger, hook.PushEvents, actions)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// branchPattern matches branch names: a regular expression between slashes,
+// eg. /^hotfix-[0-9]+$/, or a glob, eg. release/* (exact names match as well)
+type branchPattern string
+
+func (p branchPattern) regexp() (*regexp.Regexp, bool) {
+	s := string(p)
+	if len(s) < 2 || !strings.HasPrefix(s, "/") || !strings.HasSuffix(s, "/") {
+		return nil, false
+	}
+	re, err := regexp.Compile(s[1 : len(s)-1])
+	return re, err == nil
+}
+
+func (p branchPattern) validate() error {
+	s := string(p)
+	if len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		if _, err := regexp.Compile(s[1 : len(s)-1]); err != nil {
+			return fmt.Errorf("invalid branch pattern %s: %s", s, err)
+		}
+		return nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return fmt.Errorf("invalid branch pattern %s: %s", s, err)
+	}
+	return nil
+}
+
+func (p branchPattern) matches(branch string) bool {
+	if re, ok := p.regexp(); ok {
+		return re.MatchString(branch)
+	}
+	matched, _ := path.Match(string(p), branch)
+	return matched
+}
+
+func matchesAnyBranch(patterns []string, branch string) bool {
+	for _, pattern := range patterns {
+		if pattern != "" && branchPattern(pattern).matches(branch) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateBranchPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if err := branchPattern(pattern).validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
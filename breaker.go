@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var breakerFailures = flag.Int("breaker-failures", 5, "Consecutive failed GitLab API calls after which calls are stopped for -breaker-cooldown (0 disables)")
+var breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "How long GitLab API calls are stopped once the circuit breaker opened")
+
+var errBreakerOpen = errors.New("GitLab is unavailable - circuit breaker is open")
+
+// breaker stops calling GitLab after consecutive failures. Once the cooldown
+// passed, a single trial call is let through which closes it on success.
+var breaker = struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}{}
+
+var breakerOpenGauge = newGauge("gitlab_circuit_breaker_open", "Whether calls to GitLab are stopped by the circuit breaker")
+
+// breakerRetryAfter returns how long the breaker stays open, 0 when closed
+func breakerRetryAfter() time.Duration {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	if wait := breaker.openUntil.Sub(time.Now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func breakerAllow() error {
+	if *breakerFailures <= 0 {
+		return nil
+	}
+
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	if breaker.failures < *breakerFailures {
+		return nil
+	}
+	if time.Now().Before(breaker.openUntil) || breaker.trial {
+		return errBreakerOpen
+	}
+	breaker.trial = true
+	return nil
+}
+
+func breakerRecord(success bool) {
+	if *breakerFailures <= 0 {
+		return
+	}
+
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	breaker.trial = false
+	if success {
+		if breaker.failures >= *breakerFailures {
+			log.Println("[BREAKER] GitLab is available again - closed")
+			notify(notification{Kind: notifyGitLabOutage, Message: "GitLab is available again"})
+			breakerOpenGauge.set("", 0)
+		}
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+	if breaker.failures >= *breakerFailures {
+		breaker.openUntil = time.Now().Add(*breakerCooldown)
+		breakerOpenGauge.set("", 1)
+		log.Println("[BREAKER] opened after", breaker.failures, "failed calls - pausing GitLab calls for", *breakerCooldown)
+		notify(notification{Kind: notifyGitLabOutage, Message: fmt.Sprintf("GitLab is unavailable - %d failed calls", breaker.failures)})
+	}
+}
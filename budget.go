@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync/atomic"
+)
+
+var apiCallBudget = flag.Int("api-call-budget", 50, "Maximum number of GitLab API calls a single webhook may make (0 is unlimited)")
+
+var errBudgetExhausted = errors.New("GitLab API call budget of the event is exhausted")
+
+type callBudget struct {
+	remaining int64
+}
+
+type callBudgetKey struct{}
+
+func withCallBudget(ctx context.Context, calls int) context.Context {
+	if calls <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, callBudgetKey{}, &callBudget{remaining: int64(calls)})
+}
+
+// spendCall takes one call from the budget of the event, if there is any
+func spendCall(ctx context.Context) error {
+	budget, ok := ctx.Value(callBudgetKey{}).(*callBudget)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt64(&budget.remaining, -1) < 0 {
+		return errBudgetExhausted
+	}
+	return nil
+}
+
+// budgetExhausted is checked by optional steps before they make any calls
+func budgetExhausted(ctx context.Context) bool {
+	budget, ok := ctx.Value(callBudgetKey{}).(*callBudget)
+	return ok && atomic.LoadInt64(&budget.remaining) <= 0
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+)
+
+// set when building, eg. go build -ldflags "-X main.buildVersion=1.2.0 -X main.buildCommit=abc123"
+var (
+	buildVersion = "dev"
+	buildCommit  = "unknown"
+)
+
+var printVersion = flag.Bool("version", false, "Print the version and build information and exit")
+
+type buildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	BuildTags []string `json:"build_tags"`
+	Features  []string `json:"features"`
+}
+
+// enabledFeatures lists the optional features enabled by the configuration
+func enabledFeatures() []string {
+	flags := map[string]bool{
+		"access-tokens-file":       *accessTokensFile != "",
+		"comment-policy-skips":     *commentPolicySkips,
+		"confirm-pipeline":         *confirmPipeline > 0,
+		"create-pipelines":         *createPipelines,
+		"cross-project":            *allowCrossProject,
+		"debounce":                 *debounceUpdates > 0,
+		"description-variables":    *descriptionVariables != "",
+		"dry-run":                  *dryRun,
+		"email-alerts":             emailEnabled(),
+		"error-tracking":           errorTrackingEnabled(),
+		"filter-exec":              *filterExec != "",
+		"gitlab-read-urls":         *gitlabReadURLs != "",
+		"ingest-kafka":             *ingestKafkaBrokers != "",
+		"ingest-nats":              *ingestNATSURL != "",
+		"label-variables":          *labelVariablesFlag != "",
+		"leader-election":          *leaderElection != "",
+		"max-gitlab-concurrency":   *maxGitLabConcurrency > 0,
+		"max-pipelines":            *maxPipelinesPerProject > 0,
+		"max-triggers-per-mr":      *maxTriggersPerMR > 0,
+		"merge-status-wait":        *mergeStatusWait > 0,
+		"merge-trains":             *mergeTrains != "",
+		"mr-filters":               *milestoneFilter != "" || *assigneeFilter != "" || *reviewerFilter != "",
+		"native-mr-pipelines":      *nativeMRPipelines != "",
+		"notifications":            notificationsEnabled(),
+		"notify-conflicts":         *notifyConflicts,
+		"oidc":                     oidcEnabled(),
+		"opa":                      *opaURL != "",
+		"poll":                     *pollInterval > 0,
+		"preflight":                *preflight,
+		"profiles":                 *profilesFile != "",
+		"publish-outcomes":         publishingEnabled(),
+		"quiet-hours":              *quietHours != "",
+		"rebase-before-trigger":    *rebaseBeforeTrigger,
+		"redis":                    *redisURL != "",
+		"reconcile-webhooks":       *reconcileWebhooks > 0,
+		"retrigger-on-target-push": *retriggerOnTargetPush,
+		"retrigger-stale":          *retriggerStaleSchedule != "",
+		"project-access-tokens":    *useProjectAccessTokens,
+		"shadow":                   *shadowMode,
+		"skip-conflicted":          *skipConflicted,
+		"status-check":             *statusCheckName != "",
+		"sudo-author":              *sudoAuthor,
+		"tls":                      tlsEnabled(),
+		"trigger-merged":           *shouldTriggerMerged,
+		"validate-ci":              *validateCI,
+		"vault":                    vaultEnabled(),
+		"wasm-plugins":             *wasmPlugins != "",
+		"webhook-secret":           secretValue(webhookSecret) != "",
+	}
+	features := []string{}
+	for name, enabled := range flags {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		BuildTags: []string{},
+		Features:  enabledFeatures(),
+	}
+	if acmeBuilt {
+		info.BuildTags = append(info.BuildTags, "acme")
+	}
+	if kafkaBuilt {
+		info.BuildTags = append(info.BuildTags, "kafka")
+	}
+	if wazeroBuilt {
+		info.BuildTags = append(info.BuildTags, "wazero")
+	}
+	return info
+}
+
+func printBuildInfo() {
+	data, _ := json.MarshalIndent(currentBuildInfo(), "", "  ")
+	fmt.Println(string(data))
+}
+
+func handlerVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentBuildInfo())
+}
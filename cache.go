@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var skipCacheTTL = flag.Duration("skip-cache-ttl", time.Minute, "How long commits known to have a pipeline are remembered, to skip looking them up again (0 disables)")
+var triggerTokenCacheTTL = flag.Duration("trigger-token-cache-ttl", time.Hour, "How long the trigger tokens of projects are remembered, to skip looking them up for every webhook (0 disables)")
+var lookupCacheTTL = flag.Duration("lookup-cache-ttl", 10*time.Second, "How long MR details, commits and project metadata are reused by the events following shortly after, to skip looking them up again (0 disables)")
+
+// ttlCache is a map whose entries expire after the configured duration
+type ttlCache struct {
+	sync.Mutex
+	ttl     *time.Duration
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// purge expired entries when the cache grows over this size
+const cachePurgeSize = 1000
+
+var pipelineCache = newTTLCache(skipCacheTTL)
+var triggerTokenCache = newTTLCache(triggerTokenCacheTTL)
+
+var triggerTokenCacheCounter = newCounter("trigger_token_cache_total", "Trigger token lookups, by whether the token was cached")
+
+// caches of the GitLab lookups repeated by rapid-fire events of the same MR
+var mergeRequestCache = newTTLCache(lookupCacheTTL)
+var commitCache = newTTLCache(lookupCacheTTL)
+var projectCache = newTTLCache(lookupCacheTTL)
+
+var lookupCacheCounter = newCounter("gitlab_lookup_cache_total", "MR, commit and project lookups, by kind and whether the result was cached")
+
+func newTTLCache(ttl *time.Duration) *ttlCache {
+	return &ttlCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key string, value interface{}) {
+	if *c.ttl <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= cachePurgeSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(*c.ttl)}
+}
+
+func (c *ttlCache) delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.entries, key)
+}
+
+// cachedLookup returns the cached value of the key, counting the hit or miss
+func cachedLookup(c *ttlCache, kind, key string) (interface{}, bool) {
+	value, ok := c.get(key)
+	if ok {
+		lookupCacheCounter.inc(labels("kind", kind, "result", "hit"))
+	} else {
+		lookupCacheCounter.inc(labels("kind", kind, "result", "miss"))
+	}
+	return value, ok
+}
+
+// mergeRequestKey identifies the version of the MR updated at the time, so
+// events of later updates of the MR do not read its earlier state
+func mergeRequestKey(ctx context.Context, projectID int64, mrIID int, updatedAt string) string {
+	return fmt.Sprintf("%s!%d@%s", projectKey(ctx, projectID), mrIID, updatedAt)
+}
+
+func commitKey(projectID int64, sha string) string {
+	return fmt.Sprintf("%d@%s", projectID, sha)
+}
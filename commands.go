@@ -0,0 +1,198 @@
+package main
+
+/*
+Commands of the binary. Without a command the service is served, as before
+the commands were introduced, so existing deployments keep working.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type command struct {
+	description string
+	// flags registers the flags specific to the command
+	flags func()
+	run   func() error
+}
+
+var commands = map[string]command{
+	"serve": {
+		description: "serve the webhook endpoint (default)",
+		run:         serve,
+	},
+	"trigger": {
+		description: "run the pipeline trigger flow for a single MR: trigger -project <id or path> -mr <iid>",
+		flags:       triggerCommandFlags,
+		run:         runTriggerCommand,
+	},
+	"validate-config": {
+		description: "validate the flags, the environment and the configuration files without contacting GitLab",
+		run:         runValidateConfig,
+	},
+	"check": {
+		description: "check the connectivity to GitLab and the scopes of the token",
+		run:         runCheck,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// parseCommand parses the command and its flags from the arguments
+func parseCommand(args []string) command {
+	flag.Usage = usage
+
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown command:", name)
+		usage()
+		os.Exit(2)
+	}
+
+	if cmd.flags != nil {
+		cmd.flags()
+	}
+	flag.CommandLine.Parse(args)
+	return cmd
+}
+
+var triggerProject *string
+var triggerMR *int
+
+func triggerCommandFlags() {
+	triggerProject = flag.String("project", "", "ID or path of the target project of the MR")
+	triggerMR = flag.Int("mr", 0, "IID of the MR")
+}
+
+func resolveProjectID(ctx context.Context, project string) (int64, error) {
+	if id, err := strconv.ParseInt(project, 10, 64); err == nil {
+		return id, nil
+	}
+	details, err := getProjectByPath(ctx, project)
+	return details.ID, err
+}
+
+func runTriggerCommand() error {
+	if *triggerProject == "" || *triggerMR <= 0 {
+		return errors.New("trigger requires -project and -mr")
+	}
+	if err := configure(); err != nil {
+		return err
+	}
+	if err := connectGitLab(); err != nil {
+		return err
+	}
+	if err := loadOverrides(); err != nil {
+		return errors.New("Error loading per-project overrides: " + err.Error())
+	}
+
+	ctx := withRequestID(eventContext(), newRequestID())
+	projectID, err := resolveProjectID(ctx, *triggerProject)
+	if err != nil {
+		return fmt.Errorf("project %s: %s", *triggerProject, err)
+	}
+	webhook, err := webhookFromMergeRequest(ctx, projectID, *triggerMR)
+	if err != nil {
+		return err
+	}
+
+	message, code := processSerialized(ctx, webhook)
+	fmt.Println(code, message)
+	if code >= http.StatusBadRequest {
+		return errors.New("trigger failed")
+	}
+	return nil
+}
+
+func runValidateConfig() error {
+	if err := configure(); err != nil {
+		return err
+	}
+
+	var failed []string
+	if err := configureGitLabClient(); err != nil {
+		failed = append(failed, "GitLab client: "+err.Error())
+	}
+	if err := loadAllowlist(); err != nil {
+		failed = append(failed, "allowlist: "+err.Error())
+	}
+	if err := loadOverrides(); err != nil {
+		failed = append(failed, "overrides: "+err.Error())
+	}
+	if err := loadAccessTokens(); err != nil {
+		failed = append(failed, "access tokens: "+err.Error())
+	}
+	if err := loadProfiles(); err != nil {
+		failed = append(failed, "profiles: "+err.Error())
+	}
+	if *opaPolicyFile != "" {
+		if _, err := ioutil.ReadFile(*opaPolicyFile); err != nil {
+			failed = append(failed, "OPA policy: "+err.Error())
+		}
+	}
+	for _, path := range splitList(*wasmPlugins) {
+		if _, err := ioutil.ReadFile(path); err != nil {
+			failed = append(failed, "WebAssembly plugin: "+err.Error())
+		}
+	}
+	if *useProjectAccessTokens {
+		if err := loadProjectTokens(); err != nil {
+			failed = append(failed, "project access tokens: "+err.Error())
+		}
+	}
+	if *tlsCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile); err != nil {
+			failed = append(failed, "TLS certificate: "+err.Error())
+		}
+	}
+	if *tlsClientCAFile != "" {
+		if _, err := loadCertPool(*tlsClientCAFile); err != nil {
+			failed = append(failed, "TLS client CA: "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errorList(failed)
+	}
+
+	log.Println("[CONFIG] configuration is valid")
+	return nil
+}
+
+func runCheck() error {
+	if err := configure(); err != nil {
+		return err
+	}
+	*selfCheck = true
+	if err := connectGitLab(); err != nil {
+		return err
+	}
+	log.Println("[CHECK] GitLab", *gitlabURL, "is reachable and the token is valid")
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+)
+
+var maxGitLabConcurrency = flag.Int("max-gitlab-concurrency", 0, "Maximum number of simultaneous GitLab API requests, further ones wait for a free slot (0 is unlimited)")
+
+// gitlabSlots bounds the requests in flight when -max-gitlab-concurrency is set
+var gitlabSlots chan struct{}
+
+var gitlabInFlightGauge = newGauge("gitlab_requests_in_flight", "GitLab API requests in flight")
+var gitlabWaitingGauge = newGauge("gitlab_requests_waiting", "GitLab API requests waiting for a free slot of -max-gitlab-concurrency")
+var gitlabSlotWaitCounter = newCounter("gitlab_concurrency_wait_seconds_total", "Time GitLab API requests waited for a free slot of -max-gitlab-concurrency")
+
+var gitlabConcurrency = struct {
+	sync.Mutex
+	inFlight int
+	waiting  int
+}{}
+
+func configureGitLabConcurrency() {
+	if *maxGitLabConcurrency > 0 {
+		gitlabSlots = make(chan struct{}, *maxGitLabConcurrency)
+	}
+}
+
+func updateGitLabConcurrency(inFlight, waiting int) {
+	gitlabConcurrency.Lock()
+	defer gitlabConcurrency.Unlock()
+	gitlabConcurrency.inFlight += inFlight
+	gitlabConcurrency.waiting += waiting
+	gitlabInFlightGauge.set("", float64(gitlabConcurrency.inFlight))
+	gitlabWaitingGauge.set("", float64(gitlabConcurrency.waiting))
+}
+
+// acquireGitLabSlot waits for a free slot for a request, and returns the
+// function freeing it, which may be called more than once
+func acquireGitLabSlot(ctx context.Context) (func(), error) {
+	if gitlabSlots != nil {
+		select {
+		case gitlabSlots <- struct{}{}:
+		default:
+			started := time.Now()
+			updateGitLabConcurrency(0, 1)
+			select {
+			case gitlabSlots <- struct{}{}:
+				updateGitLabConcurrency(0, -1)
+				gitlabSlotWaitCounter.add("", time.Since(started).Seconds())
+			case <-ctx.Done():
+				updateGitLabConcurrency(0, -1)
+				return nil, ctx.Err()
+			}
+		}
+	}
+	updateGitLabConcurrency(1, 0)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			updateGitLabConcurrency(-1, 0)
+			if gitlabSlots != nil {
+				<-gitlabSlots
+			}
+		})
+	}, nil
+}
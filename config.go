@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var adminToken = flag.String("admin-token", "", "Bearer token protecting the /admin endpoints (disabled when empty)")
+
+// Every flag can also be set with an environment variable, eg. -private-token
+// with MR_TRIGGER_PRIVATE_TOKEN. Command line flags take precedence.
+const envPrefix = "MR_TRIGGER_"
+
+type configSetting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+var configSources = make(map[string]string)
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func isSecretSetting(name string) bool {
+	if strings.HasSuffix(name, "-file") {
+		// paths of files with secrets
+		return false
+	}
+	return strings.Contains(name, "token") || strings.Contains(name, "secret") || strings.Contains(name, "password")
+}
+
+// urlCredentials returns the user info of a URL setting, eg. the password of
+// redis://:password@localhost:6379, if any
+func urlCredentials(value string) *url.Userinfo {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return nil
+	}
+	return u.User
+}
+
+// redactURLCredentials replaces the user info of a URL setting
+func redactURLCredentials(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	u.User = nil
+	return u.Scheme + "://" + redacted + "@" + strings.TrimPrefix(u.String(), u.Scheme+"://")
+}
+
+// registerURLSecrets redacts the credentials of the URL settings from the
+// logs and responses: the password, or the user name of URLs with a token
+// instead, eg. tls://token@nats.example.com:4222
+func registerURLSecrets() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if user := urlCredentials(f.Value.String()); user != nil {
+			password, ok := user.Password()
+			if !ok {
+				password = user.Username()
+			}
+			registerSecrets(user.String(), password)
+		}
+	})
+}
+
+func applyEnvironment() (err error) {
+	flag.Visit(func(f *flag.Flag) {
+		configSources[f.Name] = "flag"
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		if configSources[f.Name] != "" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			configSources[f.Name] = "default"
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil && err == nil {
+			err = setErr
+			log.Println("[CONFIG] ERROR invalid value of", envName(f.Name), ":", setErr)
+		}
+		configSources[f.Name] = "env"
+	})
+	return
+}
+
+func effectiveConfig() map[string]configSetting {
+	config := make(map[string]configSetting)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && isSecretSetting(f.Name) {
+			value = redacted
+		} else if urlCredentials(value) != nil {
+			value = redactURLCredentials(value)
+		}
+		config[f.Name] = configSetting{Value: value, Source: configSources[f.Name]}
+	})
+	return config
+}
+
+func logEffectiveConfig() {
+	data, err := json.Marshal(effectiveConfig())
+	if err != nil {
+		log.Println("[CONFIG] ERROR", err)
+		return
+	}
+	log.Println("[CONFIG]", string(data))
+}
+
+// withAdminAuth protects the admin endpoints, which are disabled without
+// admin credentials or OIDC login
+func withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	auth := withAuth("admin", next, adminCredentials)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if oidcEnabled() && oidcAuthorize(w, r, next) {
+			return
+		}
+		auth(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		httpError(w, nil, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append([]byte(redact(string(body))), '\n'))
+}
+
+func handlerAdminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, effectiveConfig())
+}
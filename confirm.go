@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var confirmPipeline = flag.Duration("confirm-pipeline", 0, "How long to wait after triggering for the pipeline to get its jobs, to detect pipelines skipped by CI rules (0 disables)")
+var notifySkippedPipeline = flag.Bool("notify-skipped-pipeline", false, "Comment on the MR when the triggered pipeline was skipped or has no jobs")
+
+const confirmPollInterval = 2 * time.Second
+
+var nothingRunsCounter = newCounter("pipelines_nothing_runs_total", "Triggered pipelines which were skipped or have no jobs due to CI rules, by reason")
+
+func getPipelineJobs(ctx context.Context, projectID int64, pipelineID int) (jobs []job, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines/%d/jobs", *gitlabURL, projectID, pipelineID)
+	_, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &jobs)
+	return
+}
+
+// isNoJobsError reports whether the trigger failed because no job of the
+// CI configuration matched the rules, so no pipeline was created at all.
+func isNoJobsError(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "No stages / jobs for this pipeline") ||
+		strings.Contains(err.Error(), "prevented any jobs from being added to the pipeline"))
+}
+
+// confirmPipelineJobs polls the pipeline until it has jobs or the wait is
+// over, and returns the reason why nothing runs in the pipeline, if so.
+func confirmPipelineJobs(ctx context.Context, projectID int64, pipelineID int) (reason string) {
+	deadline := time.Now().Add(*confirmPipeline)
+	for {
+		p, err := getPipeline(ctx, projectID, pipelineID)
+		if err != nil {
+			logEvent(ctx, "[PIPELINE] ERROR confirming pipeline", pipelineID, ":", err)
+			return ""
+		}
+		if p.Status == "skipped" {
+			return "pipeline was skipped"
+		}
+
+		jobs, err := getPipelineJobs(ctx, projectID, pipelineID)
+		if err != nil {
+			logEvent(ctx, "[PIPELINE] ERROR confirming pipeline", pipelineID, ":", err)
+			return ""
+		}
+		if len(jobs) > 0 {
+			return ""
+		}
+
+		if time.Now().Add(confirmPollInterval).After(deadline) {
+			return "pipeline has no jobs"
+		}
+		time.Sleep(confirmPollInterval)
+	}
+}
+
+// followPipelineJobs confirms the triggered pipeline off the webhook, and
+// reports it when nothing runs in it
+func followPipelineJobs(ctx context.Context, webhook webhookRequest, pipelineID int) {
+	reason := confirmPipelineJobs(ctx, pipelineProjectID(webhook), pipelineID)
+	if reason == "" {
+		return
+	}
+	nothingRunsCounter.inc(labels("reason", reason))
+	logEvent(ctx, "[PIPELINE] nothing runs in pipeline", pipelineID, "-", reason)
+	notifyNothingRuns(ctx, webhook, reason)
+}
+
+func notifyNothingRuns(ctx context.Context, webhook webhookRequest, reason string) {
+	if !*notifySkippedPipeline || *shadowMode {
+		return
+	}
+
+	body := fmt.Sprintf("CI was triggered for commit %s, but nothing runs: %s. Check the `rules` of the jobs in `.gitlab-ci.yml`.",
+		webhook.Attributes.LastCommit.ID, reason)
+	if _, err := createMRNote(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.IID, body); err != nil {
+		logEvent(ctx, "[MR] ERROR commenting on MR:", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFollowPipelineJobsCommentsWhenNothingRuns(t *testing.T) {
+	var notes int
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/projects/1/pipelines/77":
+			w.Write([]byte(`{"id":77,"status":"skipped"}`))
+		case "/api/v4/projects/1/merge_requests/7/notes":
+			notes++
+			w.Write([]byte(`{"id":1}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gitlab.Close()
+	defer func(gitlab, token string, notify bool) {
+		*gitlabURL, *privateToken, *notifySkippedPipeline = gitlab, token, notify
+	}(*gitlabURL, *privateToken, *notifySkippedPipeline)
+	*gitlabURL, *privateToken, *notifySkippedPipeline = gitlab.URL, "private-token", true
+
+	var webhook webhookRequest
+	webhook.Attributes.SourceProjectID = 1
+	webhook.Attributes.TargetProjectID = 1
+	webhook.Attributes.IID = 7
+	webhook.RefStrategy = refSource
+
+	followPipelineJobs(context.Background(), webhook, 77)
+	if notes != 1 {
+		t.Errorf("%d comments on the MR, expected 1", notes)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+/*
+MRs with conflicts can not be merged, so their pipelines are skipped and the
+author is asked to rebase in a single MR comment, refreshed on later pushes.
+Optionally a rebase is requested with the API first, once per commit: when it
+succeeds, the rebased commit is delivered as a new update event.
+
+References:
+ - https://docs.gitlab.com/ee/api/merge_requests.html#rebase-a-merge-request
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var notifyConflicts = flag.Bool("notify-conflicts", false, "Skip triggering for MRs with conflicts and ask the author to rebase in an MR comment")
+var conflictsAutoRebase = flag.Bool("conflicts-auto-rebase", false, "Request a rebase of MRs with conflicts with the API before asking the author (with -notify-conflicts)")
+
+// conflictsNoteMarker identifies the comment asking the author to rebase
+const conflictsNoteMarker = "<!-- mr-trigger:conflicts -->"
+
+var rebaseRequestTTL = 24 * time.Hour
+
+// rebaseRequests remembers the commits whose rebase was requested, so a failed
+// rebase is not requested again
+var rebaseRequests = newTTLCache(&rebaseRequestTTL)
+
+// conflictsSkip returns the reason to skip the trigger of the MR having
+// conflicts, if so
+func conflictsSkip(ctx context.Context, webhook webhookRequest, mr mergeRequest) (string, int) {
+	if !mr.hasConflicts() {
+		return "", 0
+	}
+	if *skipConflicted {
+		commentPolicySkip(ctx, webhook, "the MR has conflicts with "+webhook.Attributes.TargetBranch, "resolve the conflicts")
+		return "conflicts - skipping build", http.StatusOK
+	}
+	if !*notifyConflicts {
+		return "", 0
+	}
+	if *shadowMode || dryRunning(ctx) {
+		logEvent(ctx, "[CONFLICTS] would notify the author of the conflicts of MR:", webhook.Attributes.IID)
+		return "conflicts - skipping build", http.StatusOK
+	}
+
+	key := mrKey(webhook) + "@" + webhook.Attributes.LastCommit.ID
+	if _, requested := rebaseRequests.get(key); *conflictsAutoRebase && !requested {
+		rebaseRequests.set(key, true)
+		err := rebaseMergeRequest(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.IID)
+		if err == nil {
+			logEvent(ctx, "[CONFLICTS] requested rebase of MR:", webhook.Attributes.IID)
+			return "conflicts - rebase requested, the rebased commit will be built", http.StatusAccepted
+		}
+		logEvent(ctx, "[CONFLICTS] ERROR requesting rebase:", err)
+	}
+	if budgetExhausted(ctx) {
+		return "conflicts - skipping build", http.StatusOK
+	}
+
+	body := fmt.Sprintf("@%s this MR has conflicts with `%s`, so CI pipeline was not triggered for commit %s.\n\nRebase the source branch onto `%s` (or resolve the conflicts) and push again.",
+		mr.Author.Username, webhook.Attributes.TargetBranch, webhook.Attributes.LastCommit.ID, webhook.Attributes.TargetBranch)
+	if err := upsertMRNote(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.IID, conflictsNoteMarker, body); err != nil {
+		logEvent(ctx, "[MR] ERROR commenting conflicts:", err)
+	}
+	return "conflicts - skipping build, the author was asked to rebase", http.StatusOK
+}
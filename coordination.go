@@ -0,0 +1,227 @@
+package main
+
+/*
+Coordination shares the state deciding about double triggers between the
+replicas of the service through Redis: the remembered deliveries, a lock per
+MR held while its event is processed, the last processed event of each MR and
+the pipelines counted by -max-pipelines-per-project. When Redis can not be
+reached, each replica falls back to its own state.
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+var redisURL = flag.String("redis-url", "", "Redis server coordinating multiple replicas: deliveries, MR locks and pipeline slots, eg. redis://:password@localhost:6379/0 (disabled when empty)")
+var redisPrefix = flag.String("redis-prefix", "mr-trigger:", "Prefix of the keys in Redis")
+var redisLockTTL = flag.Duration("redis-lock-ttl", 10*time.Minute, "How long an MR stays locked by a replica processing its event, and how long other replicas wait for it")
+
+// how often a locked MR is checked again
+const redisLockRetryInterval = 200 * time.Millisecond
+
+// pipeline slots reserved by crashed replicas are freed after this
+const redisSlotReservationTTL = 10 * time.Minute
+
+// coordinator is the Redis client when -redis-url is set
+var coordinator *redisClient
+
+var errMRLocked = errors.New("the MR is being processed by another replica")
+
+var coordinationErrorsCounter = newCounter("redis_errors_total", "Redis commands failed, falling back to the state of the replica, by the operation")
+
+// releases the lock if it is still held by the token
+const redisUnlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+// reserves a slot if the running pipelines and reservations are below the limit
+const redisAcquireSlotScript = `
+local used = redis.call("SCARD", KEYS[1]) + tonumber(redis.call("GET", KEYS[2]) or "0")
+if used >= tonumber(ARGV[1]) then return 0 end
+redis.call("INCR", KEYS[2])
+redis.call("PEXPIRE", KEYS[2], ARGV[2])
+return 1`
+
+// frees a reservation, never going below zero
+const redisReleaseSlotScript = `
+if tonumber(redis.call("GET", KEYS[1]) or "0") > 0 then redis.call("DECR", KEYS[1]) end
+return 0`
+
+func configureCoordination() error {
+	if *redisURL == "" {
+		return nil
+	}
+	if err := validateRedisURL(*redisURL); err != nil {
+		return errors.New("-redis-url: " + err.Error())
+	}
+	coordinator = newRedisClient(*redisURL)
+	return nil
+}
+
+func redisKey(parts ...interface{}) string {
+	return *redisPrefix + fmt.Sprint(parts...)
+}
+
+func coordinationFailed(operation string, err error) {
+	coordinationErrorsCounter.inc(labels("operation", operation))
+	log.Println("[REDIS] ERROR", operation+":", err)
+}
+
+// markSharedDelivery records the keys for the TTL and reports whether none of
+// them was recorded before
+func markSharedDelivery(keys []string, ttl time.Duration) (bool, error) {
+	for _, key := range keys {
+		reply, err := coordinator.do("SET", redisKey("dedup:", key), "1", "PX", fmt.Sprint(ttl.Nanoseconds()/int64(time.Millisecond)), "NX")
+		if err != nil {
+			return false, err
+		}
+		if reply == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func forgetSharedDelivery(keys []string) error {
+	args := []string{"DEL"}
+	for _, key := range keys {
+		args = append(args, redisKey("dedup:", key))
+	}
+	_, err := coordinator.do(args...)
+	return err
+}
+
+// lockMR waits for the lock of the MR, and returns the function releasing it
+func lockMR(ctx context.Context, mr string) (func(), error) {
+	if coordinator == nil {
+		return func() {}, nil
+	}
+
+	key, token := redisKey("lock:", mr), newRequestID()
+	ttl := fmt.Sprint(redisLockTTL.Nanoseconds() / int64(time.Millisecond))
+	deadline := time.Now().Add(*redisLockTTL)
+	for waited := false; ; waited = true {
+		reply, err := coordinator.do("SET", key, token, "PX", ttl, "NX")
+		if err != nil {
+			coordinationFailed("lock", err)
+			return func() {}, nil
+		}
+		if reply != nil {
+			if waited {
+				logEvent(ctx, "[REDIS] acquired lock of MR:", mr)
+			}
+			break
+		}
+		if !waited {
+			logEvent(ctx, "[REDIS] waiting for the lock of MR:", mr)
+		}
+		if time.Now().After(deadline) {
+			return nil, errMRLocked
+		}
+		time.Sleep(redisLockRetryInterval)
+	}
+
+	return func() {
+		if _, err := coordinator.do("EVAL", redisUnlockScript, "1", key, token); err != nil {
+			coordinationFailed("unlock", err)
+		}
+	}, nil
+}
+
+func sharedLastProcessedEvent(mr string) (time.Time, bool, error) {
+	reply, err := coordinator.do("GET", redisKey("last:", mr))
+	if err != nil || reply == nil {
+		return time.Time{}, false, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(reply))
+	return t, err == nil, nil
+}
+
+func setSharedLastProcessedEvent(mr string, t time.Time) error {
+	ttl := fmt.Sprint(staleEventTTL.Nanoseconds() / int64(time.Millisecond))
+	_, err := coordinator.do("SET", redisKey("last:", mr), t.Format(time.RFC3339Nano), "PX", ttl)
+	return err
+}
+
+func acquireSharedSlot(projectID int64) (bool, error) {
+	reply, err := coordinator.do("EVAL", redisAcquireSlotScript, "2",
+		redisKey("running:", projectID), redisKey("reserved:", projectID),
+		strconv.Itoa(*maxPipelinesPerProject), fmt.Sprint(redisSlotReservationTTL.Nanoseconds()/int64(time.Millisecond)))
+	return reply == int64(1), err
+}
+
+// releaseSharedSlot frees the reservation, counting the pipeline as running
+// when it was created
+func releaseSharedSlot(projectID int64, pipelineID int) error {
+	if _, err := coordinator.do("EVAL", redisReleaseSlotScript, "1", redisKey("reserved:", projectID)); err != nil {
+		return err
+	}
+	if pipelineID == 0 {
+		return nil
+	}
+	if _, err := coordinator.do("SADD", redisKey("running:", projectID), strconv.Itoa(pipelineID)); err != nil {
+		return err
+	}
+	_, err := coordinator.do("SADD", redisKey("running-projects"), fmt.Sprint(projectID))
+	return err
+}
+
+// sharedRunningPipelines returns the running pipelines counted by all the
+// replicas, by project
+func sharedRunningPipelines() (map[int64][]int, error) {
+	reply, err := coordinator.do("SMEMBERS", redisKey("running-projects"))
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[int64][]int)
+	projects, _ := reply.([]interface{})
+	for _, project := range projects {
+		projectID, err := strconv.ParseInt(fmt.Sprint(project), 10, 64)
+		if err != nil {
+			continue
+		}
+		reply, err := coordinator.do("SMEMBERS", redisKey("running:", projectID))
+		if err != nil {
+			return nil, err
+		}
+		pipelines, _ := reply.([]interface{})
+		if len(pipelines) == 0 {
+			coordinator.do("SREM", redisKey("running-projects"), fmt.Sprint(projectID))
+			continue
+		}
+		for _, pipeline := range pipelines {
+			if pipelineID, err := strconv.Atoi(fmt.Sprint(pipeline)); err == nil {
+				running[projectID] = append(running[projectID], pipelineID)
+			}
+		}
+	}
+	return running, nil
+}
+
+func finishSharedPipeline(projectID int64, pipelineID int) error {
+	_, err := coordinator.do("SREM", redisKey("running:", projectID), strconv.Itoa(pipelineID))
+	return err
+}
+
+// sharedPipelineSlots returns the running and reserved pipelines of the
+// project counted by all the replicas
+func sharedPipelineSlots(projectID int64) (int, error) {
+	running, err := coordinator.do("SCARD", redisKey("running:", projectID))
+	if err != nil {
+		return 0, err
+	}
+	reserved, err := coordinator.do("GET", redisKey("reserved:", projectID))
+	if err != nil {
+		return 0, err
+	}
+	count, _ := running.(int64)
+	if reserved != nil {
+		n, _ := strconv.ParseInt(fmt.Sprint(reserved), 10, 64)
+		count += n
+	}
+	return int(count), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cronField map[int]bool
+
+// cronSchedule is a parsed cron expression, matching the minutes of its times
+type cronSchedule struct {
+	minute  cronField
+	hour    cronField
+	day     cronField
+	month   cronField
+	weekday cronField
+	// anyDay is set when the day of month or the day of week is *
+	anyDay bool
+}
+
+func parseCronField(value string, min, max int) (cronField, error) {
+	field := cronField{}
+	for _, part := range strings.Split(value, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(part, "/"); i >= 0 {
+			stepped = true
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, errors.New("invalid step: " + part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.New("invalid value: " + part)
+			}
+			to = from
+			if stepped {
+				// 5/15 runs from 5 to the end
+				to = max
+			}
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("invalid range: " + part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			field[v] = true
+		}
+	}
+	return field, nil
+}
+
+// parseCron parses the fields minute, hour, day of month, month and day of
+// week (0 or 7 is Sunday), each one *, a number, a range (1-5) or a list
+// (1,3,5), optionally with a step (0-59/15). As in cron, when both the day of
+// month and the day of week are restricted, either of them matches.
+func parseCron(expr string) (schedule cronSchedule, err error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return schedule, errors.New("expected a cron expression of 5 fields: " + expr)
+	}
+	bounds := []struct {
+		field    *cronField
+		min, max int
+	}{{&schedule.minute, 0, 59}, {&schedule.hour, 0, 23}, {&schedule.day, 1, 31}, {&schedule.month, 1, 12}, {&schedule.weekday, 0, 7}}
+	for i, b := range bounds {
+		if *b.field, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return schedule, err
+		}
+	}
+	schedule.anyDay = fields[2] == "*" || fields[4] == "*"
+	if schedule.weekday[7] {
+		schedule.weekday[0] = true
+	}
+	return schedule, nil
+}
+
+// matches reports whether the minute of the time is in the schedule
+func (c cronSchedule) matches(t time.Time) bool {
+	day := c.day[t.Day()] && c.weekday[int(t.Weekday())]
+	if !c.anyDay {
+		day = c.day[t.Day()] || c.weekday[int(t.Weekday())]
+	}
+	return c.minute[t.Minute()] && c.hour[t.Hour()] && c.month[int(t.Month())] && day
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, expected an error", expr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// 2024-01-01 was a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		expr    string
+		time    time.Time
+		matches bool
+	}{
+		{"* * * * *", at(1, 0, 0), true},
+		{"0 3 * * *", at(1, 3, 0), true},
+		{"0 3 * * *", at(1, 3, 1), false},
+		{"0 3 * * *", at(1, 4, 0), false},
+		{"0-59/15 * * * *", at(1, 5, 45), true},
+		{"0-59/15 * * * *", at(1, 5, 46), false},
+		{"*/20 * * * *", at(1, 5, 40), true},
+		{"5/20 * * * *", at(1, 5, 45), true},
+		{"5/20 * * * *", at(1, 5, 40), false},
+		{"5/1 * * * *", at(1, 5, 59), true},
+		{"5/1 * * * *", at(1, 5, 4), false},
+		{"0,30 * * * *", at(1, 5, 30), true},
+		{"0 22 * * 1-5", at(1, 22, 0), true},
+		{"0 22 * * 1-5", at(6, 22, 0), false},
+		{"0 6 * * 0", at(7, 6, 0), true},
+		{"0 6 * * 7", at(7, 6, 0), true},
+		{"0 6 * * 6,7", at(6, 6, 0), true},
+		{"0 0 1 * *", at(1, 0, 0), true},
+		{"0 0 1 * *", at(2, 0, 0), false},
+		{"0 0 * 2 *", at(1, 0, 0), false},
+		// either the day of month or the day of week matches when both are
+		// restricted
+		{"0 0 15 * 1", at(15, 0, 0), true},
+		{"0 0 15 * 1", at(8, 0, 0), true},
+		{"0 0 15 * 1", at(9, 0, 0), false},
+		// both have to match when one of them is *
+		{"0 0 * * 1", at(9, 0, 0), false},
+		{"0 0 9 * *", at(9, 0, 0), true},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", test.expr, err)
+			continue
+		}
+		if matches := schedule.matches(test.time); matches != test.matches {
+			t.Errorf("%q matches %s: %v, expected %v", test.expr, test.time.Format(time.RFC1123), matches, test.matches)
+		}
+	}
+}
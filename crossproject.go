@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+)
+
+var allowCrossProject = flag.Bool("cross-project", false, "Support MRs between different projects of the same group which are not forks of each other")
+
+type projectDetails struct {
+	ID                 int64    `json:"id"`
+	PathWithNamespace  string   `json:"path_with_namespace"`
+	ForkedFromProject  *project `json:"forked_from_project"`
+	HTTPURLToRepo      string   `json:"http_url_to_repo"`
+	MergeTrainsEnabled bool     `json:"merge_trains_enabled"`
+}
+
+func getProject(ctx context.Context, projectID int64) (details projectDetails, err error) {
+	key := projectKey(ctx, projectID)
+	if cached, ok := cachedLookup(projectCache, "project", key); ok {
+		return cached.(projectDetails), nil
+	}
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d", *gitlabURL, projectID)
+	if _, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &details); err == nil {
+		projectCache.set(key, details)
+	}
+	return
+}
+
+func projectNamespace(p project) string {
+	if p.PathWithNamespace != "" {
+		return path.Dir(p.PathWithNamespace)
+	}
+	return p.Namespace
+}
+
+// checkCrossProject returns an error when the MR between two different
+// projects can not be handled: forks, projects of different groups, or the
+// cross-project mode being disabled.
+func checkCrossProject(ctx context.Context, webhook webhookRequest) error {
+	if !*allowCrossProject {
+		return errors.New("forks are not supported")
+	}
+
+	source, target := webhook.Attributes.Source, webhook.Attributes.Target
+	if projectNamespace(source) == "" || projectNamespace(source) != projectNamespace(target) {
+		return errors.New("cross-project MRs are supported within the same group only")
+	}
+
+	details, err := getProject(ctx, webhook.Attributes.SourceProjectID)
+	if err != nil {
+		return errors.New("error getting details of the source project:" + err.Error())
+	}
+	if details.ForkedFromProject != nil {
+		return errors.New("forks are not supported")
+	}
+	return nil
+}
+
+func reportCrossProjectPipeline(ctx context.Context, webhook webhookRequest, pipeline *pipeline) {
+	body := fmt.Sprintf("Pipeline [#%d](%s) was triggered in `%s` for commit %s.",
+		pipeline.ID, pipeline.WebURL, webhook.Attributes.Source.PathWithNamespace, webhook.Attributes.LastCommit.ID)
+
+	if *shadowMode {
+		return
+	}
+	if budgetExhausted(ctx) {
+		logEvent(ctx, "[MR] skipped reporting cross-project pipeline:", errBudgetExhausted)
+		return
+	}
+	if _, err := createMRNote(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.IID, body); err != nil {
+		logEvent(ctx, "[MR] ERROR reporting cross-project pipeline:", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// events shown on the dashboard
+const dashboardEvents = 100
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"short": func(sha string) string {
+		if len(sha) > 8 {
+			return sha[:8]
+		}
+		return sha
+	},
+	"color": func(disposition string) string {
+		switch disposition {
+		case "triggered":
+			return "#dfd"
+		case "error":
+			return "#fdd"
+		case "deferred":
+			return "#ffd"
+		}
+		return "#eee"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>MR trigger</title><meta http-equiv="refresh" content="30"></head>
+<body>
+<h1>MR trigger</h1>
+<p>Last {{.Total}} events: {{range $disposition, $count := .Counts}}{{$disposition}}: {{$count}} &nbsp; {{end}}
+error rate: {{printf "%.1f" .ErrorRate}}% &nbsp; cancelled builds: {{.Cancelled}}</p>
+<form method="GET">
+<input name="project" placeholder="project ID" value="{{.Project}}" size="10">
+<select name="disposition">
+<option value="">all</option>
+{{range .Dispositions}}<option {{if eq . $.Disposition}}selected{{end}}>{{.}}</option>{{end}}
+</select>
+<button type="submit">Filter</button>
+</form>
+<table border="1" cellpadding="4">
+<tr><th>Time</th><th>Project</th><th>MR</th><th>Action</th><th>Commit</th><th>Result</th><th>Reason</th><th>Pipeline</th><th>Cancelled builds</th><th>Request</th></tr>
+{{range .Events}}
+<tr style="background: {{color .Disposition}}">
+<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.ProjectID}}</td>
+<td>{{.MR}}</td>
+<td>{{.Action}}</td>
+<td>{{short .SHA}}</td>
+<td>{{.Disposition}}</td>
+<td>{{.Reason}}</td>
+<td>{{if .PipelineURL}}<a href="{{.PipelineURL}}">{{.PipelineID}}</a>{{else if .PipelineID}}{{.PipelineID}}{{end}}</td>
+<td>{{range .Cancelled}}{{.}} {{end}}</td>
+<td>{{.RequestID}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// handlerAdminDashboard shows the recent events, so teams can see why their
+// MR did (not) get a pipeline
+func handlerAdminDashboard(w http.ResponseWriter, r *http.Request) {
+	events := recentEvents(r, false)
+
+	counts := make(map[string]int)
+	cancelled := 0
+	for _, event := range events {
+		counts[event.Disposition]++
+		cancelled += len(event.Cancelled)
+	}
+	total := len(events)
+	errorRate := 0.0
+	if total > 0 {
+		errorRate = 100 * float64(counts["error"]) / float64(total)
+	}
+	if len(events) > dashboardEvents {
+		events = events[:dashboardEvents]
+	}
+
+	data := map[string]interface{}{
+		"Events":       events,
+		"Total":        total,
+		"Counts":       counts,
+		"ErrorRate":    errorRate,
+		"Cancelled":    cancelled,
+		"Project":      r.FormValue("project"),
+		"Disposition":  r.FormValue("disposition"),
+		"Dispositions": []string{"triggered", "skipped", "deferred", "error"},
+	}
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Println("[DASHBOARD] ERROR rendering page:", err)
+	}
+}
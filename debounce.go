@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var debounceUpdates = flag.Duration("debounce", 0, "Quiet period coalescing rapid update events of the same MR, only the last one is processed (0 disables)")
+
+type pendingUpdate struct {
+	timer   *time.Timer
+	webhook webhookRequest
+}
+
+var pendingUpdates = struct {
+	sync.Mutex
+	updates map[string]*pendingUpdate
+}{updates: make(map[string]*pendingUpdate)}
+
+func mrKey(webhook webhookRequest) string {
+	if webhook.Profile != "" {
+		return fmt.Sprintf("%s/%d!%d", webhook.Profile, webhook.Attributes.TargetProjectID, webhook.Attributes.IID)
+	}
+	return fmt.Sprintf("%d!%d", webhook.Attributes.TargetProjectID, webhook.Attributes.IID)
+}
+
+// debounceWebhook cancels the pending update of the MR, if any, and queues
+// the webhook when it is an update. It reports whether the webhook was queued.
+func debounceWebhook(webhook webhookRequest) bool {
+	if *debounceUpdates <= 0 {
+		return false
+	}
+
+	key := mrKey(webhook)
+
+	pendingUpdates.Lock()
+	defer pendingUpdates.Unlock()
+
+	if pending, ok := pendingUpdates.updates[key]; ok {
+		pending.timer.Stop()
+		delete(pendingUpdates.updates, key)
+		log.Println("[DEBOUNCE]", "MR:", key, "cancelled update for commit:", pending.webhook.Attributes.LastCommit.ID,
+			"superseded by", webhook.Attributes.Action, "of commit:", webhook.Attributes.LastCommit.ID)
+	}
+
+	if webhook.Attributes.Action != "update" {
+		return false
+	}
+
+	pending := &pendingUpdate{webhook: webhook}
+	pending.timer = time.AfterFunc(*debounceUpdates, func() {
+		runPendingUpdate(key, pending)
+	})
+	pendingUpdates.updates[key] = pending
+	return true
+}
+
+func runPendingUpdate(key string, pending *pendingUpdate) {
+	pendingUpdates.Lock()
+	if pendingUpdates.updates[key] != pending {
+		pendingUpdates.Unlock()
+		return
+	}
+	delete(pendingUpdates.updates, key)
+	pendingUpdates.Unlock()
+
+	message, code := processSerialized(eventContext(), pending.webhook)
+	log.Println("[DEBOUNCE]", "MR:", key, code, ":", message)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/pprof"
+	"runtime"
+)
+
+var debugListen = flag.String("debug-listen", "", "Listen address of the pprof and expvar debug endpoints, eg. 127.0.0.1:6060 (disabled when empty, protected by -admin-token when set)")
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+}
+
+// redactedHandler scrubs secrets (eg. of the command line) from the output
+func redactedHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		next.ServeHTTP(recorder, r)
+		for name, values := range recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.Code)
+		io.WriteString(w, redact(recorder.Body.String()))
+	})
+}
+
+// serveDebug serves /debug/pprof/ and /debug/vars on their own listener, not
+// exposed together with the webhook endpoint
+func serveDebug() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.Handle("/debug/pprof/cmdline", redactedHandler(http.HandlerFunc(pprof.Cmdline)))
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", redactedHandler(expvar.Handler()))
+
+	var handler http.Handler = mux
+	if adminCredentials.configured() {
+		handler = withAdminAuth(mux.ServeHTTP)
+	} else {
+		log.Println("[DEBUG] WARNING debug endpoints are not authenticated, set -admin-token or -admin-basic-auth to protect them")
+	}
+
+	log.Println("[DEBUG]", "listening on", *debugListen)
+	log.Fatal(http.ListenAndServe(*debugListen, handler))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dedupTTL = flag.Duration("dedup-ttl", 10*time.Minute, "How long delivered webhooks are remembered to skip GitLab retries of them (0 disables), can be overridden per project")
+
+// bounds of the per-project dedup window
+const (
+	minDedupTTL = time.Minute
+	maxDedupTTL = 30 * 24 * time.Hour
+)
+
+// expired deliveries are purged at most this often
+const dedupPurgeInterval = time.Minute
+
+var deliveries = struct {
+	sync.Mutex
+	seen      map[string]time.Time
+	lastPurge time.Time
+}{seen: make(map[string]time.Time)}
+
+var dedupEntriesGauge = newGauge("webhook_dedup_entries", "Deliveries remembered to skip redeliveries of them")
+var dedupEvictedCounter = newCounter("webhook_dedup_evicted_total", "Remembered deliveries evicted after their dedup window expired")
+var dedupDuplicatesCounter = newCounter("webhook_dedup_duplicates_total", "Redeliveries of webhooks skipped, by project")
+
+// statusRecorder remembers the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets streaming responses through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// deliveryKeys identify a delivery by the event UUID, which is stable across
+// retries, or by its content for GitLab versions not sending the UUID.
+func deliveryKeys(eventUUID string, webhook webhookRequest) []string {
+	if eventUUID != "" {
+		return []string{"uuid:" + eventUUID}
+	}
+	// distinct events of the same commit, eg. edits and label changes of the
+	// MR, differ in their update time
+	key := fmt.Sprintf("mr:%d:%d:%s:%s:%s",
+		webhook.Attributes.TargetProjectID,
+		webhook.Attributes.IID,
+		webhook.Attributes.LastCommit.ID,
+		webhook.Attributes.Action,
+		webhook.Attributes.UpdatedAt)
+	if changes := webhook.Changes.Labels; changes != nil {
+		// label changes of the same commit are separate events
+		key += ":labels:" + strings.Join(labelTitles(changes.Current), ",")
+	}
+	return []string{key}
+}
+
+// dedupWindow returns how long deliveries of the project are remembered
+func dedupWindow(projectID int64) time.Duration {
+	if ttl, err := time.ParseDuration(projectOverrideFor(projectID).DedupTTL); err == nil {
+		return ttl
+	}
+	return *dedupTTL
+}
+
+func validateDedupTTL(value string) error {
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid dedup window: %s", err)
+	}
+	if ttl < minDedupTTL || ttl > maxDedupTTL {
+		return fmt.Errorf("dedup window must be between %v and %v, but it was: %v", minDedupTTL, maxDedupTTL, ttl)
+	}
+	return nil
+}
+
+// markDelivery records the keys and reports whether none of them was seen
+// within the dedup window of the project, ie. whether the delivery should be
+// processed.
+func markDelivery(projectID int64, keys []string) bool {
+	ttl := dedupWindow(projectID)
+	if ttl <= 0 {
+		return true
+	}
+
+	if coordinator != nil {
+		fresh, err := markSharedDelivery(keys, ttl)
+		if err == nil {
+			if !fresh {
+				dedupDuplicatesCounter.inc(labels("project", fmt.Sprint(projectID)))
+			}
+			return fresh
+		}
+		coordinationFailed("dedup", err)
+	}
+
+	deliveries.Lock()
+	defer deliveries.Unlock()
+
+	now := time.Now()
+	if now.Sub(deliveries.lastPurge) >= dedupPurgeInterval {
+		evicted := 0
+		for key, expires := range deliveries.seen {
+			if now.After(expires) {
+				delete(deliveries.seen, key)
+				evicted++
+			}
+		}
+		deliveries.lastPurge = now
+		dedupEvictedCounter.add("", float64(evicted))
+	}
+
+	for _, key := range keys {
+		if expires, ok := deliveries.seen[key]; ok && now.Before(expires) {
+			dedupDuplicatesCounter.inc(labels("project", fmt.Sprint(projectID)))
+			return false
+		}
+	}
+	for _, key := range keys {
+		deliveries.seen[key] = now.Add(ttl)
+	}
+	dedupEntriesGauge.set("", float64(len(deliveries.seen)))
+	return true
+}
+
+func forgetDelivery(keys []string) {
+	if coordinator != nil {
+		if err := forgetSharedDelivery(keys); err != nil {
+			coordinationFailed("dedup", err)
+		}
+	}
+
+	deliveries.Lock()
+	defer deliveries.Unlock()
+
+	for _, key := range keys {
+		delete(deliveries.seen, key)
+	}
+	dedupEntriesGauge.set("", float64(len(deliveries.seen)))
+}
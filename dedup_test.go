@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeliveryKeys(t *testing.T) {
+	webhook := func(action, updatedAt string, labels *labelChanges) webhookRequest {
+		var w webhookRequest
+		w.Attributes.TargetProjectID = 42
+		w.Attributes.IID = 7
+		w.Attributes.LastCommit.ID = "abc"
+		w.Attributes.Action = action
+		w.Attributes.UpdatedAt = updatedAt
+		w.Changes.Labels = labels
+		return w
+	}
+	tests := []struct {
+		name    string
+		uuid    string
+		webhook webhookRequest
+		keys    []string
+	}{
+		{"uuid only", "0123-4567", webhook("update", "2024-01-01 10:00:00 UTC", nil), []string{"uuid:0123-4567"}},
+		{"content", "", webhook("update", "2024-01-01 10:00:00 UTC", nil), []string{"mr:42:7:abc:update:2024-01-01 10:00:00 UTC"}},
+		{"labels", "", webhook("update", "2024-01-01 10:00:00 UTC", &labelChanges{
+			Previous: []mrLabel{{"bug"}},
+			Current:  []mrLabel{{"perf-test"}, {"bug"}},
+		}), []string{"mr:42:7:abc:update:2024-01-01 10:00:00 UTC:labels:bug,perf-test"}},
+	}
+	for _, test := range tests {
+		if keys := deliveryKeys(test.uuid, test.webhook); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%s: deliveryKeys = %q, expected %q", test.name, keys, test.keys)
+		}
+	}
+}
+
+func TestDeliveryKeysDistinguishUpdates(t *testing.T) {
+	var first, second webhookRequest
+	first.Attributes.Action, second.Attributes.Action = "update", "update"
+	first.Attributes.LastCommit.ID, second.Attributes.LastCommit.ID = "abc", "abc"
+	first.Attributes.UpdatedAt = "2024-01-01 10:00:00 UTC"
+	second.Attributes.UpdatedAt = "2024-01-01 10:05:00 UTC"
+	if reflect.DeepEqual(deliveryKeys("", first), deliveryKeys("", second)) {
+		t.Error("updates of the same commit at different times have the same keys")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+/*
+Description directives let MR authors tweak the pipeline of their MR without
+changing the repository: variables are read from CI-VAR: lines, or from a
+fenced block of the ci-variables language, of the MR description:
+
+    CI-VAR: RUN_E2E=true
+
+    ```ci-variables
+    RUN_E2E=true
+    E2E_SUITE=smoke
+    ```
+
+Only the variables allowed by -description-variables are passed, as anybody
+who can edit the description sets them; the ones set by the overrides of the
+project and the policy take precedence.
+*/
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"path"
+	"strings"
+)
+
+var descriptionVariables = flag.String("description-variables", "", "Comma separated names or globs of variables which MR authors may set in the MR description (eg. RUN_*), disabled when empty")
+
+// descriptionDirective prefixes a variable line in the description
+const descriptionDirective = "CI-VAR:"
+
+func validateDescriptionVariables() error {
+	for _, pattern := range splitList(*descriptionVariables) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("invalid -description-variables pattern " + pattern + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func descriptionVariableAllowed(name string) bool {
+	// the standard variables can not be overridden
+	if strings.HasPrefix(name, "MR_") || strings.HasPrefix(name, "CI_") {
+		return false
+	}
+	for _, pattern := range splitList(*descriptionVariables) {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDescriptionVariables returns the variables of the CI-VAR: lines and
+// the ci-variables blocks of the description
+func parseDescriptionVariables(description string) map[string]string {
+	variables := make(map[string]string)
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(description))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "```"):
+			inBlock = !inBlock && strings.TrimSpace(strings.TrimPrefix(line, "```")) == "ci-variables"
+			continue
+		case strings.HasPrefix(line, descriptionDirective):
+			line = strings.TrimSpace(strings.TrimPrefix(line, descriptionDirective))
+		case !inBlock:
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			continue
+		}
+		variables[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return variables
+}
+
+// applyDescriptionVariables adds the allowed variables of the MR description
+// to the variables of the override
+func applyDescriptionVariables(ctx context.Context, mr mergeRequest, override *projectOverride) {
+	if *descriptionVariables == "" {
+		return
+	}
+	directives := parseDescriptionVariables(mr.Description)
+	if len(directives) == 0 {
+		return
+	}
+
+	variables := make(map[string]string)
+	for name, value := range directives {
+		if !variableNameRegexp.MatchString(name) || !descriptionVariableAllowed(name) {
+			logEvent(ctx, "[MR] ignored variable of the description:", name)
+			continue
+		}
+		variables[name] = value
+	}
+	for name, value := range override.Variables {
+		variables[name] = value
+	}
+	override.Variables = variables
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDescriptionVariables(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		variables   map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"no directives", "Fixes the login\n\nRUN_E2E=true", map[string]string{}},
+		{"lines", "Fixes it\nCI-VAR: RUN_E2E=true\n  CI-VAR:E2E_SUITE = smoke \n", map[string]string{"RUN_E2E": "true", "E2E_SUITE": "smoke"}},
+		{"value with =", "CI-VAR: OPTS=a=b", map[string]string{"OPTS": "a=b"}},
+		{"empty value", "CI-VAR: RUN_E2E=", map[string]string{"RUN_E2E": ""}},
+		{"no name", "CI-VAR: =true\nCI-VAR: RUN_E2E", map[string]string{}},
+		{"block", "Fixes it\n```ci-variables\nRUN_E2E=true\n\nE2E_SUITE=smoke\n```\nRUN_LATER=true", map[string]string{"RUN_E2E": "true", "E2E_SUITE": "smoke"}},
+		{"other block", "```sh\nRUN_E2E=true\n```", map[string]string{}},
+		{"unterminated block", "```ci-variables\nRUN_E2E=true", map[string]string{"RUN_E2E": "true"}},
+		{"block after other block", "```\nA=1\n```\n```ci-variables\nB=2\n```", map[string]string{"B": "2"}},
+		{"later wins", "CI-VAR: RUN_E2E=false\nCI-VAR: RUN_E2E=true", map[string]string{"RUN_E2E": "true"}},
+		{"crlf", "CI-VAR: RUN_E2E=true\r\n", map[string]string{"RUN_E2E": "true"}},
+	}
+	for _, test := range tests {
+		if variables := parseDescriptionVariables(test.description); !reflect.DeepEqual(variables, test.variables) {
+			t.Errorf("%s: parseDescriptionVariables = %v, expected %v", test.name, variables, test.variables)
+		}
+	}
+}
+
+func TestDescriptionVariableAllowed(t *testing.T) {
+	defer func(value string) { *descriptionVariables = value }(*descriptionVariables)
+	*descriptionVariables = "RUN_*,E2E_SUITE,MR_*,CI_*"
+
+	for name, allowed := range map[string]bool{
+		"RUN_E2E":   true,
+		"E2E_SUITE": true,
+		"E2E_OTHER": false,
+		"MR_IID":    false,
+		"CI_DEBUG":  false,
+	} {
+		if descriptionVariableAllowed(name) != allowed {
+			t.Errorf("descriptionVariableAllowed(%q) = %v, expected %v", name, !allowed, allowed)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+)
+
+var dryRun = flag.Bool("dry-run", false, "Perform all the lookups and log the pipelines which would be triggered, the builds which would be cancelled and the MR flags which would be updated, without changing anything in GitLab")
+
+var errDryRun = errors.New("dry run - the change was not sent to GitLab")
+
+// dryRunning reports whether changes are only logged: in dry-run mode, or
+// while simulating an event on /simulate
+func dryRunning(ctx context.Context) bool {
+	return *dryRun || simulationFrom(ctx) != nil
+}
+
+// dryRunGuard refuses the GitLab API requests which would change anything,
+// so no code path can mutate in dry-run mode even when it does not check the
+// flag itself
+func dryRunGuard(ctx context.Context, method, urlStr string) error {
+	if !dryRunning(ctx) || method == "GET" {
+		return nil
+	}
+	logEvent(ctx, "[DRY-RUN] would send:", method, redact(urlStr))
+	return errDryRun
+}
+
+func dryRunPipeline(ctx context.Context, projectID int64, ref string, variables map[string]string) {
+	logEvent(ctx, "[DRY-RUN] would trigger pipeline in project:", projectID, "ref:", ref, "variables:", variables)
+	if sim := simulationFrom(ctx); sim != nil {
+		sim.Lock()
+		sim.Pipeline = &simulatedPipeline{ProjectID: projectID, Ref: ref, Variables: variables}
+		sim.Unlock()
+	}
+}
+
+func dryRunCancel(ctx context.Context, pipelineID int, build job) {
+	logEvent(ctx, "[DRY-RUN] In pipeline", pipelineID, "would cancel build:", build.ID, "(", build.Name, ")")
+	if sim := simulationFrom(ctx); sim != nil {
+		sim.Lock()
+		sim.Cancellations = append(sim.Cancellations, simulatedCancellation{PipelineID: pipelineID, BuildID: build.ID, Name: build.Name})
+		sim.Unlock()
+	}
+}
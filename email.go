@@ -0,0 +1,157 @@
+package main
+
+/*
+Email alerts catch token rot early: when the triggers of a project keep
+failing (eg. an expired private token or a revoked trigger), a digest of the
+failing projects with their errors and affected MRs is mailed every
+-email-digest-interval.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var smtpAddr = flag.String("smtp-addr", "", "Address of the SMTP server sending email alerts, eg. smtp.example.com:587")
+var smtpUsername = flag.String("smtp-username", "", "User name of the SMTP server, no authentication when empty")
+var smtpPassword = flag.String("smtp-password", "", "Password of the SMTP server")
+var emailFrom = flag.String("email-from", "", "Sender address of email alerts")
+var emailTo = flag.String("email-to", "", "Comma separated recipients of email alerts about projects whose triggers keep failing (disabled when empty)")
+var emailFailureThreshold = flag.Int("email-failure-threshold", 3, "Consecutive failed triggers of a project after which it is reported in the email digest")
+var emailDigestInterval = flag.Duration("email-digest-interval", time.Hour, "How often the digest of the failing projects is mailed")
+
+// errors and MRs kept per failing project
+const maxFailureDetails = 10
+
+type projectFailures struct {
+	count  int
+	since  time.Time
+	errors []string
+	mrs    []string
+}
+
+var failingProjects = struct {
+	sync.Mutex
+	projects map[int64]*projectFailures
+}{projects: make(map[int64]*projectFailures)}
+
+func emailEnabled() bool {
+	return *emailTo != ""
+}
+
+func validateEmailFlags() error {
+	if !emailEnabled() {
+		return nil
+	}
+	if *smtpAddr == "" || *emailFrom == "" {
+		return errors.New("-email-to requires -smtp-addr and -email-from")
+	}
+	if _, _, err := net.SplitHostPort(*smtpAddr); err != nil {
+		return errors.New("-smtp-addr: " + err.Error())
+	}
+	registerSecrets(*smtpPassword)
+	return nil
+}
+
+func appendDistinct(list []string, value string) []string {
+	if contains(list, value) || len(list) >= maxFailureDetails {
+		return list
+	}
+	return append(list, value)
+}
+
+// recordTriggerOutcome counts the consecutive failed triggers of the project,
+// a triggered pipeline resets them
+func recordTriggerOutcome(projectID int64, mr string, failed bool, message string) {
+	if !emailEnabled() || projectID == 0 {
+		return
+	}
+
+	failingProjects.Lock()
+	defer failingProjects.Unlock()
+
+	if !failed {
+		delete(failingProjects.projects, projectID)
+		return
+	}
+	failures, ok := failingProjects.projects[projectID]
+	if !ok {
+		failures = &projectFailures{since: time.Now()}
+		failingProjects.projects[projectID] = failures
+	}
+	failures.count++
+	failures.errors = appendDistinct(failures.errors, redact(message))
+	failures.mrs = appendDistinct(failures.mrs, mr)
+}
+
+// failureDigest returns the digest of the projects failing persistently, and
+// forgets them so they are reported again only after further failures
+func failureDigest() string {
+	failingProjects.Lock()
+	defer failingProjects.Unlock()
+
+	var projectIDs []int64
+	for projectID, failures := range failingProjects.projects {
+		if failures.count >= *emailFailureThreshold {
+			projectIDs = append(projectIDs, projectID)
+		}
+	}
+	sort.Slice(projectIDs, func(i, j int) bool { return projectIDs[i] < projectIDs[j] })
+
+	var digest bytes.Buffer
+	for _, projectID := range projectIDs {
+		failures := failingProjects.projects[projectID]
+		name := fmt.Sprint(projectID)
+		if path := rememberedProjectPath(projectID); path != "" {
+			name = path + " (" + name + ")"
+		}
+		fmt.Fprintf(&digest, "Project %s: %d failed triggers since %s\n", name, failures.count, failures.since.Format(time.RFC3339))
+		fmt.Fprintf(&digest, "  Affected MRs: %s\n", strings.Join(failures.mrs, ", "))
+		for _, e := range failures.errors {
+			fmt.Fprintf(&digest, "  Error: %s\n", e)
+		}
+		digest.WriteString("\n")
+		delete(failingProjects.projects, projectID)
+	}
+	return digest.String()
+}
+
+func sendEmail(subject, body string) error {
+	var auth smtp.Auth
+	if *smtpUsername != "" {
+		host, _, _ := net.SplitHostPort(*smtpAddr)
+		auth = smtp.PlainAuth("", *smtpUsername, *smtpPassword, host)
+	}
+	to := splitList(*emailTo)
+	message := "From: " + *emailFrom + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(body, "\n", "\r\n", -1)
+	return smtp.SendMail(*smtpAddr, auth, *emailFrom, to, []byte(message))
+}
+
+func runEmailDigest() {
+	for range time.Tick(*emailDigestInterval) {
+		digest := failureDigest()
+		if digest == "" {
+			continue
+		}
+		body := "Triggers of the following projects keep failing on " + *gitlabURL +
+			", check the private token and the trigger tokens of the projects:\n\n" + digest
+		if err := sendEmail("MR trigger service: triggers keep failing", body); err != nil {
+			log.Println("[EMAIL] ERROR sending digest:", err)
+			continue
+		}
+		log.Println("[EMAIL] sent digest of failing projects to", *emailTo)
+	}
+}
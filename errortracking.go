@@ -0,0 +1,218 @@
+package main
+
+/*
+Error tracking reports panics and failed GitLab API calls, with the context of
+the webhook being processed, to Sentry or to a generic JSON hook, so they
+outlive the logs of the container.
+
+References:
+ - https://develop.sentry.dev/sdk/store/
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+var sentryDSN = flag.String("sentry-dsn", "", "Sentry DSN receiving panics and GitLab API errors, eg. https://key@sentry.example.com/42")
+var errorHookURL = flag.String("error-hook-url", "", "URL receiving panics and GitLab API errors as JSON")
+
+// reports waiting to be sent, further ones are dropped
+const errorReportQueueSize = 100
+
+type errorReport struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Tags    map[string]string      `json:"tags"`
+	Extra   map[string]interface{} `json:"extra,omitempty"`
+}
+
+type sentryEndpoint struct {
+	storeURL string
+	auth     string
+}
+
+var errorReports = make(chan errorReport, errorReportQueueSize)
+
+var sentry *sentryEndpoint
+
+func errorTrackingEnabled() bool {
+	return *sentryDSN != "" || *errorHookURL != ""
+}
+
+// parseSentryDSN returns the store endpoint of the DSN
+// {scheme}://{key}[:{secret}]@{host}{/path}/{project_id}
+func parseSentryDSN(dsn string) (*sentryEndpoint, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("missing the public key")
+	}
+	project := path.Base(u.Path)
+	if project == "" || project == "/" || project == "." {
+		return nil, errors.New("missing the project ID")
+	}
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=gitlab-merge-request-trigger/%s, sentry_key=%s", buildVersion, u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	storeURL := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, strings.TrimSuffix(path.Dir(u.Path), "/"), project)
+	return &sentryEndpoint{storeURL: storeURL, auth: auth}, nil
+}
+
+func configureErrorTracking() error {
+	if *sentryDSN == "" {
+		return nil
+	}
+	endpoint, err := parseSentryDSN(*sentryDSN)
+	if err != nil {
+		return errors.New("-sentry-dsn: " + err.Error())
+	}
+	registerSecrets(*sentryDSN)
+	sentry = endpoint
+	return nil
+}
+
+// reportError queues the report of the error with the context of the event
+func reportError(ctx context.Context, message string, extra map[string]interface{}) {
+	if !errorTrackingEnabled() {
+		return
+	}
+
+	tags := map[string]string{"gitlab_url": *gitlabURL}
+	if id := requestID(ctx); id != "" {
+		tags["request_id"] = id
+	}
+	if name, _ := ctx.Value(profileKey{}).(string); name != "" {
+		tags["profile"] = name
+	}
+	if record, ok := ctx.Value(eventRecordKey{}).(*eventRecord); ok {
+		tags["project_id"] = fmt.Sprint(record.ProjectID)
+		tags["mr"] = record.MR
+		tags["action"] = record.Action
+		tags["sha"] = record.SHA
+	}
+
+	select {
+	case errorReports <- errorReport{Time: time.Now(), Level: "error", Message: redact(message), Tags: tags, Extra: extra}:
+	default:
+		log.Println("[ERRORS] dropped report, too many queued:", redact(message))
+	}
+}
+
+// reportGitLabError reports failed GitLab API calls: unreachable GitLab,
+// server errors and rejected tokens. Other client errors are expected by
+// the flow (eg. removed branches).
+func reportGitLabError(ctx context.Context, method, urlStr string, resp *http.Response, err error) {
+	if err == nil {
+		return
+	}
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	if status != 0 && status < 500 && status != http.StatusUnauthorized && status != http.StatusForbidden {
+		return
+	}
+
+	endpoint := urlStr
+	if u, parseErr := url.Parse(urlStr); parseErr == nil {
+		endpoint = u.Path
+	}
+	reportError(ctx, fmt.Sprintf("GitLab API error: %s %s: %s", method, endpoint, err), map[string]interface{}{
+		"method":   method,
+		"endpoint": endpoint,
+		"status":   status,
+	})
+}
+
+// withPanicReporting reports the panics of the handlers, and responds with
+// an internal server error instead of dropping the connection
+func withPanicReporting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				stack := string(debug.Stack())
+				log.Println("[PANIC]", p, "request:", requestID(r.Context()), "\n"+stack)
+				reportError(r.Context(), fmt.Sprint("panic: ", p), map[string]interface{}{
+					"path":  r.URL.Path,
+					"stack": stack,
+				})
+				httpError(w, r, "internal error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *sentryEndpoint) send(report errorReport) error {
+	hostname, _ := os.Hostname()
+	event := map[string]interface{}{
+		"event_id":    newEventID(),
+		"timestamp":   report.Time.UTC().Format("2006-01-02T15:04:05"),
+		"level":       report.Level,
+		"platform":    "go",
+		"logger":      "gitlab-merge-request-trigger",
+		"message":     report.Message,
+		"release":     buildVersion,
+		"server_name": hostname,
+		"tags":        report.Tags,
+		"extra":       report.Extra,
+	}
+	data, _ := json.Marshal(event)
+
+	req, err := http.NewRequest("POST", s.storeURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func runErrorReporting() {
+	for report := range errorReports {
+		if sentry != nil {
+			if err := sentry.send(report); err != nil {
+				log.Println("[ERRORS] ERROR reporting to Sentry:", err)
+			}
+		}
+		if *errorHookURL != "" {
+			if err := postJSON(*errorHookURL, report); err != nil {
+				log.Println("[ERRORS] ERROR reporting to", *errorHookURL, ":", err)
+			}
+		}
+	}
+}
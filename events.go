@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxEventRecords = 1000
+
+// eventRecord is the outcome of processing an event, served on /admin/events
+type eventRecord struct {
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"request_id,omitempty"`
+	ProjectID   int64     `json:"project_id"`
+	MR          string    `json:"mr"`
+	Action      string    `json:"action"`
+	SHA         string    `json:"sha"`
+	Disposition string    `json:"disposition"`
+	Code        int       `json:"code"`
+	Reason      string    `json:"reason"`
+	PipelineID  int       `json:"pipeline_id,omitempty"`
+	PipelineURL string    `json:"pipeline_url,omitempty"`
+	Cancelled   []int     `json:"cancelled_builds,omitempty"`
+}
+
+var eventRecords = struct {
+	sync.Mutex
+	records []*eventRecord
+}{}
+
+type eventRecordKey struct{}
+
+// startEventRecord returns the context in which the pipeline of the event is
+// noted with notePipeline
+func startEventRecord(ctx context.Context, webhook webhookRequest) (context.Context, *eventRecord) {
+	record := &eventRecord{
+		Time:      time.Now(),
+		RequestID: requestID(ctx),
+		ProjectID: webhook.Attributes.TargetProjectID,
+		MR:        mrKey(webhook),
+		Action:    webhook.Attributes.Action,
+		SHA:       webhook.Attributes.LastCommit.ID,
+	}
+	return context.WithValue(ctx, eventRecordKey{}, record), record
+}
+
+func notePipeline(ctx context.Context, pipeline *pipeline) {
+	if record, ok := ctx.Value(eventRecordKey{}).(*eventRecord); ok && pipeline != nil {
+		eventRecords.Lock()
+		record.PipelineID = pipeline.ID
+		record.PipelineURL = pipeline.WebURL
+		eventRecords.Unlock()
+	}
+}
+
+func noteCancelledBuild(ctx context.Context, buildID int) {
+	outcome := outcomeEvent{Event: "cancelled", Time: time.Now(), RequestID: requestID(ctx), BuildID: buildID}
+	if record, ok := ctx.Value(eventRecordKey{}).(*eventRecord); ok {
+		eventRecords.Lock()
+		record.Cancelled = append(record.Cancelled, buildID)
+		outcome.ProjectID, outcome.MR, outcome.Action, outcome.SHA = record.ProjectID, record.MR, record.Action, record.SHA
+		eventRecords.Unlock()
+	}
+	publishEvent("cancelled", map[string]interface{}{"request_id": requestID(ctx), "build_id": buildID})
+	publishOutcome(outcome)
+}
+
+func disposition(code int, pipelineID int) string {
+	switch {
+	case code >= 400:
+		return "error"
+	case pipelineID != 0:
+		return "triggered"
+	case code == http.StatusAccepted:
+		return "deferred"
+	}
+	return "skipped"
+}
+
+func finishEventRecord(record *eventRecord, message string, code int) {
+	eventRecords.Lock()
+	defer eventRecords.Unlock()
+
+	record.Code = code
+	record.Reason = message
+	record.Disposition = disposition(code, record.PipelineID)
+	eventRecords.records = append(eventRecords.records, record)
+	if len(eventRecords.records) > maxEventRecords {
+		eventRecords.records = eventRecords.records[1:]
+	}
+	publishEvent(record.Disposition, record)
+	publishOutcome(outcomeFromRecord(*record))
+	switch record.Disposition {
+	case "error":
+		recordTriggerOutcome(record.ProjectID, record.MR, true, message)
+		notify(notification{Kind: notifyTriggerFailed, ProjectID: record.ProjectID, MR: record.MR, RequestID: record.RequestID, Message: message})
+	case "triggered":
+		recordTriggerOutcome(record.ProjectID, record.MR, false, message)
+		notify(notification{Kind: notifyTriggered, ProjectID: record.ProjectID, MR: record.MR, RequestID: record.RequestID,
+			Message: message, PipelineURL: record.PipelineURL})
+	}
+}
+
+// recordEvent records an event which was not processed
+func recordEvent(ctx context.Context, webhook webhookRequest, message string, code int) {
+	_, record := startEventRecord(ctx, webhook)
+	finishEventRecord(record, message, code)
+}
+
+// recentEvents returns the records newest first, filtered by the project and
+// disposition parameters of the request
+func recentEvents(r *http.Request, withPipeline bool) []eventRecord {
+	projectID, _ := strconv.ParseInt(r.FormValue("project"), 10, 64)
+	wanted := r.FormValue("disposition")
+
+	eventRecords.Lock()
+	defer eventRecords.Unlock()
+
+	records := []eventRecord{}
+	for i := len(eventRecords.records) - 1; i >= 0; i-- {
+		record := eventRecords.records[i]
+		if projectID != 0 && record.ProjectID != projectID ||
+			wanted != "" && record.Disposition != wanted ||
+			withPipeline && record.PipelineID == 0 {
+			continue
+		}
+		records = append(records, *record)
+	}
+	return records
+}
+
+func handlerAdminEvents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, recentEvents(r, false))
+}
+
+func handlerAdminPipelines(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, recentEvents(r, true))
+}
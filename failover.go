@@ -0,0 +1,130 @@
+package main
+
+/*
+Failover of read-only API calls: besides --url (the primary, which receives
+all mutations), alternative GitLab URLs such as a Geo secondary or an internal
+endpoint can be configured. Read-only calls go to the first healthy URL in the
+configured order; URLs are marked unhealthy on connection errors or 5xx
+responses and recovered by a periodic health check.
+*/
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var gitlabReadURLs = flag.String("gitlab-read-urls", "", "Comma separated alternative GitLab URLs (eg. a Geo secondary) used for read-only API calls while --url is unhealthy")
+var failoverCheckInterval = flag.Duration("failover-check-interval", 30*time.Second, "How often unhealthy GitLab URLs are checked to fail back to them")
+
+var endpoints = struct {
+	sync.Mutex
+	urls      []string
+	unhealthy map[string]bool
+}{unhealthy: make(map[string]bool)}
+
+var endpointHealthyGauge = newGauge("gitlab_endpoint_healthy", "Whether the GitLab URL is considered healthy for API calls")
+
+func configureFailover() {
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	endpoints.urls = append([]string{*gitlabURL}, splitList(*gitlabReadURLs)...)
+	for i, u := range endpoints.urls {
+		endpoints.urls[i] = strings.TrimSuffix(u, "/")
+		endpointHealthyGauge.set(labels("url", endpoints.urls[i]), 1)
+	}
+}
+
+func isReadOnly(method string) bool {
+	return method == "GET" || method == "HEAD"
+}
+
+// endpointURL returns the URL to be called for the API URL, and the GitLab URL
+// it was directed to.
+func endpointURL(method, urlStr string) (string, string) {
+	if !isReadOnly(method) || !strings.HasPrefix(urlStr, *gitlabURL) {
+		return urlStr, ""
+	}
+
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	for _, base := range endpoints.urls {
+		if !endpoints.unhealthy[base] {
+			return base + strings.TrimPrefix(urlStr, *gitlabURL), base
+		}
+	}
+	return urlStr, *gitlabURL
+}
+
+// recordEndpoint marks the GitLab URL healthy or unhealthy after a call
+func recordEndpoint(base string, healthy bool) {
+	if base == "" || len(endpoints.urls) < 2 {
+		return
+	}
+
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	if endpoints.unhealthy[base] == !healthy {
+		return
+	}
+	if healthy {
+		log.Println("[FAILOVER]", base, "is healthy")
+		delete(endpoints.unhealthy, base)
+		endpointHealthyGauge.set(labels("url", base), 1)
+	} else {
+		log.Println("[FAILOVER]", base, "is unhealthy")
+		endpoints.unhealthy[base] = true
+		endpointHealthyGauge.set(labels("url", base), 0)
+	}
+}
+
+// failedOver marks the GitLab URL unhealthy after a failed call and reports
+// whether the call can be retried on another one.
+func failedOver(base, method, urlStr string) bool {
+	if base == "" {
+		return false
+	}
+	recordEndpoint(base, false)
+	_, next := endpointURL(method, urlStr)
+	return next != base
+}
+
+func checkEndpoint(base string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), *gitlabTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", base+"/api/v4/version", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Private-Token", secretValue(privateToken))
+	resp, err := gitlabClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode/100 == 2
+}
+
+// runFailoverChecks periodically checks the unhealthy GitLab URLs
+func runFailoverChecks() {
+	for range time.Tick(*failoverCheckInterval) {
+		endpoints.Lock()
+		var unhealthy []string
+		for base := range endpoints.unhealthy {
+			unhealthy = append(unhealthy, base)
+		}
+		endpoints.Unlock()
+
+		for _, base := range unhealthy {
+			recordEndpoint(base, checkEndpoint(base))
+		}
+	}
+}
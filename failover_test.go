@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFailoverAfterTimeoutOfThePrimary(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte(`{"version":"primary"}`))
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"secondary"}`))
+	}))
+	defer secondary.Close()
+
+	defer func(url, readURLs string, timeout time.Duration) {
+		*gitlabURL, *gitlabReadURLs, *gitlabTimeout = url, readURLs, timeout
+		endpoints.Lock()
+		endpoints.urls, endpoints.unhealthy = nil, make(map[string]bool)
+		endpoints.Unlock()
+	}(*gitlabURL, *gitlabReadURLs, *gitlabTimeout)
+	*gitlabURL, *gitlabReadURLs, *gitlabTimeout = primary.URL, secondary.URL, 100*time.Millisecond
+	configureFailover()
+
+	var version gitlabVersion
+	if _, err := doGitLabRequest(context.Background(), "token", "GET", primary.URL+"/api/v4/version", "", nil, &version); err != nil {
+		t.Fatalf("failed over request: %s", err)
+	}
+	if version.Version != "secondary" {
+		t.Errorf("answered by %s, expected the secondary", version.Version)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+/*
+The filter executable is an escape hatch for custom trigger logic: it gets the
+same input as the OPA policy as JSON on stdin, and its exit code decides
+whether to trigger: 0 triggers, 1 skips, anything else is an error. Its stdout
+may be a JSON object with the reason of skipping and extra variables of the
+pipeline:
+
+    {"reason": "...", "variables": {"KEY": "value"}}
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var filterExec = flag.String("filter-exec", "", "Executable (with arguments) deciding whether to trigger, getting the webhook and the MR as JSON on stdin: exit code 0 triggers, 1 skips (disabled when empty)")
+var filterExecTimeout = flag.Duration("filter-exec-timeout", 10*time.Second, "How long the -filter-exec executable may run")
+
+// output of the executable kept for the logs
+const maxFilterOutput = 64 << 10
+
+func validateFilterExec() error {
+	if *filterExec == "" {
+		return nil
+	}
+	if _, err := exec.LookPath(strings.Fields(*filterExec)[0]); err != nil {
+		return errors.New("-filter-exec: " + err.Error())
+	}
+	return nil
+}
+
+// runFilterExec runs the executable with the input and returns its decision
+func runFilterExec(ctx context.Context, webhook webhookRequest, mr mergeRequest) (decision policyDecision, err error) {
+	input, err := json.Marshal(policyInput(webhook, mr))
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *filterExecTimeout)
+	defer cancel()
+	args := strings.Fields(*filterExec)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil && exitCode(exitErr) == 1 {
+		err = nil
+	} else if err != nil {
+		message := strings.TrimSpace(limitOutput(stderr.String()))
+		if message != "" {
+			err = errors.New(err.Error() + ": " + message)
+		}
+		return
+	}
+	decision.Allow = cmd.ProcessState.Success()
+
+	if output := bytes.TrimSpace(stdout.Bytes()); len(output) > 0 {
+		var result struct {
+			Reason    string            `json:"reason"`
+			Variables map[string]string `json:"variables"`
+		}
+		if jsonErr := json.Unmarshal(output, &result); jsonErr != nil {
+			logEvent(ctx, "[FILTER] ignored output which is not a JSON object:", limitOutput(string(output)))
+		}
+		decision.Reason, decision.Variables = result.Reason, result.Variables
+	}
+	return
+}
+
+// filterExecSkip returns the reason to skip the trigger when the executable
+// decided so, and adds the variables of its decision to the override otherwise
+func filterExecSkip(ctx context.Context, webhook webhookRequest, mr mergeRequest, override *projectOverride) (string, int) {
+	if *filterExec == "" {
+		return "", 0
+	}
+
+	decision, err := runFilterExec(ctx, webhook, mr)
+	if err != nil {
+		logEvent(ctx, "[FILTER] ERROR running filter:", err)
+		return "error running filter - " + err.Error(), http.StatusInternalServerError
+	}
+	if !decision.Allow {
+		reason := "skipped by filter"
+		if decision.Reason != "" {
+			reason += ": " + decision.Reason
+		}
+		logEvent(ctx, "[FILTER]", reason)
+		return reason, http.StatusOK
+	}
+	applyPolicyVariables(ctx, override, decision.Variables)
+	return "", 0
+}
+
+func exitCode(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus()
+	}
+	return -1
+}
+
+func limitOutput(output string) string {
+	if len(output) > maxFilterOutput {
+		return output[:maxFilterOutput] + "..."
+	}
+	return output
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var gitlabTimeout = flag.Duration("gitlab-timeout", 30*time.Second, "Timeout of a single GitLab API request")
+var gitlabCAFile = flag.String("gitlab-ca-file", "", "Additional CA bundle trusted when connecting to GitLab")
+var proxyURL = flag.String("proxy-url", "", "Proxy used to reach GitLab, instead of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+var gitlabInsecureSkipVerify = flag.Bool("gitlab-insecure-skip-verify", false, "Do not verify the TLS certificate of GitLab (insecure)")
+
+var gitlabClient = &http.Client{}
+
+func configureGitLabClient() error {
+	tlsConfig := &tls.Config{InsecureSkipVerify: *gitlabInsecureSkipVerify}
+	if *gitlabInsecureSkipVerify {
+		log.Println("[GITLAB] WARNING TLS certificate verification is disabled")
+	}
+
+	if *gitlabCAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(*gitlabCAFile)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + *gitlabCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if *proxyURL != "" {
+		u, err := url.Parse(*proxyURL)
+		if err != nil {
+			return errors.New("invalid -proxy-url: " + err.Error())
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	gitlabClient.Transport = &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	return nil
+}
+
+// eventContext returns the context for processing a single event. It does not
+// derive from the webhook request, as processing continues even if GitLab
+// gives up waiting for the response.
+func eventContext() context.Context {
+	return withCallBudget(context.Background(), *apiCallBudget)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var readyCacheTTL = flag.Duration("ready-cache-ttl", 30*time.Second, "How long the result of checking GitLab for /_health/ready is reused")
+
+var readiness = struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}{}
+
+// checkGitLab verifies that GitLab is reachable and the private token is valid
+func checkGitLab(ctx context.Context) error {
+	if secretValue(privateToken) == "" {
+		reqURL := fmt.Sprintf("%s/api/v4/version", *gitlabURL)
+		if resp, err := doGitLabRequest(ctx, "", "GET", reqURL, "", nil, nil); resp == nil {
+			return fmt.Errorf("GitLab is not reachable: %s", err)
+		}
+		return nil
+	}
+
+	_, resp, err := getCurrentUser(ctx)
+	if resp == nil {
+		return fmt.Errorf("GitLab is not reachable: %s", err)
+	} else if err != nil {
+		return fmt.Errorf("private token is not valid: %s", err)
+	}
+	return nil
+}
+
+func readinessError() error {
+	if breakerRetryAfter() > 0 {
+		return errBreakerOpen
+	}
+
+	readiness.Lock()
+	defer readiness.Unlock()
+
+	if time.Since(readiness.checked) >= *readyCacheTTL {
+		readiness.err = checkGitLab(context.Background())
+		readiness.checked = time.Now()
+	}
+	return readiness.err
+}
+
+// handlerReady reports whether webhooks can be processed, so they are not
+// routed to the service while GitLab or its credentials are broken. Liveness
+// is reported by /_health/live (and /_ping), which does not depend on GitLab.
+func handlerReady(w http.ResponseWriter, r *http.Request) {
+	if err := readinessError(); err != nil {
+		httpError(w, r, "not ready - "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	httpError(w, r, "ready", http.StatusOK)
+}
@@ -0,0 +1,103 @@
+package main
+
+/*
+Ingestion consumes the merge request webhooks from a message broker, for
+setups fanning the webhooks of GitLab into a bus for reliability and replay:
+a NATS subject (see ingest_nats.go) or a Kafka topic (see kafka.go, built with
+-tags kafka). The messages are the webhook payloads as delivered by GitLab and
+are processed like the webhooks posted to /webhook.json, which keeps working.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var ingestKafkaBrokers = flag.String("ingest-kafka-brokers", "", "Comma separated Kafka brokers to consume the webhooks from, eg. kafka-1:9092,kafka-2:9092 (requires building with -tags kafka, disabled when empty)")
+var ingestKafkaTopic = flag.String("ingest-kafka-topic", "gitlab.merge_requests", "Kafka topic of the webhooks")
+var ingestKafkaGroup = flag.String("ingest-kafka-group", "gitlab-merge-request-trigger", "Kafka consumer group sharing the webhooks between replicas")
+var ingestProfile = flag.String("ingest-profile", "", "Profile of the webhooks consumed from -ingest-nats-url or -ingest-kafka-brokers")
+
+func ingestEnabled() bool {
+	return *ingestNATSURL != "" || *ingestKafkaBrokers != ""
+}
+
+func validateIngestFlags() error {
+	if err := validateNATSIngest(); err != nil {
+		return err
+	}
+	if *ingestKafkaBrokers != "" {
+		if !kafkaBuilt {
+			return errors.New("-ingest-kafka-brokers: built without Kafka support, rebuild with -tags kafka")
+		}
+		if *ingestKafkaTopic == "" {
+			return errors.New("-ingest-kafka-brokers requires -ingest-kafka-topic")
+		}
+	}
+	if *ingestProfile != "" && !ingestEnabled() {
+		return errors.New("-ingest-profile requires -ingest-nats-url or -ingest-kafka-brokers")
+	}
+	return nil
+}
+
+func runIngest() {
+	if *ingestNATSURL != "" {
+		go runNATSIngest()
+	}
+	if *ingestKafkaBrokers != "" {
+		go runKafkaIngest()
+	}
+}
+
+// ingestMessage processes the webhook payload consumed from the source,
+// returning the outcome like the response of a webhook
+func ingestMessage(source, eventUUID string, payload []byte) (string, int) {
+	ctx := withRequestID(eventContext(), newRequestID())
+	message, code := ingestWebhook(ctx, source, eventUUID, payload)
+	logEvent(ctx, "[INGEST]", code, ":", message)
+	return message, code
+}
+
+func ingestWebhook(ctx context.Context, source, eventUUID string, payload []byte) (string, int) {
+	var webhook webhookRequest
+	if err := json.Unmarshal(payload, &webhook); err != nil {
+		return "error decoding json body of message:" + err.Error(), http.StatusUnsupportedMediaType
+	}
+	normalizeWebhook(&webhook)
+	if webhook.ObjectKind != "merge_request" {
+		return "ignored event: " + webhook.ObjectKind, http.StatusOK
+	}
+	if *ingestProfile != "" {
+		prof, ok := profileByName(*ingestProfile)
+		if !ok {
+			return "unknown profile: " + *ingestProfile, http.StatusNotFound
+		}
+		if !prof.binds(webhook) {
+			return fmt.Sprintf("project %d is not bound to profile %s", webhook.Attributes.TargetProjectID, *ingestProfile), http.StatusForbidden
+		}
+		webhook.Profile = *ingestProfile
+	}
+	storePayload(requestID(ctx), webhook.Profile, payload)
+	webhook.Payload = payload
+
+	// the message waits in the broker instead of being answered with 503
+	for wait := breakerRetryAfter(); wait > 0; wait = breakerRetryAfter() {
+		time.Sleep(wait)
+	}
+
+	logEvent(ctx, "[INGEST] consumed MR:", mrKey(webhook), "from:", source)
+	for {
+		record := processDelivery(ctx, webhook, eventUUID, map[string]interface{}{"source": source})
+		if record.Code != http.StatusTooManyRequests {
+			return record.Reason, record.Code
+		}
+		// the message waits for the rate limit of the project, as for the
+		// breaker, instead of being acknowledged unprocessed
+		time.Sleep(time.Second)
+	}
+}
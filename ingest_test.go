@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestIngestSharesTheFlowOfTheWebhooks(t *testing.T) {
+	defer testingHook(42)()
+	payload := []byte(`{"object_kind":"merge_request","project":{"id":42},"object_attributes":{"target_project_id":42,"iid":7}}`)
+	if message, code := ingestWebhook(context.Background(), "test", "", payload); code != http.StatusOK || message != "ignored test delivery of the webhook" {
+		t.Errorf("test delivery consumed: %d %s", code, message)
+	}
+}
+
+func TestProcessDeliveryLimitsTheProject(t *testing.T) {
+	defer func(rate float64, burst int) { *rateLimitPerProject, *rateLimitBurst = rate, burst }(*rateLimitPerProject, *rateLimitBurst)
+	*rateLimitPerProject, *rateLimitBurst = 0.001, 1
+
+	var webhook webhookRequest
+	webhook.Attributes.TargetProjectID = 43
+	projectLimiter.allow("43")
+	if record := processDelivery(context.Background(), webhook, "", nil); record.Code != http.StatusTooManyRequests {
+		t.Errorf("delivery over the rate limit of the project: %d %s", record.Code, record.Reason)
+	}
+}
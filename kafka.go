@@ -0,0 +1,96 @@
+//go:build kafka
+// +build kafka
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const kafkaBuilt = true
+
+// maxIngestAttempts limits the processing of a message failing with a server
+// error, before it is given up
+const maxIngestAttempts = 5
+
+// runKafkaIngest consumes the webhooks in the consumer group, committing the
+// offset of each message once processed, so a restart continues with the
+// first unprocessed one
+func runKafkaIngest() {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: splitList(*ingestKafkaBrokers),
+		Topic:   *ingestKafkaTopic,
+		GroupID: *ingestKafkaGroup,
+	})
+	defer reader.Close()
+	log.Println("[INGEST]", "consuming Kafka topic", *ingestKafkaTopic, "in consumer group", *ingestKafkaGroup)
+
+	ctx := context.Background()
+	for {
+		message, err := reader.FetchMessage(ctx)
+		if err != nil {
+			log.Println("[INGEST]", "ERROR consuming Kafka topic", *ingestKafkaTopic+":", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var eventUUID string
+		for _, header := range message.Headers {
+			if header.Key == "X-Gitlab-Event-UUID" {
+				eventUUID = string(header.Value)
+			}
+		}
+		ingestWithRetries("kafka:"+message.Topic, eventUUID, message.Value)
+
+		if err := reader.CommitMessages(ctx, message); err != nil {
+			log.Println("[INGEST]", "ERROR committing Kafka offset:", err)
+		}
+	}
+}
+
+// ingestWithRetries processes the message again while it fails with a server
+// error, as the offset of the partition moves on only after it
+func ingestWithRetries(source, eventUUID string, payload []byte) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		_, code := ingestMessage(source, eventUUID, payload)
+		if code < 500 {
+			return
+		}
+		if attempt >= maxIngestAttempts {
+			log.Println("[INGEST]", "giving up message of", source, "after", attempt, "attempts")
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+var kafkaWriter struct {
+	sync.Mutex
+	writer *kafka.Writer
+}
+
+// publishKafka publishes the message to -publish-kafka-topic, to the
+// partition of its key
+func publishKafka(key, value []byte) error {
+	kafkaWriter.Lock()
+	if kafkaWriter.writer == nil {
+		kafkaWriter.writer = &kafka.Writer{
+			Addr:     kafka.TCP(splitList(*publishKafkaBrokers)...),
+			Topic:    *publishKafkaTopic,
+			Balancer: &kafka.Hash{},
+		}
+	}
+	writer := kafkaWriter.writer
+	kafkaWriter.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return writer.WriteMessages(ctx, kafka.Message{Key: key, Value: value})
+}
@@ -0,0 +1,14 @@
+//go:build !kafka
+// +build !kafka
+
+package main
+
+import "errors"
+
+const kafkaBuilt = false
+
+func runKafkaIngest() {}
+
+func publishKafka(key, value []byte) error {
+	return errors.New("built without Kafka support, rebuild with -tags kafka")
+}
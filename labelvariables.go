@@ -0,0 +1,144 @@
+package main
+
+/*
+Labels of the MR can control its pipeline: -label-variables maps labels to
+variables of the triggered pipelines, eg.
+
+    perf-test=RUN_PERF=true,perf-test=PERF_SUITE=full,security=RUN_DAST=true
+
+Adding or removing a mapped label re-triggers the last commit of the MR with
+the variables of its new labels, other label changes are processed as usual.
+
+References:
+ - https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#merge-request-events
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var labelVariablesFlag = flag.String("label-variables", "", "Comma separated label=NAME=value mappings of MR labels to variables of the pipelines, eg. perf-test=RUN_PERF=true")
+
+// labelVariables are the variables of the labels of -label-variables
+var labelVariables map[string]map[string]string
+
+type mrLabel struct {
+	Title string `json:"title"`
+}
+
+type labelChanges struct {
+	Previous []mrLabel `json:"previous"`
+	Current  []mrLabel `json:"current"`
+}
+
+// webhookChanges are the changed attributes of update events
+type webhookChanges struct {
+	Labels *labelChanges `json:"labels"`
+}
+
+var labelRetriggersCounter = newCounter("label_variables_retriggers_total", "MRs re-triggered by changes of their -label-variables labels, by project")
+
+func validateLabelVariables() error {
+	mappings := make(map[string]map[string]string)
+	for _, mapping := range splitList(*labelVariablesFlag) {
+		parts := strings.SplitN(mapping, "=", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return errors.New("invalid -label-variables mapping: " + mapping + ", expected label=NAME=value")
+		}
+		if !variableNameRegexp.MatchString(parts[1]) {
+			return errors.New("invalid -label-variables variable name: " + parts[1])
+		}
+		if mappings[parts[0]] == nil {
+			mappings[parts[0]] = make(map[string]string)
+		}
+		mappings[parts[0]][parts[1]] = parts[2]
+	}
+	labelVariables = mappings
+	return nil
+}
+
+// variablesOfLabels returns the variables the labels are mapped to
+func variablesOfLabels(titles []string) map[string]string {
+	variables := make(map[string]string)
+	for _, title := range titles {
+		for name, value := range labelVariables[title] {
+			variables[name] = value
+		}
+	}
+	return variables
+}
+
+func labelTitles(labels []mrLabel) []string {
+	titles := make([]string, 0, len(labels))
+	for _, label := range labels {
+		titles = append(titles, label.Title)
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+// labelVariablesChanged reports whether the update event changed the labels
+// of the MR so that its variables changed
+func labelVariablesChanged(webhook webhookRequest) bool {
+	changes := webhook.Changes.Labels
+	if len(labelVariables) == 0 || webhook.Attributes.Action != "update" || changes == nil {
+		return false
+	}
+	previous := variablesOfLabels(labelTitles(changes.Previous))
+	current := variablesOfLabels(labelTitles(changes.Current))
+	if len(previous) != len(current) {
+		return true
+	}
+	for name, value := range current {
+		if previousValue, ok := previous[name]; !ok || previousValue != value {
+			return true
+		}
+	}
+	return false
+}
+
+// retriggerOnLabelChange marks the webhook to re-trigger the last commit of
+// the MR when the variables of its labels changed
+func retriggerOnLabelChange(ctx context.Context, webhook *webhookRequest) {
+	if !labelVariablesChanged(*webhook) {
+		return
+	}
+	logEvent(ctx, "[LABELS] variables of the labels of MR:", mrKey(*webhook), "changed, re-triggering")
+	labelRetriggersCounter.inc(labels("project", fmt.Sprint(webhook.Attributes.TargetProjectID)))
+	webhook.Retrigger = true
+}
+
+// currentLabels returns the labels of the MR, from the payload of the event
+// when it has them, as the details of the MR may be older
+func currentLabels(webhook webhookRequest, mr mergeRequest) []string {
+	if changes := webhook.Changes.Labels; changes != nil {
+		return labelTitles(changes.Current)
+	}
+	if webhook.Labels != nil {
+		return labelTitles(webhook.Labels)
+	}
+	return mr.Labels
+}
+
+// applyLabelVariables adds the variables of the labels of the MR to the
+// variables of the override
+func applyLabelVariables(webhook webhookRequest, mr mergeRequest, override *projectOverride) {
+	mapped := variablesOfLabels(currentLabels(webhook, mr))
+	if len(mapped) == 0 {
+		return
+	}
+
+	variables := make(map[string]string)
+	for name, value := range mapped {
+		variables[name] = value
+	}
+	for name, value := range override.Variables {
+		variables[name] = value
+	}
+	override.Variables = variables
+}
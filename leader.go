@@ -0,0 +1,319 @@
+package main
+
+/*
+Leader election lets only one of the replicas run the background loops -
+polling MRs, reconciling webhooks and maintaining trigger tokens - while all
+of them process webhooks. The leader holds a lease, either a Kubernetes Lease
+object or a lease file on a volume shared by the replicas, and renews it; a
+replica takes the lease over once it expired.
+
+References:
+ - https://kubernetes.io/docs/concepts/architecture/leases/
+ - https://kubernetes.io/docs/reference/kubernetes-api/cluster-resources/lease-v1/
+*/
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	leaderLeaseKubernetes = "kubernetes"
+	leaderLeaseFile       = "file"
+)
+
+var leaderElection = flag.String("leader-election", "", "Run the background loops on the elected leader replica only, holding a lease: kubernetes (a Lease object) or file (-leader-election-file) (disabled when empty)")
+var leaderElectionLease = flag.String("leader-election-lease", "gitlab-merge-request-trigger", "Name of the Kubernetes Lease object")
+var leaderElectionNamespace = flag.String("leader-election-namespace", "", "Namespace of the Kubernetes Lease object (the namespace of the pod when empty)")
+var leaderElectionFile = flag.String("leader-election-file", "", "Lease file on a volume shared by the replicas")
+var leaderElectionDuration = flag.Duration("leader-election-duration", 15*time.Second, "How long the lease of the leader is valid without renewal, renewed every third of it")
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// format of the MicroTime fields of Kubernetes
+const kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// a lock of the lease file older than this was left by a crashed replica
+const leaseFileLockTimeout = 10 * time.Second
+
+var leadership = struct {
+	sync.Mutex
+	leader  bool
+	renewed time.Time
+}{}
+
+var leaderGauge = newGauge("leader", "Whether the replica is the elected leader running the background loops")
+
+// leaseElector acquires or renews the lease, reporting whether it is held
+type leaseElector interface {
+	tryAcquire(identity string) (bool, error)
+}
+
+func validateLeaderElection() error {
+	switch *leaderElection {
+	case "":
+		return nil
+	case leaderLeaseKubernetes:
+		if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+			return errors.New("-leader-election=kubernetes requires running in Kubernetes")
+		}
+	case leaderLeaseFile:
+		if *leaderElectionFile == "" {
+			return errors.New("-leader-election=file requires -leader-election-file")
+		}
+	default:
+		return errors.New("invalid -leader-election: " + *leaderElection + ", expected kubernetes or file")
+	}
+	if *leaderElectionDuration < 3*time.Second {
+		return errors.New("-leader-election-duration must be at least 3s")
+	}
+	return nil
+}
+
+// isLeader reports whether the background loops run on this replica
+func isLeader() bool {
+	if *leaderElection == "" {
+		return true
+	}
+	leadership.Lock()
+	defer leadership.Unlock()
+	// a lease not renewed in time may have been taken over already
+	return leadership.leader && time.Since(leadership.renewed) < *leaderElectionDuration
+}
+
+func runLeaderElection() {
+	hostname, _ := os.Hostname()
+	identity := hostname + "-" + newRequestID()[:8]
+
+	var elector leaseElector = &fileLease{path: *leaderElectionFile}
+	if *leaderElection == leaderLeaseKubernetes {
+		elector = &kubernetesLease{}
+	}
+
+	log.Println("[LEADER]", "electing the leader as", identity)
+	for {
+		held, err := elector.tryAcquire(identity)
+		if err != nil {
+			log.Println("[LEADER]", "ERROR renewing the lease:", err)
+		}
+
+		leadership.Lock()
+		if err == nil {
+			if held != leadership.leader {
+				if held {
+					log.Println("[LEADER]", identity, "became the leader")
+				} else {
+					log.Println("[LEADER]", identity, "lost the leadership")
+				}
+			}
+			leadership.leader = held
+			if held {
+				leadership.renewed = time.Now()
+			}
+		}
+		leader := leadership.leader && time.Since(leadership.renewed) < *leaderElectionDuration
+		leadership.Unlock()
+		if leader {
+			leaderGauge.set("", 1)
+		} else {
+			leaderGauge.set("", 0)
+		}
+
+		time.Sleep(*leaderElectionDuration / 3)
+	}
+}
+
+// leaseExpired reports whether the lease renewed at the time can be taken over
+func leaseExpired(renewed time.Time, duration time.Duration) bool {
+	return time.Since(renewed) > duration
+}
+
+type kubernetesLeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+type kubernetesLeaseObject struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Spec       kubernetesLeaseSpec    `json:"spec"`
+}
+
+type kubernetesLease struct {
+	client *http.Client
+}
+
+func (l *kubernetesLease) request(method, urlStr string, body interface{}, result interface{}) (int, error) {
+	if l.client == nil {
+		ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return 0, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		l.client = &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+	// projected service account tokens are rotated
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, err
+	}
+
+	var payload []byte
+	if body != nil {
+		if payload, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, urlStr, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict {
+			return resp.StatusCode, nil
+		}
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", method, urlStr, resp.Status)
+	}
+	if result != nil {
+		err = json.Unmarshal(data, result)
+	}
+	return resp.StatusCode, err
+}
+
+func (l *kubernetesLease) tryAcquire(identity string) (bool, error) {
+	namespace := *leaderElectionNamespace
+	if namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return false, err
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	host := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	leasesURL := fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", host, namespace)
+	now := time.Now().UTC().Format(kubernetesMicroTime)
+
+	var lease kubernetesLeaseObject
+	code, err := l.request("GET", leasesURL+"/"+*leaderElectionLease, nil, &lease)
+	if err != nil {
+		return false, err
+	}
+	if code == http.StatusNotFound {
+		lease = kubernetesLeaseObject{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   map[string]interface{}{"name": *leaderElectionLease, "namespace": namespace},
+			Spec: kubernetesLeaseSpec{
+				HolderIdentity:       identity,
+				LeaseDurationSeconds: int(leaderElectionDuration.Seconds()),
+				AcquireTime:          now,
+				RenewTime:            now,
+			},
+		}
+		code, err := l.request("POST", leasesURL, lease, nil)
+		// another replica created it first
+		return err == nil && code != http.StatusConflict, err
+	}
+
+	spec := lease.Spec
+	if spec.HolderIdentity != identity {
+		renewed, _ := time.Parse(kubernetesMicroTime, spec.RenewTime)
+		duration := time.Duration(spec.LeaseDurationSeconds) * time.Second
+		if spec.HolderIdentity != "" && !leaseExpired(renewed, duration) {
+			return false, nil
+		}
+		spec.HolderIdentity = identity
+		spec.AcquireTime = now
+		spec.LeaseTransitions++
+	}
+	spec.LeaseDurationSeconds = int(leaderElectionDuration.Seconds())
+	spec.RenewTime = now
+	lease.Spec = spec
+
+	// the resource version in the metadata makes concurrent updates conflict
+	code, err = l.request("PUT", leasesURL+"/"+*leaderElectionLease, lease, nil)
+	return err == nil && code != http.StatusConflict, err
+}
+
+type fileLeaseContent struct {
+	Holder    string    `json:"holder"`
+	RenewTime time.Time `json:"renew_time"`
+	Duration  string    `json:"duration"`
+}
+
+type fileLease struct {
+	path string
+}
+
+// tryAcquire reads and writes the lease file while holding its lock file,
+// which is created exclusively
+func (l *fileLease) tryAcquire(identity string) (bool, error) {
+	lockPath := l.path + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > leaseFileLockTimeout {
+			os.Remove(lockPath)
+		}
+		return false, errors.New("the lease file is locked by another replica")
+	}
+	if err != nil {
+		return false, err
+	}
+	lock.Close()
+	defer os.Remove(lockPath)
+
+	var content fileLeaseContent
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &content); err != nil {
+			return false, errors.New("invalid lease file: " + err.Error())
+		}
+	}
+	duration, _ := time.ParseDuration(content.Duration)
+	if content.Holder != "" && content.Holder != identity && !leaseExpired(content.RenewTime, duration) {
+		return false, nil
+	}
+
+	data, err = json.Marshal(fileLeaseContent{Holder: identity, RenewTime: time.Now(), Duration: leaderElectionDuration.String()})
+	if err != nil {
+		return false, err
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, l.path)
+}
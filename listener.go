@@ -0,0 +1,203 @@
+package main
+
+/*
+Listeners of the service: TCP addresses, Unix domain sockets (unix:/path.sock,
+eg. behind a local nginx) and sockets passed by systemd socket activation
+(systemd, or systemd:name for the socket of the FileDescriptorName).
+
+-listen can be repeated, each listener serving the sets of handlers after an
+"=", eg. :8080=webhook,health and 127.0.0.1:9090=admin,metrics, so the admin
+APIs are not exposed on the address GitLab posts to. Without sets, a listener
+serves all the handlers.
+
+References:
+ - https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+*/
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sets of handlers served by a listener
+const (
+	handlersWebhook = "webhook"
+	handlersHealth  = "health"
+	handlersMetrics = "metrics"
+	handlersAdmin   = "admin"
+)
+
+var handlerSets = []string{handlersWebhook, handlersHealth, handlersMetrics, handlersAdmin}
+
+var listenAddrs = listenFlagVar("listen", ":8080", "HTTP listen address: host:port, unix:/path.sock or systemd[:name] for socket activation, optionally followed by =sets of handlers (webhook, health, metrics, admin), eg. 127.0.0.1:9090=admin,metrics; can be repeated")
+var listenSocketMode = flag.String("listen-socket-mode", "0660", "File mode of the Unix domain sockets of -listen unix:/path.sock")
+
+// first file descriptor passed by systemd
+const systemdListenFDsStart = 3
+
+// the sockets passed by systemd, taken once as the environment is cleared
+var systemdListeners = struct {
+	sync.Once
+	files []*os.File
+	names []string
+	err   error
+}{}
+
+// listenFlag collects the values of the repeated flag, replacing the default
+type listenFlag struct {
+	values []string
+	set    bool
+}
+
+func listenFlagVar(name, value, usage string) *listenFlag {
+	f := &listenFlag{values: []string{value}}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *listenFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values, " ")
+}
+
+func (f *listenFlag) Set(value string) error {
+	if !f.set {
+		f.values, f.set = nil, true
+	}
+	f.values = append(f.values, value)
+	return nil
+}
+
+type listenSpec struct {
+	addr string
+	sets map[string]bool
+}
+
+// parseListenSpec parses addr[=set,...]
+func parseListenSpec(value string) (listenSpec, error) {
+	spec := listenSpec{addr: value, sets: make(map[string]bool)}
+	if i := strings.LastIndex(value, "="); i >= 0 {
+		spec.addr = value[:i]
+		for _, set := range splitList(value[i+1:]) {
+			if !contains(handlerSets, set) {
+				return spec, errors.New("unknown handlers " + set + " of " + value + ", expected " + strings.Join(handlerSets, ", "))
+			}
+			spec.sets[set] = true
+		}
+	}
+	if len(spec.sets) == 0 {
+		for _, set := range handlerSets {
+			spec.sets[set] = true
+		}
+	}
+	if spec.addr == "" {
+		return spec, errors.New("missing address: " + value)
+	}
+	if strings.HasPrefix(spec.addr, "unix:") && strings.TrimPrefix(spec.addr, "unix:") == "" {
+		return spec, errors.New("expected unix:/path.sock, but it was: " + spec.addr)
+	}
+	return spec, nil
+}
+
+func listenSpecs() (specs []listenSpec, err error) {
+	for _, value := range listenAddrs.values {
+		spec, err := parseListenSpec(value)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return
+}
+
+func validateListenFlags() error {
+	if _, err := listenSpecs(); err != nil {
+		return errors.New("-listen: " + err.Error())
+	}
+	if _, err := strconv.ParseUint(*listenSocketMode, 8, 32); err != nil {
+		return errors.New("invalid -listen-socket-mode: " + *listenSocketMode)
+	}
+	return nil
+}
+
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return listenUnix(strings.TrimPrefix(addr, "unix:"))
+	case addr == "systemd" || strings.HasPrefix(addr, "systemd:"):
+		return listenSystemd(strings.TrimPrefix(strings.TrimPrefix(addr, "systemd"), ":"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	// a socket left by a previous run refuses the new one
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := strconv.ParseUint(*listenSocketMode, 8, 32)
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// listenSystemd returns the listener of the socket passed by systemd with the
+// name, or of the only one when the name is empty
+func listenSystemd(name string) (net.Listener, error) {
+	systemdListeners.Do(func() {
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			systemdListeners.err = errors.New("no sockets passed by systemd socket activation")
+			return
+		}
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count <= 0 {
+			systemdListeners.err = errors.New("invalid LISTEN_FDS: " + os.Getenv("LISTEN_FDS"))
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < count; i++ {
+			fdName := ""
+			if i < len(names) {
+				fdName = names[i]
+			}
+			systemdListeners.files = append(systemdListeners.files, os.NewFile(uintptr(systemdListenFDsStart+i), fdName))
+			systemdListeners.names = append(systemdListeners.names, fdName)
+		}
+		// not inherited by child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if systemdListeners.err != nil {
+		return nil, systemdListeners.err
+	}
+
+	files := systemdListeners.files
+	if name == "" {
+		if len(files) != 1 {
+			return nil, errors.New("systemd passed " + strconv.Itoa(len(files)) + " sockets, select one with systemd:name")
+		}
+		return net.FileListener(files[0])
+	}
+	for i, fdName := range systemdListeners.names {
+		if fdName == name {
+			return net.FileListener(files[i])
+		}
+	}
+	return nil, errors.New("no socket named " + name + " passed by systemd")
+}
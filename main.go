@@ -11,6 +11,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -19,13 +21,20 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"time"
 )
 
 type project struct {
-	Name    string `json:"name"`
-	WebURL  string `json:"web_url"`
-	HTTPURL string `json:"http_url"`
+	ID                int64  `json:"id"`
+	Name              string `json:"name"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	Namespace         string `json:"namespace"`
+	WebURL            string `json:"web_url"`
+	HTTPURL           string `json:"http_url"`
+	GitHTTPURL        string `json:"git_http_url"`
 }
 
 type commit struct {
@@ -36,7 +45,10 @@ type commit struct {
 }
 
 type pipeline struct {
-	ID int `json:"id"`
+	ID        int    `json:"id"`
+	Status    string `json:"status"`
+	WebURL    string `json:"web_url"`
+	CreatedAt string `json:"created_at"`
 }
 
 type job struct {
@@ -50,6 +62,7 @@ type objectAttributes struct {
 	TargetBranch    string  `json:"target_branch"`
 	SourceBranch    string  `json:"source_branch"`
 	SourceProjectID int64   `json:"source_project_id"`
+	TargetProjectID int64   `json:"target_project_id"`
 	State           string  `json:"state"`
 	MergeStatus     string  `json:"merge_status"`
 	Source          project `json:"source"`
@@ -57,16 +70,93 @@ type objectAttributes struct {
 	LastCommit      commit  `json:"last_commit"`
 	Action          string  `json:"action"`
 	WorkInProgress  bool    `json:"work_in_progress"`
+	UpdatedAt       string  `json:"updated_at"`
+	URL             string  `json:"url"`
 }
 
 type mergeRequest struct {
-	ShouldRemoveSourceBranch bool `json:"should_remove_source_branch"`
-	ForceRemoveSourceBranch  bool `json:"force_remove_source_branch"`
+	ID                       int          `json:"id"`
+	IID                      int          `json:"iid"`
+	State                    string       `json:"state"`
+	SourceBranch             string       `json:"source_branch"`
+	TargetBranch             string       `json:"target_branch"`
+	SourceProjectID          int64        `json:"source_project_id"`
+	TargetProjectID          int64        `json:"target_project_id"`
+	WorkInProgress           bool         `json:"work_in_progress"`
+	Draft                    bool         `json:"draft"`
+	MergeStatus              string       `json:"merge_status"`
+	UpdatedAt                string       `json:"updated_at"`
+	ShouldRemoveSourceBranch bool         `json:"should_remove_source_branch"`
+	ForceRemoveSourceBranch  bool         `json:"force_remove_source_branch"`
+	SHA                      string       `json:"sha"`
+	MergeCommitSHA           string       `json:"merge_commit_sha"`
+	Squash                   bool         `json:"squash"`
+	HasConflicts             bool         `json:"has_conflicts"`
+	SquashCommitSHA          string       `json:"squash_commit_sha"`
+	Author                   gitlabUser   `json:"author"`
+	Description              string       `json:"description"`
+	Labels                   []string     `json:"labels"`
+	Milestone                *milestone   `json:"milestone"`
+	Assignees                []gitlabUser `json:"assignees"`
+	Reviewers                []gitlabUser `json:"reviewers"`
 }
 
 type webhookRequest struct {
 	ObjectKind string           `json:"object_kind"`
+	EventType  string           `json:"event_type"`
+	EventName  string           `json:"event_name"`
+	Project    project          `json:"project"`
 	Attributes objectAttributes `json:"object_attributes"`
+	Changes    webhookChanges   `json:"changes"`
+	Labels     []mrLabel        `json:"labels"`
+	Assignees  []gitlabUser     `json:"assignees"`
+	Reviewers  []gitlabUser     `json:"reviewers"`
+	// Profile is the name of the profile the webhook was delivered to
+	Profile string `json:"-"`
+	// SourceCleanup selects the source branch of the merged MR for the
+	// pipeline, see triggerSourceCleanup
+	SourceCleanup bool `json:"-"`
+	// RefStrategy overrides the configured ref strategy of the pipeline, see
+	// refStrategyFor
+	RefStrategy string `json:"-"`
+	// Retrigger triggers a new pipeline even if the commit already has one,
+	// see retriggerStaleMR
+	Retrigger bool `json:"-"`
+	// Replay processes the event even if newer events of the MR were already
+	// processed, see handlerAdminReplay
+	Replay bool `json:"-"`
+	// SkipRebase triggers without rebasing the MR first, see followRebase
+	SkipRebase bool `json:"-"`
+	// Payload is the raw delivered payload, if any
+	Payload json.RawMessage `json:"-"`
+}
+
+// normalizeWebhook fills in the fields which are missing from some payload
+// envelopes (eg. group webhooks) from their equivalents, so the rest of the
+// flow can rely on them.
+func normalizeWebhook(webhook *webhookRequest) {
+	if webhook.ObjectKind == "" {
+		webhook.ObjectKind = webhook.EventType
+	}
+	if webhook.ObjectKind == "" {
+		// system hooks name their system events, eg. project_create
+		webhook.ObjectKind = webhook.EventName
+	}
+	if webhook.Attributes.SourceProjectID == 0 {
+		webhook.Attributes.SourceProjectID = webhook.Project.ID
+	}
+	if webhook.Attributes.TargetProjectID == 0 {
+		webhook.Attributes.TargetProjectID = webhook.Attributes.SourceProjectID
+	}
+	if webhook.Project.HTTPURL == "" {
+		webhook.Project.HTTPURL = webhook.Project.GitHTTPURL
+	}
+	if webhook.Attributes.Source.HTTPURL == "" {
+		webhook.Attributes.Source.HTTPURL = webhook.Attributes.Source.GitHTTPURL
+	}
+	if webhook.Attributes.Target.HTTPURL == "" {
+		webhook.Attributes.Target.HTTPURL = webhook.Attributes.Target.GitHTTPURL
+	}
 }
 
 type tokenResponse struct {
@@ -74,38 +164,115 @@ type tokenResponse struct {
 	DeletedAt   string `json:"deleted_at"`
 	Token       string `json:"token"`
 	Description string `json:"description"`
+	CreatedAt   string `json:"created_at"`
 }
 
-var listenAddr = flag.String("listen", ":8080", "HTTP listen address")
+var readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "Maximum duration for reading request headers")
+var readTimeout = flag.Duration("read-timeout", 30*time.Second, "Maximum duration for reading the entire request")
+var idleTimeout = flag.Duration("idle-timeout", 120*time.Second, "Maximum duration to wait for the next request on keep-alive connections")
+var maxBodySize = flag.Int64("max-body-size", 4<<20, "Maximum size of webhook request body in bytes")
 var triggerToken = flag.String("token", "", "HTTP trigger token")
 var privateToken = flag.String("private-token", "", "User PRIVATE-TOKEN with privileges to create Build triggers")
+var webhookSecret = flag.String("webhook-secret", "", "Secret token of the webhook, required in the X-Gitlab-Token header when set")
 var gitlabURL = flag.String("url", "", "GitLab instance address")
+var createPipelines = flag.Bool("create-pipelines", false, "Create pipelines with the pipelines API as the --private-token user instead of with trigger tokens")
 var shouldTriggerMerged = flag.Bool("trigger-merged", false, "Should trigger merged requests which was just merged")
-var removeSourceExceptions = flag.String("remove-source-exceptions", "", "Do not update remove_source_branch for these branches")
+var removeSourceExceptions = flag.String("remove-source-exceptions", "", "Comma separated branches for which remove_source_branch is not updated: names, globs (eg. release/*) or regular expressions between slashes (eg. /^hotfix-/)")
 
-func doJsonRequest(method, urlStr string, bodyType string, body io.Reader, data interface{}) (resp *http.Response, err error) {
-	if *privateToken == "" {
+func doJsonRequest(ctx context.Context, method, urlStr string, bodyType string, body io.Reader, data interface{}) (resp *http.Response, err error) {
+	return doJsonRequestWithToken(ctx, privateTokenFor(ctx), method, urlStr, bodyType, body, data)
+}
+
+func doJsonRequestWithToken(ctx context.Context, token string, method, urlStr string, bodyType string, body io.Reader, data interface{}) (resp *http.Response, err error) {
+	if token == "" {
 		return nil, errors.New("missing --private-token")
 	}
+	defer func() { reportGitLabError(ctx, method, urlStr, resp, err) }()
+	if err = spendCall(ctx); err != nil {
+		return
+	}
+
+	// the body is buffered to send it again when the request is retried
+	var payload []byte
+	if body != nil {
+		if payload, err = ioutil.ReadAll(body); err != nil {
+			return
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err = waitForRateLimit(ctx); err != nil {
+			return
+		}
+		resp, err = doGitLabRequest(ctx, token, method, urlStr, bodyType, payload, data)
+		if resp == nil || resp.StatusCode != http.StatusTooManyRequests || attempt > maxRateLimitRetries {
+			return
+		}
+		logEvent(ctx, "[GITLAB] rate limited, retrying", method, "request - attempt:", attempt)
+	}
+}
+
+func doGitLabRequest(ctx context.Context, token string, method, urlStr string, bodyType string, payload []byte, data interface{}) (resp *http.Response, err error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
 
-	req, err := http.NewRequest(method, urlStr, body)
+	urlStr = profileURL(ctx, urlStr)
+	reqURL, endpoint := endpointURL(method, urlStr)
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return
+	}
+	// waiting for a slot does not count against the timeout of the request
+	release, err := acquireGitLabSlot(ctx)
 	if err != nil {
 		return
 	}
+	defer release()
+	// the timeout is per attempt, a failover gets its own
+	attemptCtx, cancel := context.WithTimeout(ctx, *gitlabTimeout)
+	defer cancel()
+	req = req.WithContext(attemptCtx)
 
-	req.Header.Set("Private-Token", *privateToken)
+	req.Header.Set("Private-Token", token)
+	if username := sudoUser(ctx); username != "" {
+		req.Header.Set("Sudo", username)
+	}
 	if bodyType != "" {
 		req.Header.Set("Content-Type", bodyType)
 	}
 
-	resp, err = http.DefaultClient.Do(req)
+	if err = dryRunGuard(ctx, method, urlStr); err != nil {
+		return
+	}
+	if err = breakerAllow(); err != nil {
+		return
+	}
+	resp, err = gitlabClient.Do(req)
+	healthy := err == nil && resp.StatusCode/100 != 5
+	breakerRecord(healthy)
+	if !healthy && failedOver(endpoint, method, urlStr) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		release()
+		cancel()
+		return doGitLabRequest(ctx, token, method, urlStr, bodyType, payload, data)
+	}
 	if err != nil {
 		return
 	}
 	defer io.Copy(ioutil.Discard, resp.Body)
 	defer resp.Body.Close()
+	observeRateLimit(resp)
+	if resp.StatusCode == http.StatusUnauthorized {
+		notify(notification{Kind: notifyTokenError, Message: "GitLab rejected the token of " + method + " " + req.URL.Path})
+	}
 
-	if resp.StatusCode/100 == 2 {
+	if resp.StatusCode/100 == 2 && data == nil {
+		return
+	} else if resp.StatusCode/100 == 2 {
 		d := json.NewDecoder(resp.Body)
 		err = d.Decode(data)
 	} else {
@@ -115,16 +282,33 @@ func doJsonRequest(method, urlStr string, bodyType string, body io.Reader, data
 	return
 }
 
-func getMergeRequest(projectID int64, mrIID int) (mr mergeRequest, err error) {
+// getMergeRequest gets the details of the MR as of the event updating it at
+// updatedAt, the cached ones for the events of the same update
+func getMergeRequest(ctx context.Context, projectID int64, mrIID int, updatedAt string) (mr mergeRequest, err error) {
+	if updatedAt == "" {
+		return fetchMergeRequest(ctx, projectID, mrIID)
+	}
+	key := mergeRequestKey(ctx, projectID, mrIID, updatedAt)
+	if cached, ok := cachedLookup(mergeRequestCache, "merge_request", key); ok {
+		return cached.(mergeRequest), nil
+	}
+	if mr, err = fetchMergeRequest(ctx, projectID, mrIID); err == nil {
+		mergeRequestCache.set(key, mr)
+	}
+	return
+}
+
+// fetchMergeRequest gets the current details of the MR, bypassing the cache
+func fetchMergeRequest(ctx context.Context, projectID int64, mrIID int) (mr mergeRequest, err error) {
 	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d", *gitlabURL, projectID, mrIID)
-	_, err = doJsonRequest("GET", reqURL, "", nil, &mr)
+	_, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &mr)
 	return
 }
 
-func setRemoveSourceBranchForMR(projectID int64, mrIID int) (mr mergeRequest, err error) {
+func setRemoveSourceBranchForMR(ctx context.Context, projectID int64, mrIID int) (mr mergeRequest, err error) {
 	// https://docs.gitlab.com/ce/api/merge_requests.html#update-mr
 	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d?remove_source_branch=true", *gitlabURL, projectID, mrIID)
-	_, err = doJsonRequest("PUT", reqURL, "", nil, &mr)
+	_, err = doProjectRequest(ctx, projectID, "PUT", reqURL, "", nil, &mr)
 	return
 }
 
@@ -137,169 +321,409 @@ func contains(arr []string, str string) bool {
 	return false
 }
 
-func setRemoveSourceBranchForMR_AndReport(projectID int64, mrIID int, sourceBranch string) {
+func setRemoveSourceBranchForMR_AndReport(ctx context.Context, projectID, sourceProjectID int64, mrIID int, sourceBranch string) {
 	splittedRemoveSourceExceptions := strings.Split(*removeSourceExceptions, ",")
-	isExceptionBranch := contains(splittedRemoveSourceExceptions, sourceBranch)
-	if isExceptionBranch ==false {
-		mr, err := setRemoveSourceBranchForMR(projectID, mrIID)
+	splittedRemoveSourceExceptions = append(splittedRemoveSourceExceptions, overrideFor(ctx, projectID).RemoveSourceExceptions...)
+	isExceptionBranch := matchesAnyBranch(splittedRemoveSourceExceptions, sourceBranch)
+	if !isExceptionBranch {
+		if reason := removeSourceBranchSkip(ctx, projectID, sourceProjectID, sourceBranch); reason != "" {
+			logEvent(ctx, "[MR] not setting remove_source_branch for branch:", sourceBranch, "-", reason)
+			return
+		}
+	}
+	if *shadowMode {
+		logEvent(ctx, "[SHADOW] would set remove_source_branch for branch:", sourceBranch)
+		return
+	}
+	if isExceptionBranch == false {
+		if dryRunning(ctx) {
+			logEvent(ctx, "[DRY-RUN] would set remove_source_branch for MR:", mrIID, "branch:", sourceBranch)
+			return
+		}
+		if budgetExhausted(ctx) {
+			logEvent(ctx, "[MR] skipped setting remove_source_branch:", errBudgetExhausted)
+			return
+		}
+		mr, err := setRemoveSourceBranchForMR(ctx, projectID, mrIID)
 		if err != nil {
-			log.Println("[MR] ERROR setting remove_source_branch for MR:" + err.Error())
+			logEvent(ctx, "[MR] ERROR setting remove_source_branch for MR:"+err.Error())
 			return
 		}
-		log.Println("[MR] updated flags:",
+		logEvent(ctx, "[MR] updated flags:",
 			"should_remove_source_branch:", mr.ShouldRemoveSourceBranch,
 			"force_remove_source_branch:", mr.ForceRemoveSourceBranch)
+		publishEvent("mr_updated", map[string]interface{}{
+			"request_id":                 requestID(ctx),
+			"project_id":                 projectID,
+			"mr_iid":                     mrIID,
+			"force_remove_source_branch": mr.ForceRemoveSourceBranch,
+		})
 	} else {
-		log.Println("Modifying remove_source_branch for branch: ", sourceBranch, " was omitted!")
-	}	
+		logEvent(ctx, "Modifying remove_source_branch for branch: ", sourceBranch, " was omitted!")
+	}
 }
 
-func getCommit(projectID int64, commitID string) (commit commit, err error) {
+func getCommit(ctx context.Context, projectID int64, commitID string) (c commit, err error) {
+	key := commitKey(projectID, commitID)
+	if cached, ok := cachedLookup(commitCache, "commit", key); ok {
+		return cached.(commit), nil
+	}
 	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/repository/commits/%s", *gitlabURL, projectID, commitID)
-	_, err = doJsonRequest("GET", reqURL, "", nil, &commit)
+	if _, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &c); err == nil {
+		commitCache.set(key, c)
+	}
 	return
 }
 
-func listTokens(projectID int64) (tokens []tokenResponse, err error) {
+func listTokens(ctx context.Context, projectID int64) (tokens []tokenResponse, err error) {
 	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/triggers", *gitlabURL, projectID)
-	_, err = doJsonRequest("GET", reqURL, "", nil, &tokens)
+	err = getAllPages(ctx, projectID, reqURL, &tokens)
 	return
 }
 
-func createToken(projectID int64) (token tokenResponse, err error) {
-	var jsonStr = []byte(`{ "description": "MR trigger (created automatically)" }`)
+func createToken(ctx context.Context, projectID int64) (token tokenResponse, err error) {
+	jsonStr, _ := json.Marshal(map[string]string{"description": triggerTokenDescription})
 
 	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/triggers", *gitlabURL, projectID)
-	_, err = doJsonRequest("POST", reqURL, "application/json", bytes.NewBuffer(jsonStr), &token)
+	_, err = doProjectRequest(ctx, projectID, "POST", reqURL, "application/json", bytes.NewBuffer(jsonStr), &token)
 	return
 }
 
-func getTriggerToken(projectID int64) (string, error) {
-	if *triggerToken != "" {
-		return *triggerToken, nil
+func getTriggerToken(ctx context.Context, projectID int64) (string, error) {
+	_, profiled := profileFrom(ctx)
+	if secretValue(triggerToken) != "" && !profiled {
+		return secretValue(triggerToken), nil
 	}
 
-	if tokens, err := listTokens(projectID); err == nil {
+	if token := vaultTriggerToken(projectID); token != "" && !profiled {
+		return token, nil
+	}
+
+	if token, ok := triggerTokenCache.get(projectKey(ctx, projectID)); ok {
+		triggerTokenCacheCounter.inc(labels("result", "hit"))
+		return token.(string), nil
+	}
+	triggerTokenCacheCounter.inc(labels("result", "miss"))
+
+	rememberTriggerTokenProject(projectID)
+	token, err := resolveTriggerToken(ctx, projectID)
+	if err == nil {
+		registerSecrets(token)
+		triggerTokenCache.set(projectKey(ctx, projectID), token)
+	}
+	return token, err
+}
+
+func resolveTriggerToken(ctx context.Context, projectID int64) (string, error) {
+	if tokens, err := listTokens(ctx, projectID); err == nil {
 		for _, token := range tokens {
 			if token.DeletedAt != "" || token.Token == "" {
 				continue
 			}
-			log.Println("[TOKEN]", "found existing - id:", token.ID, ", description:", token.Description)
+			logEvent(ctx, "[TOKEN]", "found existing - id:", token.ID, ", description:", token.Description)
 			return token.Token, nil
 		}
 	}
 
-	if token, err := createToken(projectID); err == nil {
-		log.Println("[TOKEN]", "created - id:", token.ID)
+	if token, err := createToken(ctx, projectID); err == nil {
+		logEvent(ctx, "[TOKEN]", "created - id:", token.ID)
 		return token.Token, nil
 	} else {
 		return "", err
 	}
 }
 
-func runTrigger(webhook webhookRequest, token string) (pipeline *pipeline, err error) {
-	var pipelineBranch string
+// isReferenceNotFound reports whether the trigger failed because the ref does
+// not exist (anymore), eg. the source branch was removed right after merging.
+func isReferenceNotFound(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "reference not found")
+}
 
-	if webhook.Attributes.State == "merged" {
-		pipelineBranch = webhook.Attributes.TargetBranch
-	} else {
-		pipelineBranch = webhook.Attributes.SourceBranch
-	}
+// errInvalidTriggerToken is returned when GitLab rejects the trigger token
+type errInvalidTriggerToken struct {
+	error
+}
+
+func runTrigger(ctx context.Context, webhook webhookRequest, token string, variables map[string]string) (pipeline *pipeline, err error) {
+	pipelineBranch := pipelineRef(webhook)
 
 	reqURL := fmt.Sprintf(
-		"%s/api/v4/projects/%d/ref/%s/trigger/pipeline?" +
-			"token=%s" +
-			"&variables[CI_MERGE_REQUEST]=true" +
-			"&variables[MR_SOURCE_BRANCH]=%s" +
-			"&variables[MR_TARGET_BRANCH]=%s" +
-			"&variables[MR_ID]=%v" +
-			"&variables[MR_IID]=%v" +
+		"%s/api/v4/projects/%d/ref/%s/trigger/pipeline?"+
+			"token=%s"+
+			"&variables[CI_MERGE_REQUEST]=true"+
+			"&variables[MR_SOURCE_BRANCH]=%s"+
+			"&variables[MR_TARGET_BRANCH]=%s"+
+			"&variables[MR_ID]=%v"+
+			"&variables[MR_IID]=%v"+
 			"&variables[MR_STATE]=%s",
-			*gitlabURL,
-			webhook.Attributes.SourceProjectID,
-			pipelineBranch,
-			token,
-			webhook.Attributes.SourceBranch,
-			webhook.Attributes.TargetBranch,
-			webhook.Attributes.ID,
-			webhook.Attributes.IID,
-			webhook.Attributes.State)
-	_, err = doJsonRequest("POST", reqURL, "", nil, &pipeline)
+		*gitlabURL,
+		pipelineProjectID(webhook),
+		url.PathEscape(pipelineBranch),
+		token,
+		webhook.Attributes.SourceBranch,
+		webhook.Attributes.TargetBranch,
+		webhook.Attributes.ID,
+		webhook.Attributes.IID,
+		webhook.Attributes.State)
+	for _, name := range sortedVariableNames(variables) {
+		reqURL += fmt.Sprintf("&variables[%s]=%s", name, url.QueryEscape(variables[name]))
+	}
+	resp, err := doProjectRequest(ctx, pipelineProjectID(webhook), "POST", reqURL, "", nil, &pipeline)
+	if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound) {
+		err = errInvalidTriggerToken{err}
+	}
 	return
 }
 
-func getPendingBuilds(projectID int64, pipelineID int) (jobs []job, err error) {
+// triggerPipeline runs the trigger with the token of the project, resolving
+// the token again when the cached one turns out to be invalid.
+func triggerPipeline(ctx context.Context, webhook webhookRequest, variables map[string]string) (pipeline *pipeline, err error) {
+	projectID := pipelineProjectID(webhook)
+	for attempt := 1; attempt <= 2; attempt++ {
+		var token string
+		if token, err = getTriggerToken(ctx, projectID); err != nil {
+			return nil, fmt.Errorf("error getting trigger token - %s", err)
+		}
+		pipeline, err = runTrigger(ctx, webhook, token, variables)
+		if _, invalid := err.(errInvalidTriggerToken); !invalid || secretValue(triggerToken) != "" && webhook.Profile == "" {
+			return pipeline, err
+		}
+		logEvent(ctx, "[TOKEN]", "trigger token of project", projectID, "is invalid:", err)
+		triggerTokenCache.delete(projectKey(ctx, projectID))
+	}
+	return
+}
+
+type pipelineVariable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// createPipeline creates the pipeline as the user of the private token, which
+// is attributed to them instead of being "triggered via API"
+func createPipeline(ctx context.Context, webhook webhookRequest, variables map[string]string) (pipeline *pipeline, err error) {
+	all := mergeRequestVariables(webhook)
+	for name, value := range variables {
+		all[name] = value
+	}
+	pipelineVariables := []pipelineVariable{}
+	for _, name := range sortedVariableNames(all) {
+		pipelineVariables = append(pipelineVariables, pipelineVariable{Key: name, Value: all[name]})
+	}
+	jsonStr, _ := json.Marshal(map[string]interface{}{
+		"ref":       pipelineRef(webhook),
+		"variables": pipelineVariables,
+	})
+
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/pipeline", *gitlabURL, pipelineProjectID(webhook))
+	resp, err := doProjectRequest(ctx, pipelineProjectID(webhook), "POST", reqURL, "application/json", bytes.NewBuffer(jsonStr), &pipeline)
+	if username := sudoUser(ctx); username != "" && resp != nil &&
+		(resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound) {
+		// eg. the author has no access to the project, or was blocked
+		logEvent(ctx, "[MR] creating pipeline as", username, "failed, creating it as the token user:", err)
+		return createPipeline(withSudo(ctx, ""), webhook, variables)
+	}
+	return
+}
+
+func getPendingBuilds(ctx context.Context, projectID int64, pipelineID int) (jobs []job, err error) {
 	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines/%d/jobs?scope[]=pending", *gitlabURL, projectID, pipelineID)
-	_, err = doJsonRequest("GET", reqURL, "", nil, &jobs)
+	err = getAllPages(ctx, projectID, reqURL, &jobs)
 	return
 }
 
-func cancelBuild(projectID int64, buildID int) (job job, err error) {
+func cancelBuild(ctx context.Context, projectID int64, buildID int) (job job, err error) {
 	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/jobs/%d/cancel", *gitlabURL, projectID, buildID)
-	_, err = doJsonRequest("POST", reqURL, "", nil, &job)
+	_, err = doProjectRequest(ctx, projectID, "POST", reqURL, "", nil, &job)
 	return
 }
 
-func getPipelines(projectID int64, ref string) (pipelines []pipeline, err error) {
+func getPipelines(ctx context.Context, projectID int64, ref string) (pipelines []pipeline, err error) {
 	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines?ref=%s&status=running&sort=asc", *gitlabURL, projectID, ref)
-	_, err = doJsonRequest("GET", reqURL, "", nil, &pipelines)
+	err = getAllPages(ctx, projectID, reqURL, &pipelines)
 	return
 }
 
-func cancelRedundantBuilds(projectID int64, ref string, excludePipeline int) {
-	pipelines, err := getPipelines(projectID, ref)
+func cancelRedundantBuilds(ctx context.Context, projectID int64, ref string, excludePipeline int) {
+	if *shadowMode {
+		return
+	}
+
+	pipelines, err := getPipelines(ctx, projectID, ref)
 	if err != nil {
-		log.Println("ERROR", err)
+		logEvent(ctx, "ERROR", err)
 	}
 
 	for _, p := range pipelines {
 		if p.ID == excludePipeline {
 			continue
 		}
-		builds, err := getPendingBuilds(projectID, p.ID)
+		builds, err := getPendingBuilds(ctx, projectID, p.ID)
 		if err != nil {
-			log.Println("ERROR", err)
+			logEvent(ctx, "ERROR", err)
 		}
 		for _, b := range builds {
-			log.Println("[BUILD] In pipeline", p.ID, "cancelling build:", b.ID, "(", b.Name, ")")
-			_, err := cancelBuild(projectID, b.ID)
+			if budgetExhausted(ctx) {
+				logEvent(ctx, "[BUILD] stopped cancelling redundant builds:", errBudgetExhausted)
+				return
+			}
+			if dryRunning(ctx) {
+				dryRunCancel(ctx, p.ID, b)
+				continue
+			}
+			logEvent(ctx, "[BUILD] In pipeline", p.ID, "cancelling build:", b.ID, "(", b.Name, ")")
+			_, err := cancelBuild(ctx, projectID, b.ID)
 			if err != nil {
-				log.Println("ERROR", err)
+				logEvent(ctx, "ERROR", err)
+			} else {
+				noteCancelledBuild(ctx, b.ID)
 			}
 		}
 	}
 }
 
 func httpError(w http.ResponseWriter, r *http.Request, error string, code int) {
+	error = redact(error)
 	http.Error(w, error, code)
-	log.Println("[RESPONSE]", code, ":", error)
+	if r != nil {
+		logEvent(r.Context(), "[RESPONSE]", code, ":", error)
+	} else {
+		log.Println("[RESPONSE]", code, ":", error)
+	}
 }
 
 func handlerWebhook(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		httpError(w, r, "we support POST method only, but it was:"+r.Method, http.StatusMethodNotAllowed)
+		webhookError(w, r, nil, "we support POST method only, but it was:"+r.Method, http.StatusMethodNotAllowed)
 		return
 	}
 
+	profileName := requestProfile(r)
+	prof, ok := profileByName(profileName)
+	if profileName != "" && !ok {
+		webhookError(w, r, nil, "unknown profile: "+profileName, http.StatusNotFound)
+		return
+	}
+
+	if profileName != "" && prof.WebhookSecret != "" && !validSecret(r, prof.WebhookSecret) ||
+		(profileName == "" || prof.WebhookSecret == "") && !validWebhookSecret(r) {
+		webhookError(w, r, nil, "invalid X-Gitlab-Token", http.StatusUnauthorized)
+		return
+	}
+
+	if wait := breakerRetryAfter(); wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+		webhookError(w, r, nil, errBreakerOpen.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx := withRequestID(eventContext(), requestID(r.Context()))
+
 	var webhook webhookRequest
-	err := json.NewDecoder(r.Body).Decode(&webhook)
+	payload := &bytes.Buffer{}
+	err := json.NewDecoder(io.TeeReader(http.MaxBytesReader(w, r.Body, *maxBodySize), payload)).Decode(&webhook)
+	if err != nil && strings.Contains(err.Error(), "request body too large") {
+		webhookError(w, r, nil, "request body exceeds the limit of "+fmt.Sprint(*maxBodySize)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		httpError(w, r, "error decoding json body of request:"+err.Error(), http.StatusUnsupportedMediaType)
+		webhookError(w, r, nil, "error decoding json body of request:"+err.Error(), http.StatusUnsupportedMediaType)
 		return
 	}
+	normalizeWebhook(&webhook)
 
+	if webhook.ObjectKind == "push" && *retriggerOnTargetPush {
+		handleTargetPush(ctx, w, r, payload.Bytes(), prof, profileName)
+		return
+	}
+	if webhook.ObjectKind != "merge_request" && r.Header.Get("X-Gitlab-Event") == "System Hook" {
+		// system hooks deliver all the events of the instance, failing them
+		// would get the hook disabled
+		webhookError(w, r, &webhook, "ignored system hook event: "+webhook.ObjectKind, http.StatusOK)
+		return
+	}
 	if webhook.ObjectKind != "merge_request" {
-		httpError(w, r, "we support merge_request objects only, but it was:"+webhook.ObjectKind, http.StatusUnprocessableEntity)
+		// the other events enabled on the hook (eg. push events without
+		// -retrigger-on-target-push) would get it disabled as well
+		webhookError(w, r, &webhook, "ignored event: "+webhook.ObjectKind, http.StatusOK)
 		return
 	}
+	if profileName != "" {
+		if !prof.binds(webhook) {
+			webhookError(w, r, &webhook, fmt.Sprintf("project %d is not bound to profile %s", webhook.Attributes.TargetProjectID, profileName), http.StatusForbidden)
+			return
+		}
+		webhook.Profile = profileName
+	}
+	storePayload(requestID(ctx), profileName, payload.Bytes())
+	webhook.Payload = payload.Bytes()
 
-	mr, err := getMergeRequest(webhook.Attributes.SourceProjectID, webhook.Attributes.IID)
+	record := processDelivery(ctx, webhook, r.Header.Get("X-Gitlab-Event-UUID"), nil)
+	if record.Code == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+	respondWebhook(w, r, &webhook, record)
+}
+
+// processDelivery runs the flow shared by the webhooks posted to the service
+// and the ones consumed from a broker, once bound to their profile: ignoring
+// test deliveries, the rate limit of the project, skipping duplicates,
+// debouncing and processing; received are additional fields of the received
+// event.
+func processDelivery(ctx context.Context, webhook webhookRequest, eventUUID string, received map[string]interface{}) eventRecord {
+	if message, code := hookTestSkip(webhook); message != "" {
+		return eventRecord{Reason: message, Code: code}
+	}
+	if !projectLimiter.allow(fmt.Sprint(webhook.Attributes.TargetProjectID)) {
+		return eventRecord{Reason: fmt.Sprint("rate limit exceeded: project ", webhook.Attributes.TargetProjectID), Code: http.StatusTooManyRequests}
+	}
+
+	event := map[string]interface{}{
+		"request_id": requestID(ctx),
+		"project_id": webhook.Attributes.TargetProjectID,
+		"mr":         mrKey(webhook),
+		"action":     webhook.Attributes.Action,
+		"sha":        webhook.Attributes.LastCommit.ID,
+	}
+	for key, value := range received {
+		event[key] = value
+	}
+	publishEvent("received", event)
+
+	keys := deliveryKeys(eventUUID, webhook)
+	if !markDelivery(webhook.Attributes.TargetProjectID, keys) {
+		recordEvent(ctx, webhook, "duplicate delivery - skipping", http.StatusOK)
+		return eventRecord{Reason: "duplicate delivery - skipping", Code: http.StatusOK}
+	}
+
+	if debounceWebhook(webhook) {
+		message := fmt.Sprintf("update queued - processing after %v without further updates", *debounceUpdates)
+		recordEvent(ctx, webhook, message, http.StatusAccepted)
+		return eventRecord{Reason: message, Code: http.StatusAccepted}
+	}
+
+	record := processRecorded(ctx, webhook)
+	if record.Code >= 500 {
+		// failed deliveries are retried by GitLab or the broker and have to
+		// be processed again
+		forgetDelivery(keys)
+	}
+	return record
+}
+
+// processMergeRequest runs the trigger flow for the merge request event and
+// returns the outcome as a message with the matching HTTP status code.
+func processMergeRequest(ctx context.Context, webhook webhookRequest) (string, int) {
+	ctx = withProfile(ctx, webhook.Profile)
+	rememberProjectPath(webhook.Attributes.TargetProjectID, webhook.Attributes.Target.PathWithNamespace)
+	rememberProjectPath(webhook.Attributes.SourceProjectID, webhook.Attributes.Source.PathWithNamespace)
+
+	mr, err := getMergeRequest(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.IID, webhook.Attributes.UpdatedAt)
 	if err != nil {
-		httpError(w, r, "error getting details of the MR:"+err.Error(), http.StatusInternalServerError)
-		return
+		return "error getting details of the MR:" + err.Error(), http.StatusInternalServerError
 	}
 
-	log.Println("[MR]",
+	logEvent(ctx, "[MR]",
 		"state:", webhook.Attributes.State,
 		"id:", webhook.Attributes.ID,
 		"iid:", webhook.Attributes.IID,
@@ -312,65 +736,196 @@ func handlerWebhook(w http.ResponseWriter, r *http.Request) {
 		"should_remove_source_branch:", mr.ShouldRemoveSourceBranch,
 		"force_remove_source_branch:", mr.ForceRemoveSourceBranch)
 
-	if !strings.HasPrefix(webhook.Attributes.Source.HTTPURL, *gitlabURL) {
-		httpError(w, r, webhook.Attributes.Source.HTTPURL+"is not a prefix of"+*gitlabURL, http.StatusNotFound)
-		return
+	if !strings.HasPrefix(webhook.Attributes.Source.HTTPURL, instanceURL(ctx)) {
+		return webhook.Attributes.Source.HTTPURL + " is not a prefix of " + instanceURL(ctx) + " - skipping", http.StatusOK
 	}
 
-	if webhook.Attributes.Source.HTTPURL != webhook.Attributes.Target.HTTPURL {
-		httpError(w, r, "forks are not supported", http.StatusBadRequest)
-		return
+	crossProject := webhook.Attributes.Source.HTTPURL != webhook.Attributes.Target.HTTPURL
+	if crossProject {
+		if err := checkCrossProject(ctx, webhook); err != nil {
+			return err.Error() + " - skipping", http.StatusOK
+		}
+	}
+
+	override := overrideFor(ctx, webhook.Attributes.TargetProjectID)
+	if override.Disabled {
+		commentPolicySkip(ctx, webhook, "triggers are disabled for the project", "ask the maintainers of the CI trigger service to enable them")
+		return "triggers are disabled for the project", http.StatusOK
 	}
 
 	if webhook.Attributes.Action == "open" && mr.ForceRemoveSourceBranch != true {
-		defer setRemoveSourceBranchForMR_AndReport(webhook.Attributes.SourceProjectID, webhook.Attributes.IID, webhook.Attributes.SourceBranch)
+		defer setRemoveSourceBranchForMR_AndReport(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.SourceProjectID, webhook.Attributes.IID, webhook.Attributes.SourceBranch)
 	}
 
 	if webhook.Attributes.Action != "open" && webhook.Attributes.Action != "reopen" && webhook.Attributes.Action != "update" {
-		if webhook.Attributes.State == "merged" && !*shouldTriggerMerged {
-			httpError(w, r, "ignored merged MR: '-trigger-merged' flag is disabled", http.StatusNonAuthoritativeInfo)
-			return
+		triggerMerged := *shouldTriggerMerged
+		if override.TriggerMerged != nil {
+			triggerMerged = *override.TriggerMerged
+		}
+		if webhook.Attributes.State == "merged" && !triggerMerged {
+			return "ignored merged MR: '-trigger-merged' flag is disabled", http.StatusOK
 		}
 
 		if webhook.Attributes.State != "merged" {
-			httpError(w, r, "ignored MR action: " + webhook.Attributes.Action, http.StatusNonAuthoritativeInfo)
-			return
+			return "ignored MR action: " + webhook.Attributes.Action, http.StatusOK
 		}
 	}
 
+	if len(override.TargetBranches) > 0 && !contains(override.TargetBranches, webhook.Attributes.TargetBranch) {
+		commentPolicySkip(ctx, webhook, "pipelines are not triggered for target branch "+webhook.Attributes.TargetBranch,
+			"target one of the branches: "+strings.Join(override.TargetBranches, ", "))
+		return "ignored target branch: " + webhook.Attributes.TargetBranch, http.StatusOK
+	}
+
+	if message, code := mrFiltersSkip(ctx, webhook, mr); message != "" {
+		return message, code
+	}
+
 	if webhook.Attributes.WorkInProgress {
-		httpError(w, r, "Work In Progress - skipping build", http.StatusAccepted)
-		return
+		commentPolicySkip(ctx, webhook, "the MR is Work In Progress", "mark the MR as ready")
+		return "Work In Progress - skipping build", http.StatusOK
 	}
 
-	commit, err := getCommit(webhook.Attributes.SourceProjectID, webhook.Attributes.LastCommit.ID)
-	if err != nil {
-		httpError(w, r, "error getting details of the commit:"+err.Error(), http.StatusInternalServerError)
-		return
+	retriggerOnLabelChange(ctx, &webhook)
+	applyLabelVariables(webhook, mr, &override)
+	applyDescriptionVariables(ctx, mr, &override)
+	if message, code := policySkip(ctx, webhook, mr, &override); message != "" {
+		return message, code
 	}
-	if commit.LastPipeline != nil {
-		message := fmt.Sprintf("commit: %s already has associated pipeline: %d", webhook.Attributes.LastCommit.ID, commit.LastPipeline.ID)
-		httpError(w, r, message, http.StatusOK)
-		defer cancelRedundantBuilds(webhook.Attributes.SourceProjectID, webhook.Attributes.SourceBranch, commit.LastPipeline.ID)
-		return
+	if message, code := filterExecSkip(ctx, webhook, mr, &override); message != "" {
+		return message, code
+	}
+	if message, code := wasmPluginsSkip(ctx, webhook, mr, &override); message != "" {
+		return message, code
+	}
+
+	if webhook.Attributes.State != "merged" {
+		message, code := mergeTrainsSkip(ctx, &webhook, override)
+		if message != "" {
+			return message, code
+		}
+
+		mr = waitForMergeStatus(ctx, webhook, mr)
+		webhook.Attributes.MergeStatus = mr.MergeStatus
+		if message, code := conflictsSkip(ctx, webhook, mr); message != "" {
+			return message, code
+		}
+		if message, code := rebaseSkip(ctx, webhook); message != "" {
+			return message, code
+		}
+	}
+
+	if webhook.Attributes.State == "merged" && sourceCleanupEnabled(override) {
+		defer triggerSourceCleanup(ctx, webhook, mr, override)
+	}
+
+	// MRs can be opened without any commits, their first push is delivered
+	// as an update event which is then processed as usual
+	if webhook.Attributes.LastCommit.ID == "" {
+		return "MR has no commits yet - skipping, the first pushed commit will be built", http.StatusOK
+	}
+
+	cacheKey := commitKey(webhook.Attributes.SourceProjectID, webhook.Attributes.LastCommit.ID)
+	if pipelineID, ok := pipelineCache.get(cacheKey); ok && !webhook.Retrigger && !*shadowMode {
+		return fmt.Sprintf("commit: %s already has associated pipeline: %d (cached)", webhook.Attributes.LastCommit.ID, pipelineID), http.StatusOK
 	}
 
-	token, err := getTriggerToken(webhook.Attributes.SourceProjectID)
+	commit, err := getCommit(ctx, webhook.Attributes.SourceProjectID, webhook.Attributes.LastCommit.ID)
 	if err != nil {
-		httpError(w, r, "error getting trigger token - "+err.Error(), http.StatusInternalServerError)
-		return
+		return "error getting details of the commit:" + err.Error(), http.StatusInternalServerError
+	}
+	if commit.LastPipeline != nil && !webhook.Retrigger && !shadowIgnoresPipeline(webhook, commit.LastPipeline) {
+		pipelineCache.set(cacheKey, commit.LastPipeline.ID)
+		defer cancelRedundantBuilds(ctx, pipelineProjectID(webhook), webhook.Attributes.SourceBranch, commit.LastPipeline.ID)
+		return fmt.Sprintf("commit: %s already has associated pipeline: %d", webhook.Attributes.LastCommit.ID, commit.LastPipeline.ID), http.StatusOK
+	}
+
+	if message, code := invalidCIConfigSkip(ctx, webhook); message != "" {
+		return message, code
+	}
+
+	if message, code := nativePipelinesSkip(ctx, webhook); message != "" {
+		return message, code
+	}
+
+	if message, code := pinnedCommitSkip(ctx, webhook); message != "" {
+		return message, code
+	}
+
+	if *preflight {
+		if message, code := preflightPipeline(ctx, webhook, triggerVariables(webhook, mr, override)); message != "" {
+			return message, code
+		}
+	}
+
+	if dryRunning(ctx) {
+		dryRunPipeline(ctx, pipelineProjectID(webhook), pipelineRef(webhook), triggerVariables(webhook, mr, override))
+		return "dry run - would trigger pipeline for " + pipelineRef(webhook), http.StatusCreated
+	}
+
+	if *shadowMode {
+		return "shadow mode - would trigger pipeline for " + pipelineRef(webhook), http.StatusCreated
 	}
 
-	pipeline, err := runTrigger(webhook, token)
+	if message, code := quietHoursSkip(ctx, webhook); message != "" {
+		return message, code
+	}
+	if message, code := mrThrottleSkip(ctx, webhook); message != "" {
+		return message, code
+	}
+
+	if !acquirePipelineSlot(pipelineProjectID(webhook), webhook) {
+		return fmt.Sprintf("queued - project has %d running pipelines", *maxPipelinesPerProject), http.StatusAccepted
+	}
+
+	var pipeline *pipeline
+	if *createPipelines {
+		pipelineCtx := ctx
+		if *sudoAuthor {
+			pipelineCtx = withSudo(ctx, mr.Author.Username)
+		}
+		pipeline, err = createPipeline(pipelineCtx, webhook, triggerVariables(webhook, mr, override))
+	} else {
+		pipeline, err = triggerPipeline(ctx, webhook, triggerVariables(webhook, mr, override))
+	}
 	if err != nil {
-		httpError(w, r, "error triggering pipeline - "+err.Error(), http.StatusInternalServerError)
-		return
+		releasePipelineSlot(pipelineProjectID(webhook), 0)
+	} else {
+		releasePipelineSlot(pipelineProjectID(webhook), pipeline.ID)
+	}
+	if isNoJobsError(err) {
+		notifyNothingRuns(ctx, webhook, "no jobs match the rules")
+		return "skipped - pipeline not created, no jobs match the rules", http.StatusOK
+	}
+	if isReferenceNotFound(err) {
+		if delay, ok := scheduleRefRetry(ctx, webhook); ok {
+			return fmt.Sprintf("retrying in %s - ref %s not found", delay, pipelineRef(webhook)), http.StatusAccepted
+		}
+		return "skipped - ref " + pipelineRef(webhook) + " does not exist anymore (MR state: " + webhook.Attributes.State + ")", http.StatusOK
+	}
+	if err != nil {
+		return "error triggering pipeline - " + err.Error(), http.StatusInternalServerError
 	}
 
-	message := fmt.Sprintf("created pipeline id: %d", pipeline.ID)
-	httpError(w, r, message, http.StatusCreated)
-	defer cancelRedundantBuilds(webhook.Attributes.SourceProjectID, webhook.Attributes.SourceBranch, pipeline.ID)
-	return
+	pipelineCache.set(cacheKey, pipeline.ID)
+	recordMRTrigger(webhook)
+	// the cached commit does not know its new pipeline yet
+	commitCache.delete(cacheKey)
+	notePipeline(ctx, pipeline)
+	if crossProject {
+		defer reportCrossProjectPipeline(ctx, webhook, pipeline)
+	}
+	if *statusCheckName != "" {
+		// following the pipeline is bounded by -status-check-timeout, not by
+		// the call budget of the event
+		go reportStatusCheck(withProfile(withRequestID(context.Background(), requestID(ctx)), webhook.Profile), webhook, pipeline.ID)
+	}
+	defer cancelRedundantBuilds(ctx, pipelineProjectID(webhook), webhook.Attributes.SourceBranch, pipeline.ID)
+	if *confirmPipeline > 0 {
+		// the jobs are created after answering the webhook
+		go followPipelineJobs(withProfile(withRequestID(context.Background(), requestID(ctx)), webhook.Profile), webhook, pipeline.ID)
+	}
+	return fmt.Sprintf("created pipeline id: %d", pipeline.ID), http.StatusCreated
 }
 
 func handlerPing(w http.ResponseWriter, r *http.Request) {
@@ -378,21 +933,333 @@ func handlerPing(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	flag.Parse()
+	log.SetOutput(redactingWriter{os.Stderr})
+	cmd := parseCommand(os.Args[1:])
+	if *printVersion {
+		printBuildInfo()
+		return
+	}
+	if err := cmd.run(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	if *triggerToken == "" && *privateToken == "" ||
-		*triggerToken != "" && *privateToken != "" {
-		log.Fatal("Specify --trigger-token or --private-token")
+// configure applies the environment, the secret files and Vault to the flags
+// and validates them
+func configure() error {
+	if err := applyEnvironment(); err != nil {
+		return err
+	}
+	if err := loadSecretFiles(); err != nil {
+		return err
+	}
+	if err := configureVault(); err != nil {
+		return err
+	}
+	registerSecrets(secretValue(privateToken), secretValue(triggerToken), secretValue(adminToken), secretValue(webhookSecret), secretValue(vaultToken), secretValue(metricsToken), secretValue(oidcClientSecret))
+	registerURLSecrets()
+	if err := validateAuthFlags(); err != nil {
+		return err
+	}
+	if err := validateOIDCFlags(); err != nil {
+		return err
+	}
+
+	if secretValue(triggerToken) == "" && secretValue(privateToken) == "" && *accessTokensFile == "" ||
+		secretValue(triggerToken) != "" && secretValue(privateToken) != "" {
+		return errors.New("Specify --trigger-token or --private-token")
+	}
+	if *createPipelines && secretValue(privateToken) == "" {
+		return errors.New("-create-pipelines requires --private-token")
+	}
+	if *sudoAuthor && !*createPipelines {
+		return errors.New("-sudo-author requires -create-pipelines")
+	}
+	if *sudoAuthor && *useProjectAccessTokens {
+		return errors.New("-sudo-author requires the admin --private-token, it cannot be used with -project-access-tokens")
+	}
+	if *useProjectAccessTokens && secretValue(privateToken) == "" {
+		return errors.New("-project-access-tokens requires --private-token")
+	}
+	if *maxTriggersPerMR > 0 && *maxTriggersPerMRWindow <= 0 {
+		return errors.New("-max-triggers-per-mr requires a positive -max-triggers-per-mr-window")
 	}
 
 	if *gitlabURL == "" {
-		log.Fatal("Specify --url an address of GitLab instance")
+		return errors.New("Specify --url an address of GitLab instance")
+	}
+	if err := validateRemoveSourcePolicy(*removeSourceBranchPolicy); err != nil {
+		return errors.New("-remove-source-branch: " + err.Error())
+	}
+	if err := configureNotifiers(); err != nil {
+		return err
+	}
+	if err := configureErrorTracking(); err != nil {
+		return err
+	}
+	if err := validateOPAFlags(); err != nil {
+		return err
+	}
+	if err := validateFilterExec(); err != nil {
+		return err
+	}
+	if err := validateWasmPlugins(); err != nil {
+		return err
+	}
+	if err := validateIngestFlags(); err != nil {
+		return err
+	}
+	if err := validatePublishFlags(); err != nil {
+		return err
+	}
+	if err := configureCoordination(); err != nil {
+		return err
+	}
+	if err := validateLeaderElection(); err != nil {
+		return err
+	}
+	if err := validateResponseFlags(); err != nil {
+		return err
+	}
+	if err := validateQuietHours(); err != nil {
+		return err
+	}
+	if err := validateRetriggerStale(); err != nil {
+		return err
+	}
+	if err := validateDescriptionVariables(); err != nil {
+		return err
+	}
+	if err := validateLabelVariables(); err != nil {
+		return err
+	}
+	if err := validateMRFilters(); err != nil {
+		return err
+	}
+	configureGitLabConcurrency()
+	if err := validateListenFlags(); err != nil {
+		return err
+	}
+	if err := validateEmailFlags(); err != nil {
+		return err
+	}
+	if err := validateStatusCheckFlags(); err != nil {
+		return err
+	}
+	if err := validateNativeMRPipelines(*nativeMRPipelines); err != nil {
+		return errors.New("-native-mr-pipelines: " + err.Error())
+	}
+	if err := validateMergeTrains(*mergeTrains); err != nil {
+		return errors.New("-merge-trains: " + err.Error())
+	}
+	if _, err := parseRefStrategy(*refStrategy); err != nil {
+		return errors.New("-ref-strategy: " + err.Error())
+	}
+	if err := validateBranchPatterns(splitList(*removeSourceExceptions)); err != nil {
+		return errors.New("-remove-source-exceptions: " + err.Error())
+	}
+	if *pollInterval > 0 && *pollProjects == "" && *pollGroups == "" {
+		return errors.New("-poll-interval requires -poll-projects or -poll-groups")
+	}
+	if *reconcileWebhooks > 0 && (*webhookURL == "" || *bootstrapProjects == "" && *bootstrapGroups == "") {
+		return errors.New("-reconcile-webhooks requires -webhook-url and -bootstrap-projects or -bootstrap-groups")
+	}
+	if *retriggerOnTargetPush && (*retriggerOnTargetPushMax < 1 || *retriggerOnTargetPushMax > 100) {
+		return errors.New("-retrigger-on-target-push-max must be between 1 and 100")
+	}
+
+	return validateTLSFlags()
+}
+
+// connectGitLab sets up the GitLab client and checks the connection
+func connectGitLab() error {
+	if err := configureGitLabClient(); err != nil {
+		return errors.New("Error configuring GitLab client: " + err.Error())
+	}
+	configureFailover()
+
+	if *useProjectAccessTokens {
+		if err := loadProjectTokens(); err != nil {
+			return errors.New("Error loading project access tokens: " + err.Error())
+		}
+	}
+
+	if *selfCheck {
+		if err := runSelfCheck(); err != nil {
+			return errors.New("Self-check failed: " + err.Error())
+		}
+	}
+
+	if err := negotiateCapabilities(); err != nil {
+		return err
+	}
+
+	if err := loadAccessTokens(); err != nil {
+		return errors.New("Error loading access tokens: " + err.Error())
+	}
+	return nil
+}
+
+func serve() error {
+	if err := configure(); err != nil {
+		return err
+	}
+	if err := connectGitLab(); err != nil {
+		return err
+	}
+	if *gitlabReadURLs != "" {
+		go runFailoverChecks()
+	}
+	if *secretFilesInterval > 0 {
+		go watchSecretFiles()
+	}
+	if vaultEnabled() && *vaultRefresh > 0 {
+		go runVaultRefresh()
+	}
+
+	if done, err := runBootstrap(); done {
+		if err != nil {
+			return errors.New("Bootstrap failed: " + err.Error())
+		}
+		return nil
+	}
+
+	if err := loadAllowlist(); err != nil {
+		return err
 	}
 
-	println("Listening on", *listenAddr, "...")
+	if *leaderElection != "" {
+		go runLeaderElection()
+	}
+	go runNotifier()
+	if emailEnabled() {
+		go runEmailDigest()
+	}
+	if errorTrackingEnabled() {
+		go runErrorReporting()
+	}
+
+	if *maxPipelinesPerProject > 0 {
+		go runPipelineScheduler()
+	}
 
-	http.HandleFunc("/webhook.json", handlerWebhook)
-	http.HandleFunc("/_ping", handlerPing)
+	if *triggerTokenMaintenance > 0 && secretValue(triggerToken) == "" && !*createPipelines {
+		go runTriggerTokenMaintenance()
+	}
+
+	if err := loadOverrides(); err != nil {
+		return errors.New("Error loading per-project overrides: " + err.Error())
+	}
+	if err := loadProfiles(); err != nil {
+		return errors.New("Error loading profiles: " + err.Error())
+	}
+	if err := uploadOPAPolicy(); err != nil {
+		return errors.New("Error uploading OPA policy: " + err.Error())
+	}
+	if err := loadWasmPlugins(); err != nil {
+		return errors.New("Error loading WebAssembly plugins: " + err.Error())
+	}
+
+	if *pollInterval > 0 {
+		go runPoll()
+	}
+	if ingestEnabled() {
+		runIngest()
+	}
+	if publishingEnabled() {
+		go runOutcomePublishing()
+	}
+	if len(quietWindows) > 0 && *quietHoursAction == "queue" {
+		go runQuietHours()
+	}
+	if *retriggerStaleSchedule != "" {
+		go runStaleRetrigger()
+	}
+	if *retriggerOnTargetPush {
+		go runTargetPushRetriggers()
+	}
+	if *reconcileWebhooks > 0 {
+		go runWebhookReconciliation()
+	}
+
+	go reloadOnSignal()
+
+	if *debugListen != "" {
+		go serveDebug()
+	}
+
+	logEffectiveConfig()
+	routes := []struct {
+		handlers string
+		pattern  string
+		handler  http.HandlerFunc
+	}{
+		{handlersWebhook, "/webhook.json", withSourceAllowlist(withRateLimit(handlerWebhook))},
+		{handlersWebhook, "/webhook/", withSourceAllowlist(withRateLimit(handlerWebhook))},
+		{handlersWebhook, "/status-check", withSourceAllowlist(handlerStatusCheck)},
+		{handlersHealth, "/_ping", handlerPing},
+		{handlersHealth, "/_health/live", handlerPing},
+		{handlersHealth, "/_health/ready", handlerReady},
+		{handlersHealth, "/_version", handlerVersion},
+		{handlersMetrics, "/metrics", withMetricsAuth(handlerMetrics)},
+		{handlersAdmin, "/admin/config", withAdminAuth(handlerAdminConfig)},
+		{handlersAdmin, "/admin/shadow", withAdminAuth(handlerAdminShadow)},
+		{handlersAdmin, "/admin/overrides", withAdminAuth(handlerAdminOverrides)},
+		{handlersAdmin, "/admin/trigger-tokens", withAdminAuth(handlerAdminTriggerTokens)},
+		{handlersAdmin, "/admin/reload", withAdminAuth(handlerAdminReload)},
+		{handlersAdmin, "/admin/events", withAdminAuth(handlerAdminEvents)},
+		{handlersAdmin, "/admin/pipelines", withAdminAuth(handlerAdminPipelines)},
+		{handlersAdmin, "/admin/dashboard", withAdminAuth(handlerAdminDashboard)},
+		{handlersAdmin, "/events/stream", withAdminAuth(handlerEventStream)},
+		{handlersAdmin, "/admin/audit", withAdminAuth(handlerAdminAudit)},
+		{handlersAdmin, "/trigger/", withAdminAuth(handlerManualTrigger)},
+		{handlersAdmin, "/admin/replay/", withAdminAuth(handlerAdminReplay)},
+		{handlersAdmin, "/simulate", withAdminAuth(handlerSimulate)},
+		{handlersAdmin, "/oauth/login", handlerOAuthLogin},
+		{handlersAdmin, "/oauth/callback", handlerOAuthCallback},
+		{handlersAdmin, "/oauth/logout", handlerOAuthLogout},
+	}
+
+	var tlsConfig *tls.Config
+	if tlsEnabled() {
+		var err error
+		if tlsConfig, err = serverTLSConfig(); err != nil {
+			return errors.New("Error loading TLS configuration: " + err.Error())
+		}
+	}
+
+	specs, _ := listenSpecs()
+	errs := make(chan error, len(specs))
+	for _, spec := range specs {
+		mux := http.NewServeMux()
+		for _, route := range routes {
+			if spec.sets[route.handlers] {
+				mux.HandleFunc(route.pattern, route.handler)
+			}
+		}
+
+		server := &http.Server{
+			Addr:              spec.addr,
+			Handler:           withRequestLog(withPanicReporting(mux)),
+			ReadHeaderTimeout: *readHeaderTimeout,
+			ReadTimeout:       *readTimeout,
+			IdleTimeout:       *idleTimeout,
+			TLSConfig:         tlsConfig,
+		}
+		listener, err := listen(spec.addr)
+		if err != nil {
+			return errors.New("Error listening on " + spec.addr + ": " + err.Error())
+		}
+		println("Listening on", spec.addr, "...")
+
+		go func() {
+			if tlsConfig != nil {
+				errs <- server.ServeTLS(listener, *tlsCertFile, *tlsKeyFile)
+			} else {
+				errs <- server.Serve(listener)
+			}
+		}()
+	}
 
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	return <-errs
 }
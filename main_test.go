@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookIgnoresOtherEvents(t *testing.T) {
+	defer func(retrigger bool) { *retriggerOnTargetPush = retrigger }(*retriggerOnTargetPush)
+	*retriggerOnTargetPush = false
+
+	for _, kind := range []string{"push", "note", "pipeline"} {
+		r := httptest.NewRequest("POST", "/webhook.json", strings.NewReader(`{"object_kind":"`+kind+`"}`))
+		w := httptest.NewRecorder()
+		handlerWebhook(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s event: %d %s, expected 200", kind, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+/*
+Manual triggers run the flow of a merge request event for an MR fetched from
+the API, so CI can be re-run for an MR whose webhook was lost without pushing
+new commits.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// mrAction maps the state of the MR to the webhook action which runs the
+// same flow: open MRs are handled as updates, so their settings are left as is.
+func mrAction(state string) string {
+	switch state {
+	case "opened", "reopened":
+		return "update"
+	case "merged":
+		return "merge"
+	case "closed":
+		return "close"
+	}
+	return state
+}
+
+func projectFromDetails(details projectDetails) project {
+	return project{
+		ID:                details.ID,
+		PathWithNamespace: details.PathWithNamespace,
+		HTTPURL:           details.HTTPURLToRepo,
+	}
+}
+
+// webhookFromMergeRequest builds the merge request event of the MR from the API
+func webhookFromMergeRequest(ctx context.Context, projectID int64, mrIID int) (webhook webhookRequest, err error) {
+	mr, err := fetchMergeRequest(ctx, projectID, mrIID)
+	if err != nil {
+		return webhook, fmt.Errorf("error getting details of the MR: %s", err)
+	}
+	return webhookFromMR(ctx, mr)
+}
+
+// webhookFromMR builds the merge request event of the MR, looking up its
+// source and target projects
+func webhookFromMR(ctx context.Context, mr mergeRequest) (webhook webhookRequest, err error) {
+	target, err := getProject(ctx, mr.TargetProjectID)
+	if err != nil {
+		return webhook, fmt.Errorf("error getting details of the target project: %s", err)
+	}
+	source := target
+	if mr.SourceProjectID != mr.TargetProjectID {
+		if source, err = getProject(ctx, mr.SourceProjectID); err != nil {
+			return webhook, fmt.Errorf("error getting details of the source project: %s", err)
+		}
+	}
+
+	webhook = webhookRequest{
+		ObjectKind: "merge_request",
+		Project:    projectFromDetails(target),
+		Attributes: objectAttributes{
+			ID:              mr.ID,
+			IID:             mr.IID,
+			TargetBranch:    mr.TargetBranch,
+			SourceBranch:    mr.SourceBranch,
+			SourceProjectID: mr.SourceProjectID,
+			TargetProjectID: mr.TargetProjectID,
+			State:           mr.State,
+			MergeStatus:     mr.MergeStatus,
+			Source:          projectFromDetails(source),
+			Target:          projectFromDetails(target),
+			LastCommit:      commit{ID: mr.SHA},
+			Action:          mrAction(mr.State),
+			WorkInProgress:  mr.WorkInProgress || mr.Draft,
+			UpdatedAt:       mr.UpdatedAt,
+		},
+	}
+	return webhook, nil
+}
+
+// parseTriggerPath parses /trigger/{project_id}/{mr_iid}
+func parseTriggerPath(urlPath string) (projectID int64, mrIID int, err error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(urlPath, "/trigger/"), "/"), "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected /trigger/{project_id}/{mr_iid}, but it was: %s", urlPath)
+	}
+	if projectID, err = strconv.ParseInt(parts[0], 10, 64); err != nil || projectID <= 0 {
+		return 0, 0, fmt.Errorf("invalid project ID: %q", parts[0])
+	}
+	if mrIID, err = strconv.Atoi(parts[1]); err != nil || mrIID <= 0 {
+		return 0, 0, fmt.Errorf("invalid MR IID: %q", parts[1])
+	}
+	return projectID, mrIID, nil
+}
+
+func handlerManualTrigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, "we support POST method only, but it was:"+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	projectID, mrIID, err := parseTriggerPath(r.URL.Path)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx := withRequestID(eventContext(), requestID(r.Context()))
+	webhook, err := webhookFromMergeRequest(ctx, projectID, mrIID)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadGateway)
+		return
+	}
+	logEvent(ctx, "[TRIGGER] manual trigger of MR", mrKey(webhook), "requested by:", clientIP(r))
+
+	publishEvent("received", map[string]interface{}{
+		"request_id": requestID(ctx),
+		"project_id": webhook.Attributes.TargetProjectID,
+		"mr":         mrKey(webhook),
+		"action":     webhook.Attributes.Action,
+		"sha":        webhook.Attributes.LastCommit.ID,
+		"manual":     true,
+	})
+
+	message, code := processSerialized(ctx, webhook)
+	httpError(w, r, message, code)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+)
+
+var triggerMergedSourceCleanup = flag.Bool("trigger-merged-source-cleanup", false, "With -trigger-merged, also trigger a cleanup pipeline on the source branch of the merged MR (MR_PIPELINE=source_cleanup)")
+
+func sourceCleanupEnabled(override projectOverride) bool {
+	if override.MergedSourceCleanup != nil {
+		return *override.MergedSourceCleanup
+	}
+	return *triggerMergedSourceCleanup
+}
+
+// triggerSourceCleanup triggers the cleanup pipeline on the source branch of
+// the merged MR, eg. to tear down its review environment, before the branch
+// is removed. The pipeline can not run once the branch is gone.
+func triggerSourceCleanup(ctx context.Context, webhook webhookRequest, mr mergeRequest, override projectOverride) {
+	webhook.SourceCleanup = true
+	variables := triggerVariables(webhook, mr, override)
+
+	if *shadowMode {
+		logEvent(ctx, "[SHADOW] would trigger source cleanup pipeline for", pipelineRef(webhook))
+		return
+	}
+	if dryRunning(ctx) {
+		dryRunPipeline(ctx, pipelineProjectID(webhook), pipelineRef(webhook), variables)
+		return
+	}
+	if budgetExhausted(ctx) {
+		logEvent(ctx, "[MR] skipped source cleanup pipeline:", errBudgetExhausted)
+		return
+	}
+
+	var pipeline *pipeline
+	var err error
+	if *createPipelines {
+		pipelineCtx := ctx
+		if *sudoAuthor {
+			pipelineCtx = withSudo(ctx, mr.Author.Username)
+		}
+		pipeline, err = createPipeline(pipelineCtx, webhook, variables)
+	} else {
+		pipeline, err = triggerPipeline(ctx, webhook, variables)
+	}
+	if isReferenceNotFound(err) {
+		logEvent(ctx, "[MR] skipped source cleanup pipeline - branch", pipelineRef(webhook), "does not exist anymore")
+		return
+	}
+	if err != nil {
+		logEvent(ctx, "[MR] ERROR triggering source cleanup pipeline:", err)
+		return
+	}
+	logEvent(ctx, "[MR] triggered source cleanup pipeline id:", pipeline.ID, "ref:", pipelineRef(webhook))
+}
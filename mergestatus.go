@@ -0,0 +1,59 @@
+package main
+
+/*
+GitLab checks the mergeability of MRs asynchronously, so webhooks of just
+pushed commits often report merge_status "checking". The pipeline can wait for
+the check to settle, to pass the outcome as variables and to skip MRs with
+conflicts, whose pipelines are doomed.
+
+References:
+ - https://docs.gitlab.com/ee/api/merge_requests.html#merge-status
+*/
+
+import (
+	"context"
+	"flag"
+	"time"
+)
+
+var mergeStatusWait = flag.Duration("merge-status-wait", 0, "How long to wait for the mergeability check of open MRs to settle before triggering, eg. 10s (0 disables)")
+var skipConflicted = flag.Bool("skip-conflicted", false, "Skip triggering for MRs which can not be merged due to conflicts (explained in an MR comment with -comment-policy-skips)")
+
+const mergeStatusPollInterval = time.Second
+
+// mergeStatusSettled reports whether the mergeability check of the MR is over
+func mergeStatusSettled(status string) bool {
+	switch status {
+	case "unchecked", "checking", "cannot_be_merged_recheck":
+		return false
+	}
+	return true
+}
+
+// hasConflicts reports whether the MR can not be merged due to conflicts
+func (mr mergeRequest) hasConflicts() bool {
+	return mr.HasConflicts || mr.MergeStatus == "cannot_be_merged"
+}
+
+// waitForMergeStatus polls the MR until its mergeability check settles, for
+// -merge-status-wait at most, and returns the MR as last seen.
+func waitForMergeStatus(ctx context.Context, webhook webhookRequest, mr mergeRequest) mergeRequest {
+	if *mergeStatusWait <= 0 || mergeStatusSettled(mr.MergeStatus) {
+		return mr
+	}
+
+	deadline := time.Now().Add(*mergeStatusWait)
+	for !mergeStatusSettled(mr.MergeStatus) && time.Now().Before(deadline) {
+		time.Sleep(mergeStatusPollInterval)
+		latest, err := fetchMergeRequest(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.IID)
+		if err != nil {
+			logEvent(ctx, "[MR] ERROR checking merge status:", err)
+			return mr
+		}
+		mr = latest
+	}
+	if !mergeStatusSettled(mr.MergeStatus) {
+		logEvent(ctx, "[MR] merge status did not settle in", *mergeStatusWait, "- status:", mr.MergeStatus)
+	}
+	return mr
+}
@@ -0,0 +1,79 @@
+package main
+
+/*
+Merge trains (GitLab Premium) run merged results pipelines of the queued MRs
+themselves, so a pipeline triggered for the source branch conflicts with them.
+Projects using merge trains can be skipped, or triggered for the merge ref of
+the MR (the merged result) instead of the source branch.
+
+References:
+ - https://docs.gitlab.com/ee/ci/pipelines/merge_trains.html
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+)
+
+const (
+	mergeTrainsActionSkip     = "skip"
+	mergeTrainsActionMergeRef = "merge-ref"
+)
+
+var mergeTrains = flag.String("merge-trains", "", "What to do for open MRs of projects using merge trains: skip, or merge-ref to trigger for the merged result (ignored when empty)")
+
+// mergeTrainProjects caches whether the projects use merge trains
+var mergeTrainProjects = newTTLCache(triggerTokenCacheTTL)
+
+func validateMergeTrains(value string) error {
+	switch value {
+	case "", mergeTrainsActionSkip, mergeTrainsActionMergeRef:
+		return nil
+	}
+	return errors.New("invalid value: " + value + ", expected skip or merge-ref")
+}
+
+func usesMergeTrains(ctx context.Context, projectID int64) (bool, error) {
+	key := projectKey(ctx, projectID)
+	if enabled, ok := mergeTrainProjects.get(key); ok {
+		return enabled.(bool), nil
+	}
+
+	details, err := getProject(ctx, projectID)
+	if err != nil {
+		return false, err
+	}
+	mergeTrainProjects.set(key, details.MergeTrainsEnabled)
+	return details.MergeTrainsEnabled, nil
+}
+
+// mergeTrainsSkip returns the reason to skip the trigger of the open MR when
+// its project uses merge trains, or switches its pipeline to the merge ref,
+// by the setting of the project.
+func mergeTrainsSkip(ctx context.Context, webhook *webhookRequest, override projectOverride) (string, int) {
+	action := *mergeTrains
+	if override.MergeTrains != "" {
+		action = override.MergeTrains
+	}
+	if action == "" {
+		return "", 0
+	}
+
+	enabled, err := usesMergeTrains(ctx, webhook.Attributes.TargetProjectID)
+	if err != nil {
+		logEvent(ctx, "[MERGE-TRAINS] ERROR checking project:", err)
+		return "", 0
+	}
+	if !enabled {
+		return "", 0
+	}
+
+	if action == mergeTrainsActionSkip {
+		return "skipped - the project uses merge trains", http.StatusOK
+	}
+	webhook.RefStrategy = refMergeRef
+	logEvent(ctx, "[MERGE-TRAINS] the project uses merge trains, triggering for", pipelineRef(*webhook))
+	return "", 0
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is a counter or gauge exposed in the Prometheus text format, with
+// its values keyed by the formatted labels, eg. `project="1"`.
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	values map[string]float64
+}
+
+var metrics = struct {
+	sync.Mutex
+	list []*metric
+}{}
+
+func newMetric(kind, name, help string) *metric {
+	m := &metric{name: name, help: help, kind: kind, values: make(map[string]float64)}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.list = append(metrics.list, m)
+	return m
+}
+
+func newCounter(name, help string) *metric {
+	return newMetric("counter", name, help)
+}
+
+func newGauge(name, help string) *metric {
+	return newMetric("gauge", name, help)
+}
+
+// labels formats the label pairs, eg. labels("project", "1")
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *metric) add(labels string, value float64) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	m.values[labels] += value
+}
+
+func (m *metric) inc(labels string) {
+	m.add(labels, 1)
+}
+
+func (m *metric) set(labels string, value float64) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	m.values[labels] = value
+}
+
+func handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics.list {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == "" {
+				fmt.Fprintf(w, "%s %g\n", m.name, m.values[key])
+			} else {
+				fmt.Fprintf(w, "%s{%s} %g\n", m.name, key, m.values[key])
+			}
+		}
+	}
+}
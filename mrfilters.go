@@ -0,0 +1,133 @@
+package main
+
+/*
+MR filters restrict the triggers to the MRs of some milestones, assignees or
+reviewers, eg. to run expensive pipelines only for the MRs of a release:
+
+    -milestones "Release 4.*" -reviewers @my-group/qa
+
+Milestones are matched by their titles (names, globs or regular expressions
+between slashes), assignees and reviewers by their usernames or, prefixed
+with @, by their membership of a group. The assignees and reviewers are taken
+from the webhook payload, or from the MR API for payloads without them.
+
+References:
+ - https://docs.gitlab.com/ee/api/merge_requests.html#get-single-mr
+ - https://docs.gitlab.com/ee/api/members.html#list-all-members-of-a-group-or-project-including-inherited-and-invited-members
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var milestoneFilter = flag.String("milestones", "", "Comma separated titles of milestones (names, globs or regular expressions between slashes) whose MRs are triggered, all MRs when empty")
+var assigneeFilter = flag.String("assignees", "", "Comma separated usernames, or groups prefixed with @, of which an assignee of the MR is required for triggering, all MRs when empty")
+var reviewerFilter = flag.String("reviewers", "", "Comma separated usernames, or groups prefixed with @, of which a reviewer of the MR is required for triggering, all MRs when empty")
+
+type milestone struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+}
+
+// the members of groups change rarely, they are remembered this long
+var groupMembersCacheTTL = 5 * time.Minute
+var groupMembersCache = newTTLCache(&groupMembersCacheTTL)
+
+var mrFilterSkipsCounter = newCounter("mr_filter_skips_total", "MRs skipped by the milestone, assignee and reviewer filters, by filter")
+
+func validateMRFilters() error {
+	if err := validateBranchPatterns(splitList(*milestoneFilter)); err != nil {
+		return errors.New("invalid -milestones: " + err.Error())
+	}
+	return nil
+}
+
+func getGroupMembers(ctx context.Context, group string) (map[string]bool, error) {
+	if cached, ok := cachedLookup(groupMembersCache, "group_members", group); ok {
+		return cached.(map[string]bool), nil
+	}
+	var members []gitlabUser
+	reqURL := fmt.Sprintf("%s/api/v4/groups/%s/members/all", *gitlabURL, projectPathID(group))
+	if err := getAllPages(ctx, 0, reqURL, &members); err != nil {
+		return nil, err
+	}
+	usernames := make(map[string]bool, len(members))
+	for _, member := range members {
+		usernames[member.Username] = true
+	}
+	groupMembersCache.set(group, usernames)
+	return usernames, nil
+}
+
+// anyUserAllowed reports whether any of the users is one of the usernames or
+// a member of one of the groups of the filter
+func anyUserAllowed(ctx context.Context, filter []string, users []gitlabUser) (bool, error) {
+	for _, entry := range filter {
+		if !strings.HasPrefix(entry, "@") {
+			for _, user := range users {
+				if user.Username == entry {
+					return true, nil
+				}
+			}
+			continue
+		}
+		if len(users) == 0 {
+			continue
+		}
+		members, err := getGroupMembers(ctx, strings.TrimPrefix(entry, "@"))
+		if err != nil {
+			return false, fmt.Errorf("error getting the members of group %s: %s", entry, err)
+		}
+		for _, user := range users {
+			if members[user.Username] {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// mrFiltersSkip returns the reason of skipping the MR when it does not pass
+// the milestone, assignee or reviewer filters
+func mrFiltersSkip(ctx context.Context, webhook webhookRequest, mr mergeRequest) (string, int) {
+	if milestones := splitList(*milestoneFilter); len(milestones) > 0 {
+		if mr.Milestone == nil || !matchesAnyBranch(milestones, mr.Milestone.Title) {
+			mrFilterSkipsCounter.inc(labels("filter", "milestone"))
+			commentPolicySkip(ctx, webhook, "pipelines are not triggered for MRs outside the milestones: "+*milestoneFilter, "add the MR to one of the milestones")
+			return "ignored MR outside the milestones: " + *milestoneFilter, http.StatusOK
+		}
+	}
+
+	assignees, reviewers := webhook.Assignees, webhook.Reviewers
+	if assignees == nil {
+		assignees = mr.Assignees
+	}
+	if reviewers == nil {
+		reviewers = mr.Reviewers
+	}
+	for _, filter := range []struct {
+		name, list string
+		users      []gitlabUser
+	}{{"assignee", *assigneeFilter, assignees}, {"reviewer", *reviewerFilter, reviewers}} {
+		entries := splitList(filter.list)
+		if len(entries) == 0 {
+			continue
+		}
+		allowed, err := anyUserAllowed(ctx, entries, filter.users)
+		if err != nil {
+			return err.Error(), http.StatusInternalServerError
+		}
+		if !allowed {
+			mrFilterSkipsCounter.inc(labels("filter", filter.name))
+			commentPolicySkip(ctx, webhook, "pipelines are only triggered for MRs with one of "+filter.list+" as "+filter.name, "add one of them as "+filter.name+" of the MR")
+			return "ignored MR, none of its " + filter.name + "s is one of: " + filter.list, http.StatusOK
+		}
+	}
+	return "", 0
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var maxTriggersPerMR = flag.Int("max-triggers-per-mr", 0, "Maximum number of pipelines triggered for a single MR within -max-triggers-per-mr-window, further triggers wait and the newest commit wins (0 is unlimited)")
+var maxTriggersPerMRWindow = flag.Duration("max-triggers-per-mr-window", 10*time.Minute, "Time window of -max-triggers-per-mr")
+
+type heldMRTrigger struct {
+	timer   *time.Timer
+	webhook webhookRequest
+}
+
+// mrTriggers are the times of the recent triggers of the MRs, and the
+// triggers held until the window of the MR has room again
+var mrTriggers = struct {
+	sync.Mutex
+	triggered map[string][]time.Time
+	held      map[string]*heldMRTrigger
+}{triggered: make(map[string][]time.Time), held: make(map[string]*heldMRTrigger)}
+
+var mrThrottledCounter = newCounter("mr_triggers_throttled_total", "Triggers held by -max-triggers-per-mr, by project")
+
+// recentTriggersLocked returns the triggers of the MR within the window,
+// dropping the older ones
+func recentTriggersLocked(key string, now time.Time) []time.Time {
+	var recent []time.Time
+	for _, t := range mrTriggers.triggered[key] {
+		if now.Sub(t) < *maxTriggersPerMRWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(mrTriggers.triggered, key)
+	} else {
+		mrTriggers.triggered[key] = recent
+	}
+	return recent
+}
+
+// mrThrottleSkip returns the reason of holding the trigger when the MR had
+// -max-triggers-per-mr triggers within the window, and holds the webhook
+// (replacing the older held event of the MR) until the oldest of them leaves
+// the window.
+func mrThrottleSkip(ctx context.Context, webhook webhookRequest) (string, int) {
+	if *maxTriggersPerMR <= 0 {
+		return "", 0
+	}
+
+	key := mrKey(webhook)
+
+	mrTriggers.Lock()
+	defer mrTriggers.Unlock()
+
+	now := time.Now()
+	recent := recentTriggersLocked(key, now)
+	if len(recent) < *maxTriggersPerMR {
+		return "", 0
+	}
+
+	mrThrottledCounter.inc(labels("project", fmt.Sprint(webhook.Attributes.TargetProjectID)))
+	wait := recent[0].Add(*maxTriggersPerMRWindow).Sub(now)
+	if held, ok := mrTriggers.held[key]; ok {
+		logEvent(ctx, "[THROTTLE] MR:", key, "held commit:", held.webhook.Attributes.LastCommit.ID, "superseded by commit:", webhook.Attributes.LastCommit.ID)
+		held.webhook = webhook
+	} else {
+		held := &heldMRTrigger{webhook: webhook}
+		held.timer = time.AfterFunc(wait, func() { releaseMRTrigger(key, held) })
+		mrTriggers.held[key] = held
+	}
+	return fmt.Sprintf("throttled - %d pipelines triggered for the MR within %v, the newest commit is triggered in %v",
+		len(recent), *maxTriggersPerMRWindow, wait.Round(time.Second)), http.StatusAccepted
+}
+
+// recordMRTrigger notes a pipeline triggered for the MR
+func recordMRTrigger(webhook webhookRequest) {
+	if *maxTriggersPerMR <= 0 {
+		return
+	}
+
+	mrTriggers.Lock()
+	defer mrTriggers.Unlock()
+
+	now := time.Now()
+	if len(mrTriggers.triggered) >= cachePurgeSize {
+		for key := range mrTriggers.triggered {
+			recentTriggersLocked(key, now)
+		}
+	}
+	key := mrKey(webhook)
+	mrTriggers.triggered[key] = append(mrTriggers.triggered[key], now)
+}
+
+func releaseMRTrigger(key string, held *heldMRTrigger) {
+	mrTriggers.Lock()
+	if mrTriggers.held[key] != held {
+		mrTriggers.Unlock()
+		return
+	}
+	delete(mrTriggers.held, key)
+	webhook := held.webhook
+	mrTriggers.Unlock()
+
+	message, code := processSerialized(eventContext(), webhook)
+	log.Println("[THROTTLE]", "released MR:", key, code, ":", message)
+}
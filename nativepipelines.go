@@ -0,0 +1,113 @@
+package main
+
+/*
+Projects which migrated to native merge request pipelines get a pipeline from
+GitLab for every push to an MR, so triggering another one would double them.
+Their CI configuration is recognized by the rules or "only" of the jobs or the
+workflow mentioning merge request events.
+
+References:
+ - https://docs.gitlab.com/ee/ci/pipelines/merge_request_pipelines.html
+ - https://docs.gitlab.com/ee/api/lint.html#validate-a-projects-ci-configuration
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+const (
+	nativeMRPipelinesWarn = "warn"
+	nativeMRPipelinesSkip = "skip"
+)
+
+var nativeMRPipelines = flag.String("native-mr-pipelines", "", "What to do when the CI configuration of the source branch uses native merge request pipelines: warn (log and trigger anyway) or skip (disabled when empty)")
+var nativeMRPipelinesCacheTTL = flag.Duration("native-mr-pipelines-cache-ttl", 10*time.Minute, "How long the detection of native merge request pipelines is remembered per branch (0 disables)")
+
+var nativePipelinesCache = newTTLCache(nativeMRPipelinesCacheTTL)
+
+var nativePipelinesCounter = newCounter("native_mr_pipelines_total", "MR events of projects using native merge request pipelines, by the action taken")
+
+var nativePipelinesRegexps = []*regexp.Regexp{
+	// rules: - if: $CI_PIPELINE_SOURCE == "merge_request_event"
+	regexp.MustCompile(`\$\{?CI_PIPELINE_SOURCE\}?\s*==\s*["']merge_request_event["']`),
+	// only: [merge_requests] or only: merge_requests
+	regexp.MustCompile(`(?m)^[ \t]*only:[ \t]*\[?[^\]\n#]*\bmerge_requests\b`),
+	// only:
+	//   refs:
+	//     - merge_requests
+	regexp.MustCompile(`(?m)^[ \t]*only:[ \t]*\n([ \t]*(refs:|-[ \t]*\S+)[ \t]*\n)*[ \t]*-[ \t]*["']?merge_requests["']?[ \t]*$`),
+}
+
+func validateNativeMRPipelines(value string) error {
+	switch value {
+	case "", nativeMRPipelinesWarn, nativeMRPipelinesSkip:
+		return nil
+	}
+	return errors.New("invalid value: " + value + ", expected warn or skip")
+}
+
+type mergedCIConfig struct {
+	Valid      bool     `json:"valid"`
+	Errors     []string `json:"errors"`
+	MergedYAML string   `json:"merged_yaml"`
+	// Jobs are the jobs the dry run would create
+	Jobs []lintJob `json:"jobs"`
+}
+
+// getMergedCIConfig returns the CI configuration of the project at the ref,
+// with its includes expanded and the jobs of a simulated push pipeline. The
+// ref is ignored by GitLab without a dry run, which lints the configuration
+// of the default branch then.
+func getMergedCIConfig(ctx context.Context, projectID int64, ref string) (config mergedCIConfig, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/ci/lint?dry_run=true&include_jobs=true&ref=%s", *gitlabURL, projectID, url.QueryEscape(ref))
+	_, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &config)
+	return
+}
+
+func usesNativeMRPipelines(yaml string) bool {
+	for _, re := range nativePipelinesRegexps {
+		if re.MatchString(yaml) {
+			return true
+		}
+	}
+	return false
+}
+
+// nativePipelinesSkip returns the reason to skip the trigger when the source
+// branch of the MR gets native merge request pipelines. Merged MRs are not
+// affected, GitLab runs no merge request pipeline for them.
+func nativePipelinesSkip(ctx context.Context, webhook webhookRequest) (string, int) {
+	if *nativeMRPipelines == "" || webhook.Attributes.State == "merged" {
+		return "", 0
+	}
+
+	projectID, ref := webhook.Attributes.SourceProjectID, webhook.Attributes.SourceBranch
+	key := projectKey(ctx, projectID) + "@" + ref
+	native, ok := nativePipelinesCache.get(key)
+	if !ok {
+		config, err := getMergedCIConfig(ctx, projectID, ref)
+		if err != nil {
+			logEvent(ctx, "[NATIVE] ERROR getting CI configuration:", err)
+			return "", 0
+		}
+		native = config.Valid && usesNativeMRPipelines(config.MergedYAML)
+		nativePipelinesCache.set(key, native)
+	}
+	if !native.(bool) {
+		return "", 0
+	}
+
+	nativePipelinesCounter.inc(labels("action", *nativeMRPipelines))
+	if *nativeMRPipelines == nativeMRPipelinesWarn {
+		logEvent(ctx, "[NATIVE] WARNING the CI configuration of", ref, "uses native merge request pipelines, the triggered pipeline doubles them")
+		return "", 0
+	}
+	return "skipped - the CI configuration of " + ref + " uses native merge request pipelines", http.StatusOK
+}
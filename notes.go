@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var commentPolicySkips = flag.Bool("comment-policy-skips", false, "Comment on the MR when a policy (eg. per-project target branches, Work In Progress) withholds its pipeline")
+
+// policyNoteMarker identifies the single comment explaining policy skips,
+// which is updated instead of adding new ones
+const policyNoteMarker = "<!-- mr-trigger:policy -->"
+
+type note struct {
+	ID   int    `json:"id"`
+	Body string `json:"body"`
+}
+
+func createMRNote(ctx context.Context, projectID int64, mrIID int, body string) (note note, err error) {
+	jsonStr, _ := json.Marshal(map[string]string{"body": body})
+
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d/notes", *gitlabURL, projectID, mrIID)
+	_, err = doProjectRequest(ctx, projectID, "POST", reqURL, "application/json", bytes.NewBuffer(jsonStr), &note)
+	return
+}
+
+func updateMRNote(ctx context.Context, projectID int64, mrIID int, noteID int, body string) (note note, err error) {
+	jsonStr, _ := json.Marshal(map[string]string{"body": body})
+
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d/notes/%d", *gitlabURL, projectID, mrIID, noteID)
+	_, err = doProjectRequest(ctx, projectID, "PUT", reqURL, "application/json", bytes.NewBuffer(jsonStr), &note)
+	return
+}
+
+func listMRNotes(ctx context.Context, projectID int64, mrIID int) (notes []note, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d/notes?sort=desc", *gitlabURL, projectID, mrIID)
+	err = getAllPages(ctx, projectID, reqURL, &notes)
+	return
+}
+
+// upsertMRNote updates the comment containing the marker, or adds a new one
+func upsertMRNote(ctx context.Context, projectID int64, mrIID int, marker, body string) error {
+	body = body + "\n\n" + marker
+
+	notes, err := listMRNotes(ctx, projectID, mrIID)
+	if err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if strings.Contains(n.Body, marker) {
+			if n.Body == body {
+				return nil
+			}
+			_, err = updateMRNote(ctx, projectID, mrIID, n.ID, body)
+			return err
+		}
+	}
+
+	_, err = createMRNote(ctx, projectID, mrIID, body)
+	return err
+}
+
+// commentPolicySkip explains in a comment on the MR why its pipeline was
+// withheld by a policy and how to get one.
+func commentPolicySkip(ctx context.Context, webhook webhookRequest, reason, howToOverride string) {
+	if !*commentPolicySkips || *shadowMode || budgetExhausted(ctx) {
+		return
+	}
+	if dryRunning(ctx) {
+		logEvent(ctx, "[DRY-RUN] would comment on MR:", webhook.Attributes.IID, "reason:", reason)
+		return
+	}
+
+	body := fmt.Sprintf("CI pipeline was not triggered for commit %s: %s.\n\nTo get a pipeline, %s.",
+		webhook.Attributes.LastCommit.ID, reason, howToOverride)
+	if err := upsertMRNote(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.IID, policyNoteMarker, body); err != nil {
+		logEvent(ctx, "[MR] ERROR commenting policy skip:", err)
+	}
+}
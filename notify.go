@@ -0,0 +1,315 @@
+package main
+
+/*
+Notifiers let on-call learn about lost MR builds: failed triggers, tokens
+rejected by GitLab and GitLab outages, and optionally the triggered pipelines.
+Notifications are collected for -notify-batch-interval and sent together,
+repeated ones are counted instead of sent again, and the same notification is
+not sent again for -notify-dedup-window.
+
+Every sink receives the kinds of notifications routed to it: a comma
+separated list of kinds, "errors" (the default) or "successes". Sinks are
+configured globally with flags, or per project in the overrides.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var notifyBatchInterval = flag.Duration("notify-batch-interval", time.Minute, "How long notifications are collected to be sent together")
+var notifyDedupWindow = flag.Duration("notify-dedup-window", time.Hour, "How long a sent notification is not sent again")
+var notifyTemplate = flag.String("notify-template", "", "Go template of the chat message line of a notification, eg. {{.Kind}}: {{.Message}} in {{.Project}} (the built-in format when empty)")
+
+const (
+	notifyTriggerFailed = "trigger_failed"
+	notifyTokenError    = "token_error"
+	notifyGitLabOutage  = "gitlab_outage"
+	notifyTriggered     = "triggered"
+	notifyHookDisabled  = "hook_disabled"
+)
+
+// notifyGroups are the aliases of the kinds of notifications in the routes
+var notifyGroups = map[string][]string{
+	"errors":    {notifyTriggerFailed, notifyTokenError, notifyGitLabOutage, notifyHookDisabled},
+	"successes": {notifyTriggered},
+}
+
+type notification struct {
+	Kind        string `json:"kind"`
+	ProjectID   int64  `json:"project_id,omitempty"`
+	Project     string `json:"project,omitempty"`
+	MR          string `json:"mr,omitempty"`
+	RequestID   string `json:"request_id,omitempty"`
+	Message     string `json:"message"`
+	PipelineURL string `json:"pipeline_url,omitempty"`
+	// Count is the number of times the notification was raised in the batch
+	Count int `json:"count"`
+}
+
+// notifier sends a batch of notifications to a chat or an alerting system
+type notifier interface {
+	name() string
+	send(batch []notification) error
+}
+
+// notifySink is a notifier with the kinds of notifications routed to it
+type notifySink struct {
+	// Type is slack, teams or webhook (a generic JSON webhook)
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// Events are the routed kinds, errors by default
+	Events string `json:"events,omitempty"`
+}
+
+// notifiers are the global sinks, set up by configureNotifiers
+var notifiers []notifySink
+
+var pendingNotifications = struct {
+	sync.Mutex
+	batch []*notification
+}{}
+
+var sentNotifications = newTTLCache(notifyDedupWindow)
+
+var notificationsCounter = newCounter("notifications_total", "Notifications sent, by kind")
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+var notificationTemplate *template.Template
+
+func (s notifySink) validate() error {
+	switch s.Type {
+	case "slack", "teams", "webhook":
+	default:
+		return errors.New("invalid notification type: " + s.Type + ", expected slack, teams or webhook")
+	}
+	if !strings.HasPrefix(s.URL, "https://") && !strings.HasPrefix(s.URL, "http://") {
+		return errors.New("invalid notification URL of " + s.Type)
+	}
+	for _, kind := range splitList(s.Events) {
+		if _, ok := notifyGroups[kind]; !ok && kind != notifyTriggerFailed && kind != notifyTokenError && kind != notifyGitLabOutage && kind != notifyTriggered && kind != notifyHookDisabled {
+			return errors.New("invalid notification event: " + kind)
+		}
+	}
+	return nil
+}
+
+// routes reports whether the kind of notifications is routed to the sink
+func (s notifySink) routes(kind string) bool {
+	events := splitList(s.Events)
+	if len(events) == 0 {
+		events = []string{"errors"}
+	}
+	for _, event := range events {
+		if event == kind || contains(notifyGroups[event], kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s notifySink) notifier() notifier {
+	switch s.Type {
+	case "teams":
+		return teamsNotifier{url: s.URL}
+	case "webhook":
+		return webhookNotifier{url: s.URL}
+	}
+	return slackNotifier{url: s.URL}
+}
+
+func notificationsEnabled() bool {
+	return *slackWebhookURL != "" || *teamsWebhookURL != "" || *notifyWebhookURL != ""
+}
+
+func configureNotifiers() error {
+	var sinks []notifySink
+	if *slackWebhookURL != "" {
+		sinks = append(sinks, notifySink{Type: "slack", URL: *slackWebhookURL, Events: *slackEvents})
+	}
+	if *teamsWebhookURL != "" {
+		sinks = append(sinks, notifySink{Type: "teams", URL: *teamsWebhookURL, Events: *teamsEvents})
+	}
+	if *notifyWebhookURL != "" {
+		sinks = append(sinks, notifySink{Type: "webhook", URL: *notifyWebhookURL, Events: *notifyWebhookEvents})
+	}
+	for _, sink := range sinks {
+		if err := sink.validate(); err != nil {
+			return err
+		}
+		registerSecrets(sink.URL)
+	}
+
+	var tmpl *template.Template
+	if *notifyTemplate != "" {
+		var err error
+		if tmpl, err = template.New("notification").Parse(*notifyTemplate); err != nil {
+			return errors.New("-notify-template: " + err.Error())
+		}
+	}
+
+	notifiers = sinks
+	notificationTemplate = tmpl
+	return nil
+}
+
+func (n notification) key() string {
+	return fmt.Sprintf("%s|%d|%s|%s", n.Kind, n.ProjectID, n.MR, n.Message)
+}
+
+// text formats the notification as a single line, by -notify-template
+func (n notification) text() string {
+	if notificationTemplate != nil {
+		var buf bytes.Buffer
+		if err := notificationTemplate.Execute(&buf, n); err == nil {
+			return redact(buf.String())
+		}
+	}
+
+	var context []string
+	if n.Project != "" {
+		context = append(context, "project "+n.Project)
+	} else if n.ProjectID != 0 {
+		context = append(context, fmt.Sprint("project ", n.ProjectID))
+	}
+	if n.MR != "" {
+		context = append(context, "MR "+n.MR)
+	}
+	if n.RequestID != "" {
+		context = append(context, "request "+n.RequestID)
+	}
+
+	text := "[" + n.Kind + "] " + redact(n.Message)
+	if n.PipelineURL != "" {
+		text += " " + n.PipelineURL
+	}
+	if len(context) > 0 {
+		text += " (" + strings.Join(context, ", ") + ")"
+	}
+	if n.Count > 1 {
+		text += fmt.Sprintf(" - %d times", n.Count)
+	}
+	return text
+}
+
+// routed reports whether any sink receives the notification
+func (n notification) routed() bool {
+	for _, sink := range notifiers {
+		if sink.routes(n.Kind) {
+			return true
+		}
+	}
+	sink := projectOverrideFor(n.ProjectID).Notify
+	return n.ProjectID != 0 && sink != nil && sink.routes(n.Kind)
+}
+
+// notify queues the notification for the next batch
+func notify(n notification) {
+	if !n.routed() {
+		return
+	}
+	if n.Project == "" && n.ProjectID != 0 {
+		n.Project = rememberedProjectPath(n.ProjectID)
+	}
+	key := n.key()
+	if _, sent := sentNotifications.get(key); sent {
+		return
+	}
+
+	pendingNotifications.Lock()
+	defer pendingNotifications.Unlock()
+
+	for _, pending := range pendingNotifications.batch {
+		if pending.key() == key {
+			pending.Count++
+			return
+		}
+	}
+	n.Count = 1
+	pendingNotifications.batch = append(pendingNotifications.batch, &n)
+}
+
+func runNotifier() {
+	for range time.Tick(*notifyBatchInterval) {
+		flushNotifications()
+	}
+}
+
+// routedBatch returns the notifications of the batch routed to the sink
+func routedBatch(sink notifySink, batch []notification) (routed []notification) {
+	for _, n := range batch {
+		if sink.routes(n.Kind) {
+			routed = append(routed, n)
+		}
+	}
+	return
+}
+
+func flushNotifications() {
+	pendingNotifications.Lock()
+	pending := pendingNotifications.batch
+	pendingNotifications.batch = nil
+	pendingNotifications.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	batch := make([]notification, 0, len(pending))
+	byProject := make(map[int64][]notification)
+	for _, n := range pending {
+		sentNotifications.set(n.key(), true)
+		batch = append(batch, *n)
+		if n.ProjectID != 0 {
+			byProject[n.ProjectID] = append(byProject[n.ProjectID], *n)
+		}
+	}
+
+	sendRouted := func(sink notifySink, batch []notification) {
+		routed := routedBatch(sink, batch)
+		if len(routed) == 0 {
+			return
+		}
+		for _, n := range routed {
+			notificationsCounter.inc(labels("kind", n.Kind))
+		}
+		sender := sink.notifier()
+		if err := sender.send(routed); err != nil {
+			log.Println("[NOTIFY] ERROR sending", len(routed), "notifications to", sender.name(), ":", err)
+		}
+	}
+	for _, sink := range notifiers {
+		sendRouted(sink, batch)
+	}
+	for projectID, projectBatch := range byProject {
+		if sink := projectOverrideFor(projectID).Notify; sink != nil {
+			sendRouted(*sink, projectBatch)
+		}
+	}
+}
+
+// postJSON posts the payload to the webhook of a notifier
+func postJSON(url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
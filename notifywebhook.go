@@ -0,0 +1,32 @@
+package main
+
+import "flag"
+
+var notifyWebhookURL = flag.String("notify-webhook-url", "", "URL receiving notifications as JSON, eg. of an alerting system")
+var notifyWebhookEvents = flag.String("notify-webhook-events", "errors", "Notifications routed to -notify-webhook-url: comma separated kinds, errors or successes")
+
+// webhookNotifier posts the notifications as JSON, with their chat message line
+type webhookNotifier struct {
+	url string
+}
+
+type webhookNotification struct {
+	notification
+	Text string `json:"text"`
+}
+
+func (h webhookNotifier) name() string {
+	return "webhook"
+}
+
+func (h webhookNotifier) send(batch []notification) error {
+	notifications := make([]webhookNotification, 0, len(batch))
+	for _, n := range batch {
+		n.Message = redact(n.Message)
+		notifications = append(notifications, webhookNotification{notification: n, Text: n.text()})
+	}
+	return postJSON(h.url, map[string]interface{}{
+		"gitlab_url":    *gitlabURL,
+		"notifications": notifications,
+	})
+}
@@ -0,0 +1,360 @@
+package main
+
+/*
+OIDC login protects the dashboard and the admin endpoints for people, eg.
+against GitLab itself as the identity provider: the authorization code flow
+logs the user in, and the groups of the userinfo (the full paths of the GitLab
+groups the user is a member of) map to the roles:
+ - admin: all the admin endpoints
+ - viewer: reading them only (GET requests)
+
+The session is kept in a cookie signed with a key derived from the client
+secret, so it is valid on every replica. API clients keep using -admin-token.
+
+References:
+ - https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowAuth
+ - https://docs.gitlab.com/ee/integration/openid_connect_provider.html
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var oidcIssuer = flag.String("oidc-issuer", "", "OIDC issuer logging people in to the admin endpoints, eg. https://gitlab.example.com (disabled when empty)")
+var oidcClientID = flag.String("oidc-client-id", "", "OIDC client ID (the application ID of the GitLab application)")
+var oidcClientSecret = flag.String("oidc-client-secret", "", "OIDC client secret")
+var oidcRedirectURL = flag.String("oidc-redirect-url", "", "Address of /oauth/callback of the service, registered as the redirect URI of the client")
+var oidcAdminGroups = flag.String("oidc-admin-groups", "", "Comma separated groups whose members are admins")
+var oidcViewerGroups = flag.String("oidc-viewer-groups", "", "Comma separated groups whose members can view the admin endpoints")
+var oidcSessionTTL = flag.Duration("oidc-session-ttl", 8*time.Hour, "How long a login is valid")
+
+const (
+	roleAdmin  = "admin"
+	roleViewer = "viewer"
+)
+
+const (
+	oidcSessionCookie = "mr_trigger_session"
+	oidcStateCookie   = "mr_trigger_oauth_state"
+)
+
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// the discovery document of the issuer, fetched on the first login
+var oidcDiscovery = struct {
+	sync.Mutex
+	provider *oidcProvider
+}{}
+
+type oidcSession struct {
+	User    string `json:"user"`
+	Role    string `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+func oidcEnabled() bool {
+	return *oidcIssuer != ""
+}
+
+func validateOIDCFlags() error {
+	if !oidcEnabled() {
+		return nil
+	}
+	if *oidcClientID == "" || secretValue(oidcClientSecret) == "" || *oidcRedirectURL == "" {
+		return errors.New("-oidc-issuer requires -oidc-client-id, -oidc-client-secret and -oidc-redirect-url")
+	}
+	if *oidcAdminGroups == "" && *oidcViewerGroups == "" {
+		return errors.New("-oidc-issuer requires -oidc-admin-groups or -oidc-viewer-groups")
+	}
+	if _, err := url.Parse(*oidcRedirectURL); err != nil {
+		return errors.New("-oidc-redirect-url: " + err.Error())
+	}
+	return nil
+}
+
+func discoverOIDCProvider() (*oidcProvider, error) {
+	oidcDiscovery.Lock()
+	defer oidcDiscovery.Unlock()
+	if oidcDiscovery.provider != nil {
+		return oidcDiscovery.provider, nil
+	}
+
+	var provider oidcProvider
+	if err := oidcGetJSON(strings.TrimSuffix(*oidcIssuer, "/")+"/.well-known/openid-configuration", "", &provider); err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.UserinfoEndpoint == "" {
+		return nil, errors.New("incomplete discovery document of " + *oidcIssuer)
+	}
+	oidcDiscovery.provider = &provider
+	return &provider, nil
+}
+
+func oidcGetJSON(urlStr, accessToken string, data interface{}) error {
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", urlStr, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(data)
+}
+
+// oidcKey signs the cookies
+func oidcKey() []byte {
+	key := sha256.Sum256([]byte("gitlab-merge-request-trigger session:" + secretValue(oidcClientSecret)))
+	return key[:]
+}
+
+func signCookieValue(value []byte) string {
+	mac := hmac.New(sha256.New, oidcKey())
+	mac.Write(value)
+	return base64.RawURLEncoding.EncodeToString(value) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyCookieValue(cookie string) ([]byte, bool) {
+	i := strings.LastIndex(cookie, ".")
+	if i < 0 {
+		return nil, false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(cookie[:i])
+	if err != nil {
+		return nil, false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(cookie[i+1:])
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, oidcKey())
+	mac.Write(value)
+	return value, hmac.Equal(signature, mac.Sum(nil))
+}
+
+func setOIDCCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	redirect, _ := url.Parse(*oidcRedirectURL)
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   redirect != nil && redirect.Scheme == "https",
+	}
+	// http.Cookie of Go 1.9 has no SameSite; Lax keeps the cookie on the
+	// redirect back from the issuer, but not on cross-site POSTs
+	w.Header().Add("Set-Cookie", cookie.String()+"; SameSite=Lax")
+}
+
+// sameOrigin reports whether the request comes from a page of this service:
+// its Origin, or its Referer when the browser sent no Origin, is of the host
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(source)
+	return source != "" && err == nil && u.Host == r.Host
+}
+
+func sessionFromRequest(r *http.Request) *oidcSession {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	if err != nil {
+		return nil
+	}
+	value, ok := verifyCookieValue(cookie.Value)
+	if !ok {
+		return nil
+	}
+	var session oidcSession
+	if json.Unmarshal(value, &session) != nil || time.Now().Unix() > session.Expires {
+		return nil
+	}
+	return &session
+}
+
+// roleOfGroups returns the role of the member of the groups, if any
+func roleOfGroups(groups []string) string {
+	role := ""
+	for _, group := range groups {
+		if contains(splitList(*oidcAdminGroups), group) {
+			return roleAdmin
+		}
+		if contains(splitList(*oidcViewerGroups), group) {
+			role = roleViewer
+		}
+	}
+	return role
+}
+
+// oidcAuthorize serves the request of a logged in user according to the
+// role, or redirects browsers to log in, and reports whether it handled the
+// request; API clients fall back to the other credentials.
+func oidcAuthorize(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) bool {
+	if session := sessionFromRequest(r); session != nil {
+		if r.Method != "GET" && r.Method != "HEAD" && !sameOrigin(r) {
+			httpError(w, r, "cross-origin requests are not allowed", http.StatusForbidden)
+		} else if session.Role == roleAdmin || session.Role == roleViewer && (r.Method == "GET" || r.Method == "HEAD") {
+			next(w, r)
+		} else {
+			httpError(w, r, "forbidden for the "+session.Role+" role of "+session.User, http.StatusForbidden)
+		}
+		return true
+	}
+	if r.Header.Get("Authorization") == "" && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/oauth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return true
+	}
+	return false
+}
+
+// handlerOAuthLogin redirects to the authorization endpoint of the issuer
+func handlerOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := discoverOIDCProvider()
+	if err != nil {
+		httpError(w, r, "error discovering the OIDC issuer: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/admin/dashboard"
+	}
+	state := newRequestID() + newRequestID()
+	setOIDCCookie(w, oidcStateCookie, signCookieValue([]byte(state+" "+next)), 10*time.Minute)
+
+	query := url.Values{
+		"client_id":     {*oidcClientID},
+		"redirect_uri":  {*oidcRedirectURL},
+		"response_type": {"code"},
+		"scope":         {"openid profile"},
+		"state":         {state},
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// handlerOAuthCallback exchanges the code for the userinfo, and logs the user
+// in with the role of their groups
+func handlerOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		httpError(w, r, "missing login state, log in again", http.StatusBadRequest)
+		return
+	}
+	value, ok := verifyCookieValue(cookie.Value)
+	parts := strings.SplitN(string(value), " ", 2)
+	if !ok || len(parts) != 2 || r.FormValue("state") != parts[0] {
+		httpError(w, r, "invalid login state, log in again", http.StatusBadRequest)
+		return
+	}
+	next := parts[1]
+	setOIDCCookie(w, oidcStateCookie, "", -time.Second)
+	if message := r.FormValue("error"); message != "" {
+		httpError(w, r, "login failed: "+message+" "+r.FormValue("error_description"), http.StatusForbidden)
+		return
+	}
+
+	provider, err := discoverOIDCProvider()
+	if err != nil {
+		httpError(w, r, "error discovering the OIDC issuer: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp, err := oidcClient.PostForm(provider.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.FormValue("code")},
+		"redirect_uri":  {*oidcRedirectURL},
+		"client_id":     {*oidcClientID},
+		"client_secret": {secretValue(oidcClientSecret)},
+	})
+	if err != nil {
+		httpError(w, r, "error exchanging the code: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &token) != nil || token.AccessToken == "" {
+		httpError(w, r, "error exchanging the code: "+resp.Status, http.StatusBadGateway)
+		return
+	}
+
+	var userinfo struct {
+		Subject           string   `json:"sub"`
+		PreferredUsername string   `json:"preferred_username"`
+		Nickname          string   `json:"nickname"`
+		Groups            []string `json:"groups"`
+	}
+	if err := oidcGetJSON(provider.UserinfoEndpoint, token.AccessToken, &userinfo); err != nil {
+		httpError(w, r, "error getting the userinfo: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	user := userinfo.PreferredUsername
+	if user == "" {
+		user = userinfo.Nickname
+	}
+	if user == "" {
+		user = userinfo.Subject
+	}
+
+	role := roleOfGroups(userinfo.Groups)
+	if role == "" {
+		log.Println("[OIDC]", "denied login of", user, "- not a member of the admin or viewer groups")
+		httpError(w, r, user+" is not a member of the admin or viewer groups", http.StatusForbidden)
+		return
+	}
+	session, _ := json.Marshal(oidcSession{User: user, Role: role, Expires: time.Now().Add(*oidcSessionTTL).Unix()})
+	setOIDCCookie(w, oidcSessionCookie, signCookieValue(session), *oidcSessionTTL)
+	log.Println("[OIDC]", user, "logged in as", role, "from", clientIP(r))
+	publishEvent("login", map[string]interface{}{"user": user, "role": role, "ip": clientIP(r)})
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+func handlerOAuthLogout(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	setOIDCCookie(w, oidcSessionCookie, "", -time.Second)
+	if session := sessionFromRequest(r); session != nil {
+		log.Println("[OIDC]", session.User, "logged out")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("logged out - log in again on /oauth/login\n"))
+}
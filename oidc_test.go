@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOIDCSessionRejectsCrossOriginWrites(t *testing.T) {
+	value, _ := json.Marshal(oidcSession{User: "admin", Role: roleAdmin, Expires: time.Now().Add(time.Hour).Unix()})
+	session := &http.Cookie{Name: oidcSessionCookie, Value: signCookieValue(value)}
+
+	tests := []struct {
+		method, origin, referer string
+		code                    int
+	}{
+		{"GET", "", "", http.StatusOK},
+		{"POST", "", "", http.StatusForbidden},
+		{"POST", "https://evil.example", "", http.StatusForbidden},
+		{"POST", "null", "", http.StatusForbidden},
+		{"POST", "", "https://evil.example/admin", http.StatusForbidden},
+		{"POST", "https://mrt.example", "", http.StatusOK},
+		{"POST", "", "https://mrt.example/admin/overrides", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "https://mrt.example/admin/overrides", nil)
+		r.AddCookie(session)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.referer != "" {
+			r.Header.Set("Referer", test.referer)
+		}
+		w := httptest.NewRecorder()
+		oidcAuthorize(w, r, func(w http.ResponseWriter, r *http.Request) {})
+		if w.Code != test.code {
+			t.Errorf("%s with Origin %q and Referer %q: %d, expected %d", test.method, test.origin, test.referer, w.Code, test.code)
+		}
+	}
+}
+
+func TestOIDCCookieIsSameSite(t *testing.T) {
+	w := httptest.NewRecorder()
+	setOIDCCookie(w, oidcSessionCookie, "value", time.Hour)
+	if cookie := w.Header().Get("Set-Cookie"); !strings.Contains(cookie, "SameSite=Lax") {
+		t.Errorf("cookie %q, expected SameSite=Lax", cookie)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+/*
+Trigger decisions can be delegated to Open Policy Agent: the decision document
+is queried with the webhook payload and the MR details as input, and allows or
+denies the trigger, optionally with a reason and extra variables:
+
+    {"allow": true, "reason": "...", "variables": {"KEY": "value"}}
+
+A plain boolean decision is accepted too. With -opa-policy-file, the Rego
+policy is uploaded to the OPA server on start and reload.
+
+References:
+ - https://www.openpolicyagent.org/docs/latest/rest-api/#get-a-document-with-input
+ - https://www.openpolicyagent.org/docs/latest/rest-api/#create-or-update-a-policy
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+var opaURL = flag.String("opa-url", "", "URL of the Open Policy Agent decision document allowing triggers, eg. http://localhost:8181/v1/data/mrtrigger/decision (disabled when empty)")
+var opaPolicyFile = flag.String("opa-policy-file", "", "Rego policy uploaded to the OPA server of -opa-url on start and reload")
+var opaFailClosed = flag.Bool("opa-fail-closed", false, "Deny triggers when OPA can not be queried, instead of allowing them")
+
+// opaPolicyID is the ID of the uploaded policy on the OPA server
+const opaPolicyID = "gitlab-merge-request-trigger"
+
+// policyDecision is the decision of a policy, see also -filter-exec
+type policyDecision struct {
+	Allow     bool              `json:"allow"`
+	Reason    string            `json:"reason"`
+	Variables map[string]string `json:"variables"`
+}
+
+func (d *policyDecision) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &d.Allow); err == nil {
+		return nil
+	}
+	type decision policyDecision
+	return json.Unmarshal(data, (*decision)(d))
+}
+
+func validateOPAFlags() error {
+	if *opaPolicyFile != "" && *opaURL == "" {
+		return errors.New("-opa-policy-file requires -opa-url")
+	}
+	if *opaURL != "" {
+		if _, err := url.Parse(*opaURL); err != nil {
+			return errors.New("-opa-url: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func opaRequest(method, urlStr, bodyType string, body []byte, data interface{}) error {
+	req, err := http.NewRequest(method, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", bodyType)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s", resp.Status, message)
+	}
+	if data == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(data)
+}
+
+// uploadOPAPolicy creates or updates the policy on the OPA server
+func uploadOPAPolicy() error {
+	if *opaPolicyFile == "" {
+		return nil
+	}
+	policy, err := ioutil.ReadFile(*opaPolicyFile)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(*opaURL)
+	if err != nil {
+		return err
+	}
+	policyURL := fmt.Sprintf("%s://%s/v1/policies/%s", u.Scheme, u.Host, opaPolicyID)
+	return opaRequest("PUT", policyURL, "text/plain", policy, nil)
+}
+
+// policyInput is the input of the policy: the delivered webhook payload and
+// the details of the MR
+func policyInput(webhook webhookRequest, mr mergeRequest) map[string]interface{} {
+	var payload interface{} = webhook
+	if webhook.Payload != nil {
+		payload = webhook.Payload
+	}
+	return map[string]interface{}{
+		"webhook":       payload,
+		"merge_request": mr,
+		"profile":       webhook.Profile,
+	}
+}
+
+// queryPolicy asks OPA whether to trigger the pipeline of the MR
+func queryPolicy(ctx context.Context, webhook webhookRequest, mr mergeRequest) (decision policyDecision, err error) {
+	input, err := json.Marshal(map[string]interface{}{"input": policyInput(webhook, mr)})
+	if err != nil {
+		return
+	}
+
+	var response struct {
+		Result *policyDecision `json:"result"`
+	}
+	if err = opaRequest("POST", *opaURL, "application/json", input, &response); err != nil {
+		return
+	}
+	if response.Result == nil {
+		// the document is undefined, eg. the policy is not loaded
+		return decision, errors.New("undefined decision")
+	}
+	return *response.Result, nil
+}
+
+// policySkip returns the reason to skip the trigger when the policy denies it,
+// and adds the variables of the decision to the override otherwise
+func policySkip(ctx context.Context, webhook webhookRequest, mr mergeRequest, override *projectOverride) (string, int) {
+	if *opaURL == "" {
+		return "", 0
+	}
+
+	decision, err := queryPolicy(ctx, webhook, mr)
+	if err != nil {
+		logEvent(ctx, "[OPA] ERROR querying policy:", err)
+		if *opaFailClosed {
+			return "error querying policy - " + err.Error(), http.StatusServiceUnavailable
+		}
+		return "", 0
+	}
+	if !decision.Allow {
+		reason := "denied by policy"
+		if decision.Reason != "" {
+			reason += ": " + decision.Reason
+		}
+		logEvent(ctx, "[OPA]", reason)
+		return reason, http.StatusOK
+	}
+
+	applyPolicyVariables(ctx, override, decision.Variables)
+	return "", 0
+}
+
+// applyPolicyVariables adds the variables of the decision to the override
+func applyPolicyVariables(ctx context.Context, override *projectOverride, decided map[string]string) {
+	if len(decided) == 0 {
+		return
+	}
+	variables := make(map[string]string)
+	for name, value := range override.Variables {
+		variables[name] = value
+	}
+	for name, value := range decided {
+		if !variableNameRegexp.MatchString(name) {
+			logEvent(ctx, "[POLICY] ignored invalid variable name:", name)
+			continue
+		}
+		variables[name] = value
+	}
+	override.Variables = variables
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var overridesFile = flag.String("overrides-file", "overrides.json", "File where per-project overrides edited on /admin/overrides are persisted")
+var overridesAuditFile = flag.String("overrides-audit-file", "overrides-audit.log", "File where changes of per-project overrides are appended as JSON lines")
+
+// projectOverride changes the behaviour of the service for a single project
+type projectOverride struct {
+	Disabled               bool              `json:"disabled,omitempty"`
+	TriggerMerged          *bool             `json:"trigger_merged,omitempty"`
+	MergedSourceCleanup    *bool             `json:"merged_source_cleanup,omitempty"`
+	TargetBranches         []string          `json:"target_branches,omitempty"`
+	RemoveSourceExceptions []string          `json:"remove_source_exceptions,omitempty"`
+	RemoveSourceBranch     string            `json:"remove_source_branch,omitempty"`
+	RefStrategy            string            `json:"ref_strategy,omitempty"`
+	MergeTrains            string            `json:"merge_trains,omitempty"`
+	Notify                 *notifySink       `json:"notify,omitempty"`
+	Variables              map[string]string `json:"variables,omitempty"`
+	DedupTTL               string            `json:"dedup_ttl,omitempty"`
+	RetriggerStaleAfter    string            `json:"retrigger_stale_after,omitempty"`
+}
+
+type overrideAudit struct {
+	Time      time.Time        `json:"time"`
+	Remote    string           `json:"remote"`
+	ProjectID int64            `json:"project_id"`
+	Before    *projectOverride `json:"before"`
+	After     *projectOverride `json:"after"`
+}
+
+var overrides = struct {
+	sync.RWMutex
+	projects map[int64]projectOverride
+}{projects: make(map[int64]projectOverride)}
+
+var variableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func loadOverrides() error {
+	data, err := ioutil.ReadFile(*overridesFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	projects := make(map[int64]projectOverride)
+	if err := json.Unmarshal(data, &projects); err != nil {
+		return err
+	}
+	for projectID, override := range projects {
+		if err := override.validate(); err != nil {
+			return fmt.Errorf("project %d: %s", projectID, err)
+		}
+		if override.Notify != nil {
+			registerSecrets(override.Notify.URL)
+		}
+	}
+
+	overrides.Lock()
+	defer overrides.Unlock()
+	overrides.projects = projects
+	return nil
+}
+
+func projectOverrideFor(projectID int64) projectOverride {
+	overrides.RLock()
+	defer overrides.RUnlock()
+	return overrides.projects[projectID]
+}
+
+func (o projectOverride) validate() error {
+	for name := range o.Variables {
+		if !variableNameRegexp.MatchString(name) {
+			return errors.New("invalid variable name: " + name)
+		}
+	}
+	if err := validateBranchPatterns(o.RemoveSourceExceptions); err != nil {
+		return err
+	}
+	if o.RemoveSourceBranch != "" {
+		if err := validateRemoveSourcePolicy(o.RemoveSourceBranch); err != nil {
+			return err
+		}
+	}
+	if _, err := parseRefStrategy(o.RefStrategy); err != nil {
+		return err
+	}
+	if err := validateMergeTrains(o.MergeTrains); err != nil {
+		return err
+	}
+	if o.Notify != nil {
+		if err := o.Notify.validate(); err != nil {
+			return err
+		}
+	}
+	if o.RetriggerStaleAfter != "" {
+		if _, err := time.ParseDuration(o.RetriggerStaleAfter); err != nil {
+			return errors.New("invalid retrigger stale after: " + err.Error())
+		}
+	}
+	if o.DedupTTL != "" {
+		return validateDedupTTL(o.DedupTTL)
+	}
+	return nil
+}
+
+func (o projectOverride) isEmpty() bool {
+	return !o.Disabled && o.TriggerMerged == nil && o.MergedSourceCleanup == nil && len(o.TargetBranches) == 0 &&
+		len(o.RemoveSourceExceptions) == 0 && o.RemoveSourceBranch == "" && o.RefStrategy == "" && o.MergeTrains == "" && o.Notify == nil && len(o.Variables) == 0 && o.DedupTTL == "" &&
+		o.RetriggerStaleAfter == ""
+}
+
+// setProjectOverride persists the override of the project (removes it when
+// empty) and appends the change to the audit log.
+func setProjectOverride(projectID int64, override projectOverride, remote string) error {
+	if err := override.validate(); err != nil {
+		return err
+	}
+
+	if override.Notify != nil {
+		registerSecrets(override.Notify.URL)
+	}
+
+	overrides.Lock()
+	defer overrides.Unlock()
+
+	audit := overrideAudit{Time: time.Now(), Remote: remote, ProjectID: projectID}
+	if before, ok := overrides.projects[projectID]; ok {
+		audit.Before = &before
+	}
+	if override.isEmpty() {
+		delete(overrides.projects, projectID)
+	} else {
+		overrides.projects[projectID] = override
+		audit.After = &override
+	}
+
+	data, err := json.MarshalIndent(overrides.projects, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*overridesFile, data, 0600); err != nil {
+		return err
+	}
+
+	line, _ := json.Marshal(audit)
+	f, err := os.OpenFile(*overridesAuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+
+	log.Println("[OVERRIDES]", "project:", projectID, "changed by:", remote)
+	return err
+}
+
+func splitList(value string) (list []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+func parseVariables(value string) (map[string]string, error) {
+	variables := make(map[string]string)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, errors.New("expected KEY=VALUE, but it was: " + line)
+		}
+		variables[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return variables, nil
+}
+
+func overrideFromForm(r *http.Request) (projectOverride, error) {
+	override := projectOverride{
+		Disabled:               r.FormValue("disabled") != "",
+		TargetBranches:         splitList(r.FormValue("target_branches")),
+		RemoveSourceExceptions: splitList(r.FormValue("remove_source_exceptions")),
+		RemoveSourceBranch:     r.FormValue("remove_source_branch"),
+		RefStrategy:            strings.TrimSpace(r.FormValue("ref_strategy")),
+		MergeTrains:            r.FormValue("merge_trains"),
+		DedupTTL:               strings.TrimSpace(r.FormValue("dedup_ttl")),
+		RetriggerStaleAfter:    strings.TrimSpace(r.FormValue("retrigger_stale_after")),
+	}
+	if url := strings.TrimSpace(r.FormValue("notify_url")); url != "" {
+		override.Notify = &notifySink{
+			Type:   r.FormValue("notify_type"),
+			URL:    url,
+			Events: strings.TrimSpace(r.FormValue("notify_events")),
+		}
+	}
+	switch r.FormValue("trigger_merged") {
+	case "true", "false":
+		value := r.FormValue("trigger_merged") == "true"
+		override.TriggerMerged = &value
+	}
+	switch r.FormValue("merged_source_cleanup") {
+	case "true", "false":
+		value := r.FormValue("merged_source_cleanup") == "true"
+		override.MergedSourceCleanup = &value
+	}
+
+	variables, err := parseVariables(r.FormValue("variables"))
+	if err != nil {
+		return override, err
+	}
+	if len(variables) > 0 {
+		override.Variables = variables
+	}
+	return override, override.validate()
+}
+
+type overrideRow struct {
+	ProjectID int64
+	projectOverride
+}
+
+func (row overrideRow) TriggerMergedValue() string {
+	if row.TriggerMerged == nil {
+		return ""
+	}
+	return strconv.FormatBool(*row.TriggerMerged)
+}
+
+func (row overrideRow) MergedSourceCleanupValue() string {
+	if row.MergedSourceCleanup == nil {
+		return ""
+	}
+	return strconv.FormatBool(*row.MergedSourceCleanup)
+}
+
+func (row overrideRow) NotifyType() string {
+	if row.Notify == nil {
+		return ""
+	}
+	return row.Notify.Type
+}
+
+func (row overrideRow) VariablesText() string {
+	var lines []string
+	for name, value := range row.Variables {
+		lines = append(lines, name+"="+value)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+var overridesTemplate = template.Must(template.New("overrides").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Per-project overrides</title></head>
+<body>
+<h1>Per-project overrides</h1>
+{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+<table border="1" cellpadding="4">
+<tr><th>Project ID</th><th>Disabled</th><th>Trigger merged</th><th>Source cleanup of merged</th><th>Target branches</th><th>Remove source exceptions</th><th>Remove source branch</th><th>Ref strategy</th><th>Merge trains</th><th>Notifications (type, URL, events)</th><th>Variables (KEY=VALUE per line)</th><th>Dedup window</th><th>Re-trigger stale after</th><th></th></tr>
+{{range .Rows}}
+<tr><form method="POST">
+<td><input type="hidden" name="project_id" value="{{.ProjectID}}">{{.ProjectID}}</td>
+<td><input type="checkbox" name="disabled" {{if .Disabled}}checked{{end}}></td>
+<td><select name="trigger_merged">
+<option value="" {{if eq .TriggerMergedValue ""}}selected{{end}}>default</option>
+<option value="true" {{if eq .TriggerMergedValue "true"}}selected{{end}}>true</option>
+<option value="false" {{if eq .TriggerMergedValue "false"}}selected{{end}}>false</option>
+</select></td>
+<td><select name="merged_source_cleanup">
+<option value="" {{if eq .MergedSourceCleanupValue ""}}selected{{end}}>default</option>
+<option value="true" {{if eq .MergedSourceCleanupValue "true"}}selected{{end}}>true</option>
+<option value="false" {{if eq .MergedSourceCleanupValue "false"}}selected{{end}}>false</option>
+</select></td>
+<td><input name="target_branches" value="{{join .TargetBranches ","}}"></td>
+<td><input name="remove_source_exceptions" value="{{join .RemoveSourceExceptions ","}}"></td>
+<td><select name="remove_source_branch">
+<option value="" {{if eq .RemoveSourceBranch ""}}selected{{end}}>default</option>
+<option value="always" {{if eq .RemoveSourceBranch "always"}}selected{{end}}>always</option>
+<option value="never" {{if eq .RemoveSourceBranch "never"}}selected{{end}}>never</option>
+<option value="only-non-protected" {{if eq .RemoveSourceBranch "only-non-protected"}}selected{{end}}>only-non-protected</option>
+</select></td>
+<td><input name="ref_strategy" value="{{.RefStrategy}}"></td>
+<td><select name="merge_trains">
+<option value="" {{if eq .MergeTrains ""}}selected{{end}}>default</option>
+<option value="skip" {{if eq .MergeTrains "skip"}}selected{{end}}>skip</option>
+<option value="merge-ref" {{if eq .MergeTrains "merge-ref"}}selected{{end}}>merge-ref</option>
+</select></td>
+<td><select name="notify_type">
+<option value="slack" {{if eq .NotifyType "slack"}}selected{{end}}>slack</option>
+<option value="teams" {{if eq .NotifyType "teams"}}selected{{end}}>teams</option>
+<option value="webhook" {{if eq .NotifyType "webhook"}}selected{{end}}>webhook</option>
+</select>
+<input name="notify_url" value="{{if .Notify}}{{.Notify.URL}}{{end}}">
+<input name="notify_events" size="10" value="{{if .Notify}}{{.Notify.Events}}{{end}}"></td>
+<td><textarea name="variables" rows="3">{{.VariablesText}}</textarea></td>
+<td><input name="dedup_ttl" size="6" value="{{.DedupTTL}}"></td>
+<td><input name="retrigger_stale_after" size="6" value="{{.RetriggerStaleAfter}}"></td>
+<td><button type="submit">Save</button> <button type="submit" name="delete" value="1">Delete</button></td>
+</form></tr>
+{{end}}
+<tr><form method="POST">
+<td><input name="project_id" size="8" placeholder="new"></td>
+<td><input type="checkbox" name="disabled"></td>
+<td><select name="trigger_merged"><option value="">default</option><option value="true">true</option><option value="false">false</option></select></td>
+<td><select name="merged_source_cleanup"><option value="">default</option><option value="true">true</option><option value="false">false</option></select></td>
+<td><input name="target_branches"></td>
+<td><input name="remove_source_exceptions"></td>
+<td><select name="remove_source_branch"><option value="">default</option><option value="always">always</option><option value="never">never</option><option value="only-non-protected">only-non-protected</option></select></td>
+<td><input name="ref_strategy" placeholder="eg. merged=target"></td>
+<td><select name="merge_trains"><option value="">default</option><option value="skip">skip</option><option value="merge-ref">merge-ref</option></select></td>
+<td><select name="notify_type"><option value="slack">slack</option><option value="teams">teams</option><option value="webhook">webhook</option></select>
+<input name="notify_url" placeholder="URL"> <input name="notify_events" size="10" placeholder="errors"></td>
+<td><textarea name="variables" rows="3"></textarea></td>
+<td><input name="dedup_ttl" size="6" placeholder="eg. 72h"></td>
+<td><input name="retrigger_stale_after" size="6" placeholder="eg. 24h"></td>
+<td><button type="submit">Add</button></td>
+</form></tr>
+</table>
+</body>
+</html>
+`))
+
+func handlerAdminOverrides(w http.ResponseWriter, r *http.Request) {
+	var formError error
+	if r.Method == "POST" {
+		formError = saveOverrideForm(r)
+		if formError == nil {
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	overrides.RLock()
+	var rows []overrideRow
+	for projectID, override := range overrides.projects {
+		rows = append(rows, overrideRow{ProjectID: projectID, projectOverride: override})
+	}
+	overrides.RUnlock()
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ProjectID < rows[j].ProjectID })
+
+	data := map[string]interface{}{"Rows": rows, "Error": formError}
+	if err := overridesTemplate.Execute(w, data); err != nil {
+		log.Println("[OVERRIDES] ERROR rendering page:", err)
+	}
+}
+
+func saveOverrideForm(r *http.Request) error {
+	// the admin credentials of the browser are sent along with forms of any
+	// site, so the form must come from the page itself
+	if !sameOrigin(r) {
+		return errors.New("cross-origin requests are not allowed")
+	}
+
+	projectID, err := strconv.ParseInt(strings.TrimSpace(r.FormValue("project_id")), 10, 64)
+	if err != nil || projectID <= 0 {
+		return fmt.Errorf("invalid project ID: %q", r.FormValue("project_id"))
+	}
+
+	var override projectOverride
+	if r.FormValue("delete") == "" {
+		if override, err = overrideFromForm(r); err != nil {
+			return err
+		}
+	}
+	return setProjectOverride(projectID, override, clientIP(r).String())
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSaveOverrideFormRequiresSameOrigin(t *testing.T) {
+	form := url.Values{"project_id": {"abc"}}.Encode()
+	tests := []struct {
+		origin, referer string
+		crossOrigin     bool
+	}{
+		{"", "", true},
+		{"https://evil.example", "", true},
+		{"", "https://evil.example/admin/overrides", true},
+		{"https://mrt.example", "", false},
+		{"", "https://mrt.example/admin/overrides", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "https://mrt.example/admin/overrides", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.referer != "" {
+			r.Header.Set("Referer", test.referer)
+		}
+		// the invalid project ID fails the same-origin forms after the check
+		err := saveOverrideForm(r)
+		if crossOrigin := err != nil && strings.Contains(err.Error(), "cross-origin"); crossOrigin != test.crossOrigin {
+			t.Errorf("Origin %q and Referer %q: %v, expected cross-origin: %v", test.origin, test.referer, err, test.crossOrigin)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// listing more pages is most likely a loop
+const maxPages = 100
+
+var nextLinkRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// nextPageURL returns the URL of the next page of the listing, following the
+// Link header (used by keyset pagination) or the X-Next-Page header.
+func nextPageURL(pageURL string, link, nextPage string) string {
+	if m := nextLinkRegexp.FindStringSubmatch(link); m != nil {
+		return m[1]
+	}
+	if nextPage == "" {
+		return ""
+	}
+
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	query := u.Query()
+	query.Set("page", nextPage)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// getAllPages fetches all the pages of the listing into data, which has to be
+// a pointer to a slice. Listings of projectID 0 use the private token.
+func getAllPages(ctx context.Context, projectID int64, urlStr string, data interface{}) error {
+	separator := "?"
+	if strings.Contains(urlStr, "?") {
+		separator = "&"
+	}
+	pageURL := urlStr + separator + "per_page=100"
+
+	var items []json.RawMessage
+	for page := 0; pageURL != ""; page++ {
+		if page == maxPages {
+			return fmt.Errorf("listing has more than %d pages", maxPages)
+		}
+
+		var pageItems []json.RawMessage
+		if projectID == 0 {
+			resp, err := doJsonRequest(ctx, "GET", pageURL, "", nil, &pageItems)
+			if err != nil {
+				return err
+			}
+			pageURL = nextPageURL(pageURL, resp.Header.Get("Link"), resp.Header.Get("X-Next-Page"))
+		} else {
+			resp, err := doProjectRequest(ctx, projectID, "GET", pageURL, "", nil, &pageItems)
+			if err != nil {
+				return err
+			}
+			pageURL = nextPageURL(pageURL, resp.Header.Get("Link"), resp.Header.Get("X-Next-Page"))
+		}
+		items = append(items, pageItems...)
+	}
+
+	if items == nil {
+		items = []json.RawMessage{}
+	}
+	all, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(all, data)
+}
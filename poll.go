@@ -0,0 +1,102 @@
+package main
+
+/*
+Poll mode lists the open MRs updated since the previous poll and runs the
+same trigger logic for them, for GitLab instances which can not reach the
+service with webhooks.
+
+References:
+ - https://docs.gitlab.com/ee/api/merge_requests.html#list-project-merge-requests
+ - https://docs.gitlab.com/ee/api/merge_requests.html#list-group-merge-requests
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+var pollInterval = flag.Duration("poll-interval", 0, "Poll the open MRs of -poll-projects and -poll-groups at this interval instead of waiting for webhooks (disabled when 0)")
+var pollProjects = flag.String("poll-projects", "", "Comma separated IDs or paths of projects whose MRs to poll")
+var pollGroups = flag.String("poll-groups", "", "Comma separated IDs or paths of groups whose MRs to poll")
+
+func listUpdatedMergeRequests(ctx context.Context, scope, id string, updatedAfter time.Time) (mrs []mergeRequest, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/%s/%s/merge_requests?state=opened&scope=all&updated_after=%s",
+		*gitlabURL, scope, projectPathID(id), url.QueryEscape(updatedAfter.Format(time.RFC3339)))
+	err = getAllPages(ctx, 0, reqURL, &mrs)
+	return
+}
+
+type pollSource struct {
+	scope, id string
+}
+
+// pollSources returns the projects and groups to poll
+func pollSources() (sources []pollSource) {
+	for _, source := range []struct{ scope, list string }{{"projects", *pollProjects}, {"groups", *pollGroups}} {
+		for _, id := range splitList(source.list) {
+			sources = append(sources, pollSource{source.scope, id})
+		}
+	}
+	return
+}
+
+// pollOnce processes the open MRs of every source updated after its since,
+// which is advanced to next only when the source was listed: the MRs of a
+// failed listing are listed again by the next poll
+func pollOnce(since map[pollSource]time.Time, next time.Time) {
+	var mrs []mergeRequest
+	for _, source := range pollSources() {
+		updated, err := listUpdatedMergeRequests(context.Background(), source.scope, source.id, since[source])
+		if err != nil {
+			log.Println("[POLL] ERROR listing MRs of", source.scope, source.id, ":", err)
+			continue
+		}
+		since[source] = next
+		mrs = append(mrs, updated...)
+	}
+
+	for _, mr := range mrs {
+		ctx := withRequestID(eventContext(), newRequestID())
+		webhook, err := webhookFromMR(ctx, mr)
+		if err != nil {
+			logEvent(ctx, "[POLL] ERROR", fmt.Sprintf("%d!%d", mr.TargetProjectID, mr.IID), err)
+			continue
+		}
+
+		publishEvent("received", map[string]interface{}{
+			"request_id": requestID(ctx),
+			"project_id": webhook.Attributes.TargetProjectID,
+			"mr":         mrKey(webhook),
+			"action":     webhook.Attributes.Action,
+			"sha":        webhook.Attributes.LastCommit.ID,
+			"poll":       true,
+		})
+		message, code := processSerialized(ctx, webhook)
+		logEvent(ctx, "[POLL]", mrKey(webhook), code, ":", message)
+	}
+}
+
+func runPoll() {
+	log.Println("[POLL] polling MRs every", *pollInterval)
+	since := make(map[pollSource]time.Time)
+	for _, source := range pollSources() {
+		since[source] = time.Now().Add(-*pollInterval)
+	}
+	for range time.Tick(*pollInterval) {
+		// MRs updated while listing are listed again by the next poll, their
+		// already triggered pipelines are found then
+		next := time.Now()
+		if !isLeader() {
+			// the leader polls meanwhile
+			for source := range since {
+				since[source] = next
+			}
+			continue
+		}
+		pollOnce(since, next)
+	}
+}
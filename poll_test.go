@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollAdvancesOnlyTheListedSources(t *testing.T) {
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/projects/2/") {
+			http.Error(w, `{"message":"500 Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer gitlab.Close()
+	defer func(gitlab, token, projects, groups string) {
+		*gitlabURL, *privateToken, *pollProjects, *pollGroups = gitlab, token, projects, groups
+	}(*gitlabURL, *privateToken, *pollProjects, *pollGroups)
+	*gitlabURL, *privateToken, *pollProjects, *pollGroups = gitlab.URL, "private-token", "1,2", ""
+
+	previous, next := time.Now().Add(-time.Minute), time.Now()
+	since := map[pollSource]time.Time{{"projects", "1"}: previous, {"projects", "2"}: previous}
+	pollOnce(since, next)
+
+	if listed := since[pollSource{"projects", "1"}]; !listed.Equal(next) {
+		t.Errorf("since of the listed project %s, expected %s", listed, next)
+	}
+	if failed := since[pollSource{"projects", "2"}]; !failed.Equal(previous) {
+		t.Errorf("since of the failed project %s, expected %s", failed, previous)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"regexp"
+)
+
+var preflight = flag.Bool("preflight", false, "Simulate the pipeline with the CI lint API before triggering and skip it when no jobs would run")
+
+type lintJob struct {
+	Name  string `json:"name"`
+	Stage string `json:"stage"`
+}
+
+// triggerRulesRegexp matches the rules of a CI configuration depending on
+// the pipeline being triggered: only: [triggers] and the pipeline source
+var triggerRulesRegexp = regexp.MustCompile(`\btriggers\b|\$\{?CI_PIPELINE_SOURCE\b`)
+
+// dependsOnTrigger reports whether the jobs of the CI configuration may
+// depend on the pipeline being triggered or on its variables
+func dependsOnTrigger(yaml string, variables map[string]string) bool {
+	if triggerRulesRegexp.MatchString(yaml) {
+		return true
+	}
+	for name := range variables {
+		if regexp.MustCompile(`\$\{?` + regexp.QuoteMeta(name) + `\b`).MatchString(yaml) {
+			return true
+		}
+	}
+	return false
+}
+
+// preflightPipeline returns the reason to skip the trigger, if the pipeline
+// would be empty. The dry run of GitLab simulates a push pipeline without the
+// trigger variables, so when the configuration depends on them the trigger
+// is not skipped, only warned about.
+func preflightPipeline(ctx context.Context, webhook webhookRequest, variables map[string]string) (string, int) {
+	ref := pipelineRef(webhook)
+	config, err := getMergedCIConfig(ctx, pipelineProjectID(webhook), ref)
+	if err != nil {
+		logEvent(ctx, "[PREFLIGHT] ERROR linting CI configuration:", err)
+		return "", 0
+	}
+	if !config.Valid || len(config.Jobs) > 0 {
+		return "", 0
+	}
+	if dependsOnTrigger(config.MergedYAML, variables) {
+		logEvent(ctx, "[PREFLIGHT] WARNING no jobs of", ref, "would run in a push pipeline, but the rules depend on the trigger - triggering")
+		return "", 0
+	}
+	return "skipped - no jobs of the CI configuration would run for " + ref, http.StatusOK
+}
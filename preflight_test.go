@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestDependsOnTrigger(t *testing.T) {
+	variables := map[string]string{"CI_MERGE_REQUEST": "true", "MR_IID": "7"}
+	tests := []struct {
+		yaml    string
+		depends bool
+	}{
+		{"build:\n  script: make\n  only: [main]\n", false},
+		{"build:\n  script: make\n  only: [triggers]\n", true},
+		{"build:\n  script: make\n  only:\n    - triggers\n", true},
+		{"build:\n  rules:\n    - if: $CI_PIPELINE_SOURCE == \"trigger\"\n", true},
+		{"build:\n  rules:\n    - if: ${CI_PIPELINE_SOURCE} == \"trigger\"\n", true},
+		{"build:\n  rules:\n    - if: $CI_MERGE_REQUEST\n", true},
+		{"build:\n  rules:\n    - if: $MR_IID_OTHER\n", false},
+		{"build:\n  rules:\n    - if: $MR_IID == \"7\"\n", true},
+	}
+	for _, test := range tests {
+		if depends := dependsOnTrigger(test.yaml, variables); depends != test.depends {
+			t.Errorf("dependsOnTrigger(%q) = %v, expected %v", test.yaml, depends, test.depends)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+/*
+Profiles are named configurations served on /webhook/{name}.json, so one
+deployment can serve many teams with their own GitLab instance, token,
+webhook secret, filters and variables. A profile is bound to its projects:
+webhooks of other projects are rejected.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var profilesFile = flag.String("profiles-file", "", "JSON file of the named configuration profiles served on /webhook/{name}.json")
+
+type profile struct {
+	// GitLabURL is the instance of the profile, -url by default
+	GitLabURL     string   `json:"gitlab_url,omitempty"`
+	PrivateToken  string   `json:"private_token"`
+	WebhookSecret string   `json:"webhook_secret,omitempty"`
+	Projects      []string `json:"projects,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	// the filters and variables of the profile, per-project overrides are
+	// applied on top of them
+	projectOverride
+}
+
+var profiles = struct {
+	sync.RWMutex
+	byName map[string]profile
+}{byName: make(map[string]profile)}
+
+func (p profile) validate() error {
+	if p.PrivateToken == "" {
+		return errors.New("private_token is required")
+	}
+	if len(p.Projects) == 0 && len(p.Groups) == 0 {
+		return errors.New("bind the profile to projects or groups")
+	}
+	return p.projectOverride.validate()
+}
+
+func loadProfiles() error {
+	if *profilesFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(*profilesFile)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]profile)
+	if err := json.Unmarshal(data, &byName); err != nil {
+		return fmt.Errorf("%s: %s", *profilesFile, err)
+	}
+	for name, p := range byName {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profile %s: %s", name, err)
+		}
+		registerSecrets(p.PrivateToken, p.WebhookSecret)
+	}
+
+	profiles.Lock()
+	defer profiles.Unlock()
+	profiles.byName = byName
+	return nil
+}
+
+func profileByName(name string) (profile, bool) {
+	profiles.RLock()
+	defer profiles.RUnlock()
+	p, ok := profiles.byName[name]
+	return p, ok
+}
+
+// requestProfile returns the name of the profile of /webhook/{name}.json
+func requestProfile(r *http.Request) string {
+	if !strings.HasPrefix(r.URL.Path, "/webhook/") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/webhook/"), ".json")
+}
+
+// binds reports whether the target project of the webhook belongs to the profile
+func (p profile) binds(webhook webhookRequest) bool {
+	path := webhook.Attributes.Target.PathWithNamespace
+	for _, project := range p.Projects {
+		if project == fmt.Sprint(webhook.Attributes.TargetProjectID) || project == path {
+			return true
+		}
+	}
+	for _, group := range p.Groups {
+		if path != "" && strings.HasPrefix(path, strings.TrimSuffix(group, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type profileKey struct{}
+
+func withProfile(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, profileKey{}, name)
+}
+
+func profileFrom(ctx context.Context) (profile, bool) {
+	name, _ := ctx.Value(profileKey{}).(string)
+	if name == "" {
+		return profile{}, false
+	}
+	return profileByName(name)
+}
+
+// instanceURL returns the address of the GitLab instance the event belongs to
+func instanceURL(ctx context.Context) string {
+	if p, ok := profileFrom(ctx); ok && p.GitLabURL != "" {
+		return strings.TrimSuffix(p.GitLabURL, "/")
+	}
+	return *gitlabURL
+}
+
+// profileURL points the GitLab API URL to the instance of the profile
+func profileURL(ctx context.Context, urlStr string) string {
+	if instance := instanceURL(ctx); instance != *gitlabURL && strings.HasPrefix(urlStr, *gitlabURL) {
+		return instance + strings.TrimPrefix(urlStr, *gitlabURL)
+	}
+	return urlStr
+}
+
+// privateTokenFor returns the private token of the profile of the event, or
+// the configured one
+func privateTokenFor(ctx context.Context) string {
+	if p, ok := profileFrom(ctx); ok {
+		return p.PrivateToken
+	}
+	return secretValue(privateToken)
+}
+
+// projectKey qualifies the project ID with the profile of the event, as the
+// projects of different instances may have the same ID
+func projectKey(ctx context.Context, projectID int64) string {
+	if name, _ := ctx.Value(profileKey{}).(string); name != "" {
+		return fmt.Sprintf("%s/%d", name, projectID)
+	}
+	return fmt.Sprint(projectID)
+}
+
+// overrideFor returns the override of the project on top of the settings of
+// the profile of the event
+func overrideFor(ctx context.Context, projectID int64) projectOverride {
+	override := projectOverrideFor(projectID)
+	p, ok := profileFrom(ctx)
+	if !ok {
+		return override
+	}
+
+	merged := p.projectOverride
+	merged.Disabled = merged.Disabled || override.Disabled
+	if override.TriggerMerged != nil {
+		merged.TriggerMerged = override.TriggerMerged
+	}
+	if override.MergedSourceCleanup != nil {
+		merged.MergedSourceCleanup = override.MergedSourceCleanup
+	}
+	if len(override.TargetBranches) > 0 {
+		merged.TargetBranches = override.TargetBranches
+	}
+	if override.RemoveSourceBranch != "" {
+		merged.RemoveSourceBranch = override.RemoveSourceBranch
+	}
+	if override.MergeTrains != "" {
+		merged.MergeTrains = override.MergeTrains
+	}
+	if override.RefStrategy != "" {
+		// the rules of the project take precedence over the ones of the profile
+		merged.RefStrategy = merged.RefStrategy + "," + override.RefStrategy
+	}
+	merged.RemoveSourceExceptions = append(append([]string{}, merged.RemoveSourceExceptions...), override.RemoveSourceExceptions...)
+	if len(override.Variables) > 0 {
+		variables := make(map[string]string)
+		for name, value := range merged.Variables {
+			variables[name] = value
+		}
+		for name, value := range override.Variables {
+			variables[name] = value
+		}
+		merged.Variables = variables
+	}
+	if override.DedupTTL != "" {
+		merged.DedupTTL = override.DedupTTL
+	}
+	return merged
+}
@@ -0,0 +1,262 @@
+package main
+
+/*
+Least-privilege mode: instead of using the global private token for every
+project API call, the service creates a project access token per project
+(using the private token once), persists it and uses it for that project only.
+
+References:
+ - https://docs.gitlab.com/ee/api/project_access_tokens.html
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var useProjectAccessTokens = flag.Bool("project-access-tokens", false, "Use per-project access tokens managed by the service instead of --private-token for project API calls")
+var projectTokensFile = flag.String("project-tokens-file", "project-tokens.json", "File where managed project access tokens are persisted")
+var projectTokenTTL = flag.Duration("project-token-ttl", 30*24*time.Hour, "Lifetime of managed project access tokens")
+var projectTokenRotateBefore = flag.Duration("project-token-rotate-before", 7*24*time.Hour, "Rotate managed project access tokens when they expire within this duration")
+
+const (
+	developerAccess  = 30
+	maintainerAccess = 40
+)
+
+// api is the narrowest scope allowing the write calls of the service, eg.
+// triggering pipelines, commenting and cancelling jobs; read_api does not.
+var projectTokenScopes = []string{"api"}
+
+// projectTokenAccessLevel returns the narrowest role triggering the pipelines
+// of the project: Developer with -trigger-token, Maintainer otherwise, which
+// is required to list and create the pipeline triggers of the project.
+func projectTokenAccessLevel() int {
+	if secretValue(triggerToken) != "" {
+		return developerAccess
+	}
+	return maintainerAccess
+}
+
+type projectAccessToken struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at"`
+	Revoked   bool   `json:"revoked"`
+}
+
+// projectTokens guards the tokens and the file, the per-project locks the
+// API calls creating, rotating and revoking the token of a project, so the
+// projects don't wait for each other
+var projectTokens = struct {
+	sync.Mutex
+	tokens map[int64]projectAccessToken
+	locks  map[int64]*sync.Mutex
+}{tokens: make(map[int64]projectAccessToken), locks: make(map[int64]*sync.Mutex)}
+
+func projectTokenLock(projectID int64) *sync.Mutex {
+	projectTokens.Lock()
+	defer projectTokens.Unlock()
+
+	lock, ok := projectTokens.locks[projectID]
+	if !ok {
+		lock = &sync.Mutex{}
+		projectTokens.locks[projectID] = lock
+	}
+	return lock
+}
+
+func getProjectToken(projectID int64) (projectAccessToken, bool) {
+	projectTokens.Lock()
+	defer projectTokens.Unlock()
+
+	token, ok := projectTokens.tokens[projectID]
+	return token, ok
+}
+
+// setProjectToken stores the token of the project, or drops it when nil
+func setProjectToken(projectID int64, token *projectAccessToken) {
+	projectTokens.Lock()
+	defer projectTokens.Unlock()
+
+	if token == nil {
+		delete(projectTokens.tokens, projectID)
+	} else {
+		projectTokens.tokens[projectID] = *token
+	}
+	saveProjectTokensLocked()
+}
+
+func loadProjectTokens() error {
+	data, err := ioutil.ReadFile(*projectTokensFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	projectTokens.Lock()
+	defer projectTokens.Unlock()
+	return json.Unmarshal(data, &projectTokens.tokens)
+}
+
+func saveProjectTokensLocked() {
+	data, err := json.MarshalIndent(projectTokens.tokens, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(*projectTokensFile, data, 0600)
+	}
+	if err != nil {
+		log.Println("[PROJECT-TOKEN] ERROR saving", *projectTokensFile, ":", err)
+	}
+}
+
+func projectTokenExpiry() string {
+	return time.Now().Add(*projectTokenTTL).Format("2006-01-02")
+}
+
+func projectTokenExpiresSoon(token projectAccessToken) bool {
+	expiresAt, err := time.Parse("2006-01-02", token.ExpiresAt)
+	if err != nil {
+		return false
+	}
+	return time.Now().Add(*projectTokenRotateBefore).After(expiresAt)
+}
+
+func createProjectAccessToken(ctx context.Context, projectID int64) (token projectAccessToken, err error) {
+	jsonStr, _ := json.Marshal(map[string]interface{}{
+		"name":         "MR trigger (created automatically)",
+		"scopes":       projectTokenScopes,
+		"access_level": projectTokenAccessLevel(),
+		"expires_at":   projectTokenExpiry(),
+	})
+
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/access_tokens", *gitlabURL, projectID)
+	_, err = doJsonRequest(ctx, "POST", reqURL, "application/json", bytes.NewBuffer(jsonStr), &token)
+	return
+}
+
+func rotateProjectAccessToken(ctx context.Context, projectID int64, tokenID int) (token projectAccessToken, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/access_tokens/%d/rotate?expires_at=%s", *gitlabURL, projectID, tokenID, projectTokenExpiry())
+	_, err = doJsonRequest(ctx, "POST", reqURL, "", nil, &token)
+	return
+}
+
+func revokeProjectAccessToken(ctx context.Context, projectID int64, tokenID int) error {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/access_tokens/%d", *gitlabURL, projectID, tokenID)
+	resp, err := doJsonRequest(ctx, "DELETE", reqURL, "", nil, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// projectAPIToken returns the token to be used for API calls of the project,
+// creating or rotating the managed project access token when needed.
+func projectAPIToken(ctx context.Context, projectID int64) (string, error) {
+	if p, ok := profileFrom(ctx); ok {
+		return p.PrivateToken, nil
+	}
+	if token, _ := configuredAccessToken(projectID); token != "" {
+		return token, nil
+	}
+	if !*useProjectAccessTokens {
+		return secretValue(privateToken), nil
+	}
+
+	lock := projectTokenLock(projectID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	token, ok := getProjectToken(projectID)
+	registerSecrets(token.Token)
+	if ok && !token.Revoked && !projectTokenExpiresSoon(token) {
+		return token.Token, nil
+	}
+
+	if ok && !token.Revoked && gitlabSupports("project_token_rotation") {
+		rotated, err := rotateProjectAccessToken(ctx, projectID, token.ID)
+		if err == nil {
+			log.Println("[PROJECT-TOKEN]", "rotated - project:", projectID, "id:", token.ID, "->", rotated.ID)
+			registerSecrets(rotated.Token)
+			setProjectToken(projectID, &rotated)
+			return rotated.Token, nil
+		}
+		log.Println("[PROJECT-TOKEN] ERROR rotating token for project", projectID, ":", err)
+	}
+
+	created, err := createProjectAccessToken(ctx, projectID)
+	if err != nil {
+		return "", err
+	}
+	log.Println("[PROJECT-TOKEN]", "created - project:", projectID, "id:", created.ID, "expires:", created.ExpiresAt)
+	registerSecrets(created.Token)
+	setProjectToken(projectID, &created)
+	return created.Token, nil
+}
+
+// forgetProjectToken drops the managed token of the project, optionally
+// revoking it first (e.g. when the project was removed).
+func forgetProjectToken(ctx context.Context, projectID int64, revoke bool) {
+	lock := projectTokenLock(projectID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	token, ok := getProjectToken(projectID)
+	if !ok {
+		return
+	}
+	if revoke {
+		if err := revokeProjectAccessToken(ctx, projectID, token.ID); err != nil {
+			log.Println("[PROJECT-TOKEN] ERROR revoking token", token.ID, "of project", projectID, ":", err)
+		} else {
+			log.Println("[PROJECT-TOKEN]", "revoked - project:", projectID, "id:", token.ID)
+		}
+	}
+	setProjectToken(projectID, nil)
+}
+
+// projectRemoved reports whether the project is not found anymore, asked with
+// the private token: a 404 of a project call may be of a missing branch or MR
+func projectRemoved(ctx context.Context, projectID int64) bool {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d", *gitlabURL, projectID)
+	resp, _ := doJsonRequest(ctx, "GET", reqURL, "", nil, nil)
+	return resp != nil && resp.StatusCode == http.StatusNotFound
+}
+
+func doProjectRequest(ctx context.Context, projectID int64, method, urlStr string, bodyType string, body io.Reader, data interface{}) (resp *http.Response, err error) {
+	token, err := projectAPIToken(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err = doJsonRequestWithToken(ctx, token, method, urlStr, bodyType, body, data)
+	if configured, matchedBy := configuredAccessToken(projectID); configured != "" {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			log.Println("[ACCESS-TOKEN] ERROR token of", matchedBy, "was rejected, it may have expired")
+		}
+		return
+	}
+	if resp == nil || !*useProjectAccessTokens {
+		return
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		// expired or revoked outside of the service, create a new one next time
+		forgetProjectToken(ctx, projectID, false)
+	case resp.StatusCode == http.StatusNotFound && projectRemoved(ctx, projectID):
+		forgetProjectToken(ctx, projectID, true)
+	}
+	return
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProjectTokensAreCreatedPerProject(t *testing.T) {
+	var mu sync.Mutex
+	accessLevels := make(map[string]int)
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			AccessLevel int `json:"access_level"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		accessLevels[r.URL.Path] = body.AccessLevel
+		mu.Unlock()
+		if strings.Contains(r.URL.Path, "/projects/1/") {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Write([]byte(`{"id":1,"token":"project-token-0123456789","expires_at":"2099-01-01"}`))
+	}))
+	defer gitlab.Close()
+
+	file, _ := ioutil.TempFile("", "project-tokens")
+	file.Close()
+	defer os.Remove(file.Name())
+	defer func(gitlab, private, trigger, tokensFile string, use bool) {
+		*gitlabURL, *privateToken, *triggerToken, *projectTokensFile, *useProjectAccessTokens = gitlab, private, trigger, tokensFile, use
+	}(*gitlabURL, *privateToken, *triggerToken, *projectTokensFile, *useProjectAccessTokens)
+	*gitlabURL, *privateToken, *triggerToken, *projectTokensFile, *useProjectAccessTokens = gitlab.URL, "private-token", "trigger-token", file.Name(), true
+
+	done := make(chan struct{})
+	go func() {
+		projectAPIToken(context.Background(), 1)
+		close(done)
+	}()
+	defer func() {
+		<-done
+		projectTokens.tokens = make(map[int64]projectAccessToken)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := projectAPIToken(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > 300*time.Millisecond {
+		t.Errorf("the token of project 2 waited %s for project 1", waited)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if level := accessLevels["/api/v4/projects/2/access_tokens"]; level != developerAccess {
+		t.Errorf("access level %d with -trigger-token, expected Developer", level)
+	}
+}
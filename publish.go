@@ -0,0 +1,170 @@
+package main
+
+/*
+Outcome publishing sends a structured event for every processed webhook -
+triggered, skipped, deferred or failed - and for every cancelled build to a
+message bus, for downstream analytics and bots: a NATS subject (per event, eg.
+mr_trigger.outcomes.triggered), a Kafka topic (keyed by the MR, built with
+-tags kafka) or a Redis channel.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+)
+
+var publishNATSURL = flag.String("publish-nats-url", "", "NATS server to publish the outcomes of the webhooks to, eg. nats://localhost:4222 (disabled when empty)")
+var publishNATSSubject = flag.String("publish-nats-subject", "mr_trigger.outcomes", "NATS subject prefix of the outcomes, followed by the event, eg. mr_trigger.outcomes.triggered")
+var publishKafkaBrokers = flag.String("publish-kafka-brokers", "", "Comma separated Kafka brokers to publish the outcomes of the webhooks to (requires building with -tags kafka, disabled when empty)")
+var publishKafkaTopic = flag.String("publish-kafka-topic", "mr_trigger.outcomes", "Kafka topic of the outcomes")
+var publishRedisURL = flag.String("publish-redis-url", "", "Redis server to publish the outcomes of the webhooks to, eg. redis://:password@localhost:6379/0 (disabled when empty)")
+var publishRedisChannel = flag.String("publish-redis-channel", "mr_trigger.outcomes", "Redis channel of the outcomes")
+
+// outcomes waiting to be published, further ones are dropped
+const outcomeQueueSize = 1000
+
+type outcomeEvent struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"request_id,omitempty"`
+	ProjectID   int64     `json:"project_id"`
+	MR          string    `json:"mr"`
+	Action      string    `json:"action,omitempty"`
+	SHA         string    `json:"sha,omitempty"`
+	Code        int       `json:"code,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	PipelineID  int       `json:"pipeline_id,omitempty"`
+	PipelineURL string    `json:"pipeline_url,omitempty"`
+	BuildID     int       `json:"build_id,omitempty"`
+}
+
+var outcomes = make(chan outcomeEvent, outcomeQueueSize)
+
+var outcomesDroppedCounter = newCounter("outcomes_dropped_total", "Outcome events not published, by the reason")
+
+func publishingEnabled() bool {
+	return *publishNATSURL != "" || *publishKafkaBrokers != "" || *publishRedisURL != ""
+}
+
+func validatePublishFlags() error {
+	if *publishNATSURL != "" {
+		if err := validateNATSURL(*publishNATSURL); err != nil {
+			return errors.New("-publish-nats-url: " + err.Error())
+		}
+	}
+	if *publishKafkaBrokers != "" && !kafkaBuilt {
+		return errors.New("-publish-kafka-brokers: built without Kafka support, rebuild with -tags kafka")
+	}
+	if *publishRedisURL != "" {
+		if err := validateRedisURL(*publishRedisURL); err != nil {
+			return errors.New("-publish-redis-url: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// outcomeFromRecord returns the event of the finished record: failed records
+// are the ones of the "error" disposition
+func outcomeFromRecord(record eventRecord) outcomeEvent {
+	event := record.Disposition
+	if event == "error" {
+		event = "failed"
+	}
+	return outcomeEvent{
+		Event:       event,
+		Time:        time.Now(),
+		RequestID:   record.RequestID,
+		ProjectID:   record.ProjectID,
+		MR:          record.MR,
+		Action:      record.Action,
+		SHA:         record.SHA,
+		Code:        record.Code,
+		Reason:      redact(record.Reason),
+		PipelineID:  record.PipelineID,
+		PipelineURL: record.PipelineURL,
+	}
+}
+
+func publishOutcome(event outcomeEvent) {
+	if !publishingEnabled() {
+		return
+	}
+	select {
+	case outcomes <- event:
+	default:
+		outcomesDroppedCounter.inc(labels("reason", "queue_full"))
+		log.Println("[PUBLISH] dropped", event.Event, "event of", event.MR, "- too many queued")
+	}
+}
+
+func runOutcomePublishing() {
+	var nats natsPublisher
+	var redis *redisClient
+	if *publishRedisURL != "" {
+		redis = newRedisClient(*publishRedisURL)
+	}
+
+	for event := range outcomes {
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		if *publishNATSURL != "" {
+			if err := nats.publish(*publishNATSSubject+"."+event.Event, data); err != nil {
+				outcomesDroppedCounter.inc(labels("reason", "nats_error"))
+				log.Println("[PUBLISH] ERROR publishing to NATS:", err)
+			}
+		}
+		if *publishKafkaBrokers != "" {
+			if err := publishKafka([]byte(event.MR), data); err != nil {
+				outcomesDroppedCounter.inc(labels("reason", "kafka_error"))
+				log.Println("[PUBLISH] ERROR publishing to Kafka:", err)
+			}
+		}
+		if redis != nil {
+			if _, err := redis.do("PUBLISH", *publishRedisChannel, string(data)); err != nil {
+				outcomesDroppedCounter.inc(labels("reason", "redis_error"))
+				log.Println("[PUBLISH] ERROR publishing to Redis:", err)
+			}
+		}
+	}
+}
+
+// natsPublisher publishes on a connection which is redialed once broken
+type natsPublisher struct {
+	sync.Mutex
+	conn *natsConn
+}
+
+func (p *natsPublisher) publish(subject string, data []byte) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.conn == nil {
+		conn, err := dialNATS(*publishNATSURL)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+		go func() {
+			err := conn.answerPings()
+			log.Println("[PUBLISH] NATS connection closed:", err)
+			p.Lock()
+			if p.conn == conn {
+				p.conn = nil
+			}
+			p.Unlock()
+			conn.conn.Close()
+		}()
+	}
+	err := p.conn.send("PUB %s %d\r\n%s", subject, len(data), data)
+	if err != nil {
+		p.conn.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
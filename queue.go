@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var reorderWindow = flag.Duration("reorder-window", 0, "How long events are held to process the events of a project in the order of their timestamps, rather than in the order of arrival")
+
+// keyedQueue runs the jobs submitted with the same key one after another,
+// ordered by their timestamps, while jobs of different keys run concurrently.
+// A job is held for the delay, so that earlier jobs arriving late are run
+// before it.
+type keyedQueue struct {
+	sync.Mutex
+	delay   *time.Duration
+	workers map[string]*queueWorker
+}
+
+type queueWorker struct {
+	jobs []queuedJob
+}
+
+type queuedJob struct {
+	order  time.Time
+	queued time.Time
+	run    func()
+}
+
+// events older than the last processed event of the MR are skipped as stale
+var staleEventTTL = time.Hour
+var lastProcessedEvents = newTTLCache(&staleEventTTL)
+
+var eventQueue = newKeyedQueue(reorderWindow)
+
+func newKeyedQueue(delay *time.Duration) *keyedQueue {
+	return &keyedQueue{delay: delay, workers: make(map[string]*queueWorker)}
+}
+
+func (q *keyedQueue) submit(key string, order time.Time, job func()) {
+	q.Lock()
+	defer q.Unlock()
+
+	worker, ok := q.workers[key]
+	if !ok {
+		worker = &queueWorker{}
+		q.workers[key] = worker
+		go q.work(key, worker)
+	}
+	worker.jobs = append(worker.jobs, queuedJob{order: order, queued: time.Now(), run: job})
+}
+
+func (q *keyedQueue) work(key string, worker *queueWorker) {
+	for {
+		q.Lock()
+		if len(worker.jobs) == 0 {
+			delete(q.workers, key)
+			q.Unlock()
+			return
+		}
+
+		next := 0
+		for i, job := range worker.jobs {
+			if job.order.Before(worker.jobs[next].order) {
+				next = i
+			}
+		}
+		job := worker.jobs[next]
+		if wait := job.queued.Add(*q.delay).Sub(time.Now()); wait > 0 {
+			q.Unlock()
+			time.Sleep(wait)
+			continue
+		}
+		worker.jobs = append(worker.jobs[:next], worker.jobs[next+1:]...)
+		q.Unlock()
+
+		job.run()
+	}
+}
+
+// run submits the job and waits until it is done
+func (q *keyedQueue) run(key string, order time.Time, job func()) {
+	done := make(chan struct{})
+	q.submit(key, order, func() {
+		defer close(done)
+		job()
+	})
+	<-done
+}
+
+func eventTime(webhook webhookRequest) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05 MST", "2006-01-02 15:04:05 -0700"} {
+		if t, err := time.Parse(layout, webhook.Attributes.UpdatedAt); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+func lastProcessedEvent(mr string) (time.Time, bool) {
+	if coordinator != nil {
+		last, ok, err := sharedLastProcessedEvent(mr)
+		if err == nil {
+			return last, ok
+		}
+		coordinationFailed("last event", err)
+	}
+	if last, ok := lastProcessedEvents.get(mr); ok {
+		return last.(time.Time), true
+	}
+	return time.Time{}, false
+}
+
+func setLastProcessedEvent(mr string, t time.Time) {
+	if coordinator != nil {
+		if err := setSharedLastProcessedEvent(mr, t); err != nil {
+			coordinationFailed("last event", err)
+		}
+	}
+	lastProcessedEvents.set(mr, t)
+}
+
+// processSerialized processes the event after all the earlier events of the
+// same project were processed, holding the lock of the MR with -redis-url.
+func processSerialized(ctx context.Context, webhook webhookRequest) (message string, code int) {
+	record := processRecorded(ctx, webhook)
+	return record.Reason, record.Code
+}
+
+// processRecorded is processSerialized returning the record of the event
+func processRecorded(ctx context.Context, webhook webhookRequest) eventRecord {
+	var message string
+	var code int
+	ctx, record := startEventRecord(ctx, webhook)
+
+	order := eventTime(webhook)
+	eventQueue.run(fmt.Sprint(webhook.Attributes.TargetProjectID), order, func() {
+		unlock, err := lockMR(ctx, mrKey(webhook))
+		if err != nil {
+			message, code = err.Error(), http.StatusServiceUnavailable
+			return
+		}
+		defer unlock()
+
+		// replays are reprocessed on purpose, usually after newer events
+		if !webhook.Replay {
+			if last, ok := lastProcessedEvent(mrKey(webhook)); ok && order.Before(last) {
+				message, code = "stale event - a newer event of the MR was already processed", http.StatusOK
+				return
+			}
+			setLastProcessedEvent(mrKey(webhook), order)
+		}
+
+		message, code = processMergeRequest(ctx, webhook)
+		if *shadowMode {
+			recordShadowDecision(webhook, message, code)
+		}
+	})
+	finishEventRecord(record, message, code)
+
+	eventRecords.Lock()
+	defer eventRecords.Unlock()
+	return *record
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedQueueRunsTheEventsOfAProjectInOrder(t *testing.T) {
+	delay := 100 * time.Millisecond
+	queue := newKeyedQueue(&delay)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	now := time.Now()
+	// the later event arrives first, the earlier one within the window
+	for _, event := range []struct {
+		name string
+		at   time.Time
+	}{{"1!2 update", now.Add(time.Second)}, {"1!1 open", now}} {
+		event := event
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queue.run("1", event.at, func() {
+				mu.Lock()
+				order = append(order, event.name)
+				mu.Unlock()
+			})
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != "1!1 open" {
+		t.Errorf("processed %v, expected the events of the project in the order of their timestamps", order)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+/*
+Quiet hours hold the triggers in maintenance windows, eg. of GitLab or of the
+runners. A window is a cron expression of its start and its duration:
+
+    0 22 * * 1-5 8h; 0 6 * * 6 48h
+
+The expression is evaluated in -quiet-hours-timezone, see parseCron.
+
+Triggers of the windows are either skipped, explained in the comment of
+-comment-policy-skips, or queued (the last event of each MR) and processed
+once all the windows ended. The queue is kept in memory only: the triggers
+queued when the service restarts are lost, GitLab was answered already.
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var quietHours = flag.String("quiet-hours", "", "Windows in which triggers are held, separated by ;, each a cron expression of its start and its duration, eg. 0 22 * * 1-5 8h")
+var quietHoursTimezone = flag.String("quiet-hours-timezone", "Local", "Time zone of the -quiet-hours windows, eg. Europe/Budapest")
+var quietHoursAction = flag.String("quiet-hours-action", "queue", "What to do with triggers in -quiet-hours windows: queue them until the windows end, or skip them")
+
+// the windows are checked for their end this often
+const quietHoursCheckInterval = 30 * time.Second
+
+// windows can not be longer than this, to bound looking up their start
+const maxQuietWindow = 7 * 24 * time.Hour
+
+type quietWindow struct {
+	spec string
+	cronSchedule
+	duration time.Duration
+}
+
+var quietWindows []quietWindow
+var quietLocation = time.Local
+
+var heldTriggers = struct {
+	sync.Mutex
+	queue []webhookRequest
+}{}
+
+var quietHoursHeldGauge = newGauge("quiet_hours_held_triggers", "Triggers queued until the -quiet-hours windows end")
+var quietHoursCounter = newCounter("quiet_hours_triggers_total", "Triggers held in -quiet-hours windows, by action")
+
+func parseQuietWindow(spec string) (window quietWindow, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 6 {
+		return window, errors.New("expected a cron expression of 5 fields and a duration: " + spec)
+	}
+	window.spec = spec
+	if window.cronSchedule, err = parseCron(strings.Join(fields[:5], " ")); err != nil {
+		return window, fmt.Errorf("%s: %s", spec, err)
+	}
+	if window.duration, err = time.ParseDuration(fields[5]); err != nil {
+		return window, fmt.Errorf("%s: %s", spec, err)
+	}
+	if window.duration < time.Minute || window.duration > maxQuietWindow {
+		return window, fmt.Errorf("%s: the duration must be between %v and %v", spec, time.Minute, maxQuietWindow)
+	}
+	return window, nil
+}
+
+func validateQuietHours() error {
+	switch *quietHoursAction {
+	case "queue", "skip":
+	default:
+		return errors.New("invalid -quiet-hours-action: " + *quietHoursAction + ", expected queue or skip")
+	}
+	location, err := time.LoadLocation(*quietHoursTimezone)
+	if err != nil {
+		return errors.New("invalid -quiet-hours-timezone: " + err.Error())
+	}
+
+	var windows []quietWindow
+	for _, spec := range strings.Split(*quietHours, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		window, err := parseQuietWindow(spec)
+		if err != nil {
+			return errors.New("invalid -quiet-hours window: " + err.Error())
+		}
+		windows = append(windows, window)
+	}
+	quietWindows, quietLocation = windows, location
+	return nil
+}
+
+// activeUntil returns the end of the window if it is active at the time
+func (w quietWindow) activeUntil(t time.Time) (time.Time, bool) {
+	t = t.In(quietLocation)
+	for start := t.Truncate(time.Minute); t.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+		if w.matches(start) {
+			return start.Add(w.duration), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// activeQuietWindow returns the window active at the time, if any
+func activeQuietWindow(t time.Time) (quietWindow, time.Time, bool) {
+	for _, window := range quietWindows {
+		if end, ok := window.activeUntil(t); ok {
+			return window, end, true
+		}
+	}
+	return quietWindow{}, time.Time{}, false
+}
+
+// quietHoursSkip returns the reason of holding the trigger in a quiet window,
+// and queues the webhook (replacing older queued events of the same MR) with
+// the queue action.
+func quietHoursSkip(ctx context.Context, webhook webhookRequest) (string, int) {
+	window, end, ok := activeQuietWindow(time.Now())
+	if !ok {
+		return "", 0
+	}
+	quietHoursCounter.inc(labels("action", *quietHoursAction))
+	if *quietHoursAction == "skip" {
+		commentPolicySkip(ctx, webhook, "pipelines are not triggered in the quiet hours of "+window.spec+", until "+end.Format(time.RFC3339), "push again or retry the pipeline after the quiet hours")
+		return fmt.Sprintf("quiet hours until %s (%s) - skipping", end.Format(time.RFC3339), window.spec), http.StatusOK
+	}
+
+	heldTriggers.Lock()
+	defer heldTriggers.Unlock()
+
+	for i, queued := range heldTriggers.queue {
+		if mrKey(queued) == mrKey(webhook) {
+			heldTriggers.queue = append(heldTriggers.queue[:i], heldTriggers.queue[i+1:]...)
+			break
+		}
+	}
+	heldTriggers.queue = append(heldTriggers.queue, webhook)
+	quietHoursHeldGauge.set("", float64(len(heldTriggers.queue)))
+	logEvent(ctx, "[QUIET-HOURS] queued MR:", mrKey(webhook), "until", end.Format(time.RFC3339))
+	return fmt.Sprintf("queued - quiet hours until %s (%s)", end.Format(time.RFC3339), window.spec), http.StatusAccepted
+}
+
+// runQuietHours processes the queued triggers once the windows ended
+func runQuietHours() {
+	for range time.Tick(quietHoursCheckInterval) {
+		if _, _, ok := activeQuietWindow(time.Now()); ok {
+			continue
+		}
+
+		heldTriggers.Lock()
+		queue := heldTriggers.queue
+		heldTriggers.queue = nil
+		quietHoursHeldGauge.set("", 0)
+		heldTriggers.Unlock()
+
+		if len(queue) > 0 {
+			log.Println("[QUIET-HOURS] quiet hours ended, releasing", len(queue), "triggers")
+		}
+		for _, webhook := range queue {
+			go func(webhook webhookRequest) {
+				message, code := processSerialized(eventContext(), webhook)
+				log.Println("[QUIET-HOURS]", "released MR:", mrKey(webhook), code, ":", message)
+			}(webhook)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var rateLimit = flag.Float64("rate-limit", 0, "Maximum webhooks per second accepted in total (0 disables)")
+var rateLimitPerIP = flag.Float64("rate-limit-per-ip", 0, "Maximum webhooks per second accepted from a single source address (0 disables)")
+var rateLimitPerProject = flag.Float64("rate-limit-per-project", 0, "Maximum webhooks per second accepted for a single project (0 disables)")
+var rateLimitBurst = flag.Int("rate-limit-burst", 10, "Number of webhooks accepted in a burst above the rate limits")
+
+// limiter keeps a token bucket per key
+type limiter struct {
+	sync.Mutex
+	rate    *float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const maxLimiterBuckets = 10000
+
+var globalLimiter = newLimiter(rateLimit)
+var ipLimiter = newLimiter(rateLimitPerIP)
+var projectLimiter = newLimiter(rateLimitPerProject)
+
+func newLimiter(rate *float64) *limiter {
+	return &limiter{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *limiter) allow(key string) bool {
+	if *l.rate <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	burst := float64(*rateLimitBurst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxLimiterBuckets {
+			l.purge(now, burst)
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * *l.rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// purge drops the buckets which are refilled, they are equal to new ones
+func (l *limiter) purge(now time.Time, burst float64) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()**l.rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func rateLimited(w http.ResponseWriter, r *http.Request, scope string) {
+	w.Header().Set("Retry-After", "1")
+	httpError(w, r, "rate limit exceeded: "+scope, http.StatusTooManyRequests)
+}
+
+func withRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !globalLimiter.allow("") {
+			rateLimited(w, r, "global")
+			return
+		}
+		if ip := clientIP(r); !ipLimiter.allow(ip.String()) {
+			rateLimited(w, r, "source "+ip.String())
+			return
+		}
+		next(w, r)
+	}
+}
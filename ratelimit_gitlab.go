@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var gitlabRateLimitReserve = flag.Int("gitlab-rate-limit-reserve", 10, "Pause GitLab API calls until the rate limit resets when fewer requests than this remain")
+
+// retries of requests rejected with 429 Too Many Requests
+const maxRateLimitRetries = 3
+
+var gitlabRateLimit = struct {
+	sync.Mutex
+	remaining int
+	resetAt   time.Time
+}{remaining: -1}
+
+var rateLimitRemainingGauge = newGauge("gitlab_rate_limit_remaining", "Requests remaining in the current GitLab rate limit window")
+var rateLimitLimitGauge = newGauge("gitlab_rate_limit_limit", "Requests allowed in a GitLab rate limit window")
+var rateLimitedCounter = newCounter("gitlab_rate_limited_total", "GitLab API requests rejected with 429 Too Many Requests")
+var throttledCounter = newCounter("gitlab_throttled_seconds_total", "Time GitLab API calls were paused waiting for the rate limit to reset")
+
+// observeRateLimit records the rate limit state from the response headers
+func observeRateLimit(resp *http.Response) {
+	gitlabRateLimit.Lock()
+	defer gitlabRateLimit.Unlock()
+
+	if remaining, err := strconv.Atoi(resp.Header.Get("RateLimit-Remaining")); err == nil {
+		gitlabRateLimit.remaining = remaining
+		rateLimitRemainingGauge.set("", float64(remaining))
+	}
+	if limit, err := strconv.Atoi(resp.Header.Get("RateLimit-Limit")); err == nil {
+		rateLimitLimitGauge.set("", float64(limit))
+	}
+	if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		gitlabRateLimit.resetAt = time.Unix(reset, 0)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		rateLimitedCounter.inc("")
+		gitlabRateLimit.remaining = 0
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			gitlabRateLimit.resetAt = time.Now().Add(time.Duration(seconds) * time.Second)
+		} else if !gitlabRateLimit.resetAt.After(time.Now()) {
+			gitlabRateLimit.resetAt = time.Now().Add(time.Second)
+		}
+	}
+}
+
+// waitForRateLimit pauses while the rate limit is (nearly) exhausted
+func waitForRateLimit(ctx context.Context) error {
+	gitlabRateLimit.Lock()
+	var wait time.Duration
+	if gitlabRateLimit.remaining >= 0 && gitlabRateLimit.remaining <= *gitlabRateLimitReserve {
+		wait = gitlabRateLimit.resetAt.Sub(time.Now())
+	}
+	gitlabRateLimit.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	log.Println("[GITLAB] rate limit nearly exhausted, pausing for", wait)
+	throttledCounter.add("", wait.Seconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+/*
+Rebasing before triggering makes the pipeline run on a source branch which is
+up to date with the target branch. The rebase pushes a new commit, which is
+delivered as an update event and built then, so the event of the outdated
+commit is not built. The rebase is followed in the background, off the
+webhook and its call budget: when it fails, the outdated commit is built.
+
+References:
+ - https://docs.gitlab.com/ee/api/merge_requests.html#rebase-a-merge-request
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var rebaseBeforeTrigger = flag.Bool("rebase-before-trigger", false, "Rebase the source branch of MRs behind their target branch with the API before triggering")
+var rebaseTimeout = flag.Duration("rebase-timeout", time.Minute, "How long to wait for the rebase of -rebase-before-trigger to complete")
+
+const rebasePollInterval = time.Second
+
+type rebaseStatus struct {
+	SHA                  string `json:"sha"`
+	RebaseInProgress     bool   `json:"rebase_in_progress"`
+	MergeError           string `json:"merge_error"`
+	DivergedCommitsCount int    `json:"diverged_commits_count"`
+}
+
+func rebaseMergeRequest(ctx context.Context, projectID int64, mrIID int) (err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d/rebase", *gitlabURL, projectID, mrIID)
+	_, err = doProjectRequest(ctx, projectID, "PUT", reqURL, "", nil, nil)
+	return
+}
+
+func getRebaseStatus(ctx context.Context, projectID int64, mrIID int) (status rebaseStatus, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d?include_rebase_in_progress=true&include_diverged_commits_count=true",
+		*gitlabURL, projectID, mrIID)
+	_, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &status)
+	return
+}
+
+// rebaseSkip requests the rebase of the MR when it is behind its target
+// branch, and returns the reason to skip the trigger of the outdated commit,
+// if so. Failed rebases do not withhold the pipeline, see followRebase.
+func rebaseSkip(ctx context.Context, webhook webhookRequest) (string, int) {
+	if !*rebaseBeforeTrigger || webhook.SkipRebase {
+		return "", 0
+	}
+
+	projectID, mrIID := webhook.Attributes.TargetProjectID, webhook.Attributes.IID
+	status, err := getRebaseStatus(ctx, projectID, mrIID)
+	if err != nil {
+		logEvent(ctx, "[REBASE] ERROR checking MR:", err)
+		return "", 0
+	}
+	if status.DivergedCommitsCount == 0 && !status.RebaseInProgress {
+		return "", 0
+	}
+	if *shadowMode || dryRunning(ctx) {
+		logEvent(ctx, "[REBASE] would rebase MR:", mrIID, "behind by", status.DivergedCommitsCount, "commits")
+		return "", 0
+	}
+
+	if !status.RebaseInProgress {
+		if err := rebaseMergeRequest(ctx, projectID, mrIID); err != nil {
+			logEvent(ctx, "[REBASE] ERROR requesting rebase:", err)
+			return "", 0
+		}
+	}
+	go followRebase(withProfile(withRequestID(context.Background(), requestID(ctx)), webhook.Profile), webhook)
+	logEvent(ctx, "[REBASE] rebasing MR:", mrIID, "behind by", status.DivergedCommitsCount, "commits")
+	return "rebasing - the rebased commit will be built", http.StatusAccepted
+}
+
+// followRebase waits for the rebase of the MR to complete, and builds the
+// commit of the event when the rebase failed or did not change it
+func followRebase(ctx context.Context, webhook webhookRequest) {
+	projectID, mrIID := webhook.Attributes.TargetProjectID, webhook.Attributes.IID
+	deadline := time.Now().Add(*rebaseTimeout)
+	for {
+		time.Sleep(rebasePollInterval)
+		status, err := getRebaseStatus(ctx, projectID, mrIID)
+		if err != nil {
+			logEvent(ctx, "[REBASE] ERROR checking rebase:", err)
+			break
+		}
+		if status.RebaseInProgress && time.Now().Before(deadline) {
+			continue
+		}
+		if status.RebaseInProgress {
+			logEvent(ctx, "[REBASE] rebase did not complete in", *rebaseTimeout)
+		} else if status.MergeError != "" {
+			logEvent(ctx, "[REBASE] ERROR rebasing:", status.MergeError)
+		} else if status.SHA != webhook.Attributes.LastCommit.ID {
+			logEvent(ctx, "[REBASE] rebased MR:", mrIID, "commit:", webhook.Attributes.LastCommit.ID, "->", status.SHA)
+			return
+		}
+		break
+	}
+
+	webhook.SkipRebase = true
+	message, code := processSerialized(withCallBudget(ctx, *apiCallBudget), webhook)
+	logEvent(ctx, "[REBASE] building the commit without rebase:", code, ":", message)
+}
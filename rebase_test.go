@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRebaseIsFollowedOffTheWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	rebased := false
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == "PUT":
+			rebased = true
+			w.Write([]byte("{}"))
+		case rebased:
+			w.Write([]byte(`{"sha":"rebased","rebase_in_progress":false}`))
+		default:
+			w.Write([]byte(`{"sha":"outdated","diverged_commits_count":2}`))
+		}
+	}))
+	defer gitlab.Close()
+	defer func(gitlab, token string, rebase bool) {
+		*gitlabURL, *privateToken, *rebaseBeforeTrigger = gitlab, token, rebase
+	}(*gitlabURL, *privateToken, *rebaseBeforeTrigger)
+	*gitlabURL, *privateToken, *rebaseBeforeTrigger = gitlab.URL, "private-token", true
+
+	var webhook webhookRequest
+	webhook.Attributes.TargetProjectID = 1
+	webhook.Attributes.IID = 7
+	webhook.Attributes.LastCommit.ID = "outdated"
+
+	start := time.Now()
+	if _, code := rebaseSkip(context.Background(), webhook); code != http.StatusAccepted {
+		t.Fatalf("answered %d, expected 202", code)
+	}
+	if waited := time.Since(start); waited > rebasePollInterval/2 {
+		t.Errorf("the webhook waited %s for the rebase", waited)
+	}
+
+	// the follower sees the rebased commit, which is built by its own event
+	time.Sleep(rebasePollInterval + 500*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 3 || requests[2] != "GET /api/v4/projects/1/merge_requests/7" {
+		t.Errorf("requests %v, expected checking, requesting and following the rebase", requests)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// shorter values are not redacted, to not mangle unrelated text
+const minSecretLength = 8
+
+// secretPatterns match secrets whose values are not known in advance: token
+// query parameters (eg. of trigger URLs in errors) and GitLab tokens
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)((?:private_|access_)?token=)[^&\s"']+`),
+	regexp.MustCompile(`\bgl(?:pat|ptt|dt|rt|oas|cbt|ft|imt|agent|soat)-[0-9A-Za-z_\-]{20,}`),
+}
+
+var secretValues = struct {
+	sync.RWMutex
+	values map[string]bool
+}{values: make(map[string]bool)}
+
+// registerSecrets makes the values redacted from the logs and responses
+func registerSecrets(values ...string) {
+	secretValues.Lock()
+	defer secretValues.Unlock()
+
+	for _, value := range values {
+		if len(value) >= minSecretLength {
+			secretValues.values[value] = true
+		}
+	}
+}
+
+func redact(s string) string {
+	secretValues.RLock()
+	for value := range secretValues.values {
+		s = strings.Replace(s, value, redacted, -1)
+	}
+	secretValues.RUnlock()
+
+	s = secretPatterns[0].ReplaceAllString(s, "${1}"+redacted)
+	return secretPatterns[1].ReplaceAllString(s, redacted)
+}
+
+// redactingWriter scrubs secrets from the log lines
+type redactingWriter struct {
+	io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.Writer, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
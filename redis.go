@@ -0,0 +1,194 @@
+package main
+
+/*
+A minimal Redis client speaking RESP over a single connection, which is
+redialed when broken. Commands are serialized, which is plenty for the few
+commands per webhook of the service.
+
+References:
+ - https://redis.io/docs/latest/develop/reference/protocol-spec/
+*/
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisTimeout = 5 * time.Second
+
+// redisError is an error reply of the server, the connection stays usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisClient struct {
+	url string
+
+	sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisClient(rawURL string) *redisClient {
+	return &redisClient{url: rawURL}
+}
+
+func validateRedisURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return errors.New("expected a redis:// or rediss:// URL, but it was: " + rawURL)
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return errors.New("invalid database: " + db)
+		}
+	}
+	return nil
+}
+
+// dial connects to redis[s]://[[user]:password@]host[:port][/db]
+func (c *redisClient) dial() error {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	if u.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+
+	if u.User != nil {
+		args := []string{"AUTH", u.User.Username()}
+		if password, ok := u.User.Password(); ok {
+			args = []string{"AUTH", password}
+			if u.User.Username() != "" {
+				args = []string{"AUTH", u.User.Username(), password}
+			}
+		}
+		if _, err := c.roundTrip(args); err != nil {
+			c.close()
+			return err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		if _, err := c.roundTrip([]string{"SELECT", db}); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.reader = nil, nil
+	}
+}
+
+// do runs the command, returning its reply: a string, an int64, nil or a
+// []interface{} of them
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	// a connection broken while idle fails the first command only
+	for attempt := 1; ; attempt++ {
+		if c.conn == nil {
+			if err := c.dial(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := c.roundTrip(args)
+		if _, ok := err.(redisError); ok || err == nil {
+			return reply, err
+		}
+		c.close()
+		if attempt > 1 {
+			return nil, err
+		}
+	}
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	var command []byte
+	command = append(command, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		command = append(command, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := c.conn.Write(command); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("unexpected reply: " + line)
+}
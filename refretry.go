@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+)
+
+var refNotFoundRetry = flag.Duration("ref-not-found-retry", 0, "How long triggers of open MRs failing with \"Reference not found\" are retried with backoff, eg. when the webhook arrives before the ref is replicated (0 disables)")
+
+// the first retry is delayed by this, later ones twice as long as the previous
+const refRetryInitialDelay = 2 * time.Second
+
+type refRetryKey struct{}
+
+type refRetry struct {
+	started time.Time
+	delay   time.Duration
+	attempt int
+}
+
+// scheduleRefRetry processes the event again after a delay, when the ref of
+// its pipeline was not found and the retry window is not over yet. Merged MRs
+// are not retried, their source branch is expected to be removed.
+func scheduleRefRetry(ctx context.Context, webhook webhookRequest) (time.Duration, bool) {
+	if *refNotFoundRetry <= 0 || webhook.Attributes.State == "merged" || dryRunning(ctx) {
+		return 0, false
+	}
+
+	retry, ok := ctx.Value(refRetryKey{}).(refRetry)
+	if ok {
+		retry.delay *= 2
+	} else {
+		retry = refRetry{started: time.Now(), delay: refRetryInitialDelay}
+	}
+	retry.attempt++
+	if time.Since(retry.started)+retry.delay > *refNotFoundRetry {
+		logEvent(ctx, "[RETRY] giving up on ref", pipelineRef(webhook), "after", retry.attempt-1, "retries")
+		return 0, false
+	}
+
+	// the retry keeps the request ID of the event, so its log lines can be followed
+	retryCtx := context.WithValue(withRequestID(eventContext(), requestID(ctx)), refRetryKey{}, retry)
+	time.AfterFunc(retry.delay, func() {
+		message, code := processSerialized(retryCtx, webhook)
+		logEvent(retryCtx, "[RETRY] attempt:", retry.attempt, "ref:", pipelineRef(webhook), code, ":", message)
+	})
+	return retry.delay, true
+}
@@ -0,0 +1,117 @@
+package main
+
+/*
+Ref strategy picks the ref the pipeline runs for, per action or state of the
+MR: the source branch, the target branch, the merge ref of the MR (the result
+of merging it, kept up to date by GitLab as refs/merge-requests/:iid/merge)
+or the last commit of the MR.
+
+The trigger API only accepts branch and tag names, so the last commit is
+pinned rather than triggered: the pipeline runs for the source branch with
+the commit in MR_PIN_SHA, and is skipped once the branch moved past it (the
+newer commit is built by its own event).
+
+Rules are comma separated "key=strategy" pairs, where the key is an action
+(eg. open, update, merge), a state (eg. opened, merged) or "default". The
+action takes precedence over the state.
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	refSource   = "source"
+	refTarget   = "target"
+	refMergeRef = "merge-ref"
+	refSHA      = "sha"
+)
+
+var refStrategy = flag.String("ref-strategy", "merged=target,default=source", "Ref the pipeline runs for per action or state of the MR, eg. merged=target,update=merge-ref,default=source (strategies: source, target, merge-ref, sha - the source branch pinned to the last commit)")
+
+func parseRefStrategy(value string) (map[string]string, error) {
+	rules := make(map[string]string)
+	for _, rule := range splitList(value) {
+		i := strings.Index(rule, "=")
+		if i < 0 {
+			return nil, errors.New("expected action=strategy, but it was: " + rule)
+		}
+		key, strategy := strings.TrimSpace(rule[:i]), strings.TrimSpace(rule[i+1:])
+		switch strategy {
+		case refSource, refTarget, refMergeRef, refSHA:
+		default:
+			return nil, fmt.Errorf("invalid ref strategy of %s: %s, expected source, target, merge-ref or sha", key, strategy)
+		}
+		rules[key] = strategy
+	}
+	return rules, nil
+}
+
+// refStrategyFor returns the strategy of the MR: the rules of the project
+// override the ones of -ref-strategy
+func refStrategyFor(webhook webhookRequest) string {
+	if webhook.SourceCleanup {
+		return refSource
+	}
+	if webhook.RefStrategy != "" {
+		return webhook.RefStrategy
+	}
+
+	// both are validated on load
+	rules, _ := parseRefStrategy(*refStrategy)
+	ctx := withProfile(context.Background(), webhook.Profile)
+	projectRules, _ := parseRefStrategy(overrideFor(ctx, webhook.Attributes.TargetProjectID).RefStrategy)
+	for key, strategy := range projectRules {
+		rules[key] = strategy
+	}
+
+	for _, key := range []string{webhook.Attributes.Action, webhook.Attributes.State, "default"} {
+		if strategy, ok := rules[key]; ok && key != "" {
+			return strategy
+		}
+	}
+	return refSource
+}
+
+// pipelineRef returns the ref the pipeline of the MR runs for
+func pipelineRef(webhook webhookRequest) string {
+	switch refStrategyFor(webhook) {
+	case refTarget:
+		return webhook.Attributes.TargetBranch
+	case refMergeRef:
+		return fmt.Sprintf("refs/merge-requests/%d/merge", webhook.Attributes.IID)
+	}
+	return webhook.Attributes.SourceBranch
+}
+
+// pinnedCommitSkip returns why the pipeline of the MR is skipped when the sha
+// strategy pins its last commit, but the source branch moved past it, if so
+func pinnedCommitSkip(ctx context.Context, webhook webhookRequest) (string, int) {
+	if refStrategyFor(webhook) != refSHA {
+		return "", 0
+	}
+	branch, err := getBranch(ctx, webhook.Attributes.SourceProjectID, webhook.Attributes.SourceBranch)
+	if err != nil {
+		return "error getting the source branch of the pinned commit: " + err.Error(), http.StatusInternalServerError
+	}
+	if branch.Commit.ID != webhook.Attributes.LastCommit.ID {
+		return fmt.Sprintf("skipped - branch %s moved past the pinned commit %s", webhook.Attributes.SourceBranch, webhook.Attributes.LastCommit.ID), http.StatusOK
+	}
+	return "", 0
+}
+
+// pipelineProjectID returns the project where the pipeline runs: the target
+// project holds the target branch and the merge ref, the source project the
+// source branch and the last commit of the MR.
+func pipelineProjectID(webhook webhookRequest) int64 {
+	switch refStrategyFor(webhook) {
+	case refTarget, refMergeRef:
+		return webhook.Attributes.TargetProjectID
+	}
+	return webhook.Attributes.SourceProjectID
+}
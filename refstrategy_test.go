@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPinnedCommitTriggersOnTheSourceBranch(t *testing.T) {
+	head := "bbb"
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"feature","commit":{"id":"` + head + `"}}`))
+	}))
+	defer gitlab.Close()
+	defer func(gitlab, token string) { *gitlabURL, *privateToken = gitlab, token }(*gitlabURL, *privateToken)
+	*gitlabURL, *privateToken = gitlab.URL, "private-token"
+
+	var webhook webhookRequest
+	webhook.RefStrategy = refSHA
+	webhook.Attributes.SourceProjectID = 1
+	webhook.Attributes.SourceBranch = "feature"
+	webhook.Attributes.LastCommit.ID = "aaa"
+
+	if ref := pipelineRef(webhook); ref != "feature" {
+		t.Errorf("pipeline ref %s, expected the source branch", ref)
+	}
+	if pin := triggerVariables(webhook, mergeRequest{}, projectOverride{})["MR_PIN_SHA"]; pin != "aaa" {
+		t.Errorf("MR_PIN_SHA %q, expected the last commit", pin)
+	}
+	if message, _ := pinnedCommitSkip(context.Background(), webhook); message == "" {
+		t.Error("not skipped after the branch moved past the pinned commit")
+	}
+	head = "aaa"
+	if message, _ := pinnedCommitSkip(context.Background(), webhook); message != "" {
+		t.Errorf("skipped the head of the branch: %s", message)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// reloadConfig loads the files of the configuration again: per-project
+// overrides, access tokens, profiles, the OPA policy, secret files and the
+// secrets from Vault. Flags are not reloaded.
+func reloadConfig() error {
+	var failed []string
+	if err := loadOverrides(); err != nil {
+		failed = append(failed, "overrides: "+err.Error())
+	}
+	if err := loadAccessTokens(); err != nil {
+		failed = append(failed, "access tokens: "+err.Error())
+	}
+	if err := loadProfiles(); err != nil {
+		failed = append(failed, "profiles: "+err.Error())
+	}
+	if err := uploadOPAPolicy(); err != nil {
+		failed = append(failed, "OPA policy: "+err.Error())
+	}
+	if err := loadWasmPlugins(); err != nil {
+		failed = append(failed, "WebAssembly plugins: "+err.Error())
+	}
+	for _, s := range secretFiles {
+		if *s.path == "" {
+			continue
+		}
+		if _, err := s.reload(); err != nil {
+			failed = append(failed, "-"+s.name+"-file: "+err.Error())
+		}
+	}
+	if vaultEnabled() {
+		if err := loadVaultSecrets(); err != nil {
+			failed = append(failed, "vault: "+err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errorList(failed)
+	}
+	log.Println("[RELOAD]", "configuration reloaded")
+	return nil
+}
+
+type errorList []string
+
+func (e errorList) Error() string {
+	return strings.Join(e, "; ")
+}
+
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reloadConfig(); err != nil {
+			log.Println("[RELOAD] ERROR", err)
+		}
+	}
+}
+
+func handlerAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, "use POST to reload the configuration", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		httpError(w, r, "reload failed - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpError(w, r, "configuration reloaded", http.StatusOK)
+}
@@ -0,0 +1,70 @@
+package main
+
+/*
+Policy of setting remove_source_branch on just created MRs.
+
+References:
+ - https://docs.gitlab.com/ee/api/branches.html#get-single-repository-branch
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+)
+
+const (
+	removeSourceAlways           = "always"
+	removeSourceNever            = "never"
+	removeSourceOnlyNonProtected = "only-non-protected"
+)
+
+var removeSourceBranchPolicy = flag.String("remove-source-branch", removeSourceOnlyNonProtected, "When to set remove_source_branch on just created MRs: always, never or only-non-protected (skips protected source branches)")
+
+type branch struct {
+	Name      string `json:"name"`
+	Protected bool   `json:"protected"`
+	Commit    struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
+
+func validateRemoveSourcePolicy(policy string) error {
+	switch policy {
+	case removeSourceAlways, removeSourceNever, removeSourceOnlyNonProtected:
+		return nil
+	}
+	return errors.New("invalid remove_source_branch policy: " + policy + ", expected always, never or only-non-protected")
+}
+
+func getBranch(ctx context.Context, projectID int64, name string) (branch branch, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/repository/branches/%s", *gitlabURL, projectID, url.PathEscape(name))
+	_, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &branch)
+	return
+}
+
+// removeSourceBranchSkip returns why remove_source_branch is not to be set for
+// the source branch by the policy of the project, if so
+func removeSourceBranchSkip(ctx context.Context, projectID, sourceProjectID int64, sourceBranch string) string {
+	policy := *removeSourceBranchPolicy
+	if override := overrideFor(ctx, projectID); override.RemoveSourceBranch != "" {
+		policy = override.RemoveSourceBranch
+	}
+
+	switch policy {
+	case removeSourceNever:
+		return "the policy is never"
+	case removeSourceOnlyNonProtected:
+		branch, err := getBranch(ctx, sourceProjectID, sourceBranch)
+		if err != nil {
+			// a branch which can not be checked is kept
+			return "error checking the protection of the branch: " + err.Error()
+		}
+		if branch.Protected {
+			return "the branch is protected"
+		}
+	}
+	return ""
+}
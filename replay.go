@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var replayPayloads = flag.Int("replay-payloads", 0, "Number of raw payloads of recent webhooks kept to be reprocessed on /admin/replay/{event_id} (disabled when 0)")
+
+// replayStore keeps the raw payloads of the recent webhooks by their request ID
+var replayStore = struct {
+	sync.Mutex
+	payloads map[string]storedEvent
+	order    []string
+}{payloads: make(map[string]storedEvent)}
+
+type storedEvent struct {
+	profile string
+	payload []byte
+}
+
+func storePayload(eventID, profile string, payload []byte) {
+	if *replayPayloads <= 0 || eventID == "" {
+		return
+	}
+
+	replayStore.Lock()
+	defer replayStore.Unlock()
+
+	if _, ok := replayStore.payloads[eventID]; !ok {
+		replayStore.order = append(replayStore.order, eventID)
+	}
+	replayStore.payloads[eventID] = storedEvent{profile: profile, payload: append([]byte(nil), payload...)}
+	for len(replayStore.order) > *replayPayloads {
+		delete(replayStore.payloads, replayStore.order[0])
+		replayStore.order = replayStore.order[1:]
+	}
+}
+
+func storedPayload(eventID string) (storedEvent, bool) {
+	replayStore.Lock()
+	defer replayStore.Unlock()
+	stored, ok := replayStore.payloads[eventID]
+	return stored, ok
+}
+
+// handlerAdminReplay reprocesses the stored webhook, regardless of it being
+// a duplicate delivery or debounced, as a new event with its own request ID
+func handlerAdminReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, "we support POST method only, but it was:"+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	eventID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/replay/"), "/")
+	stored, ok := storedPayload(eventID)
+	if !ok {
+		httpError(w, r, "no stored payload of event: "+eventID, http.StatusNotFound)
+		return
+	}
+
+	var webhook webhookRequest
+	if err := json.Unmarshal(stored.payload, &webhook); err != nil {
+		httpError(w, r, "error decoding stored payload:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	normalizeWebhook(&webhook)
+	webhook.Profile = stored.profile
+	webhook.Payload = stored.payload
+	webhook.Replay = true
+
+	ctx := withRequestID(eventContext(), requestID(r.Context()))
+	logEvent(ctx, "[REPLAY] replaying event:", eventID, "MR:", mrKey(webhook), "requested by:", clientIP(r))
+
+	publishEvent("received", map[string]interface{}{
+		"request_id": requestID(ctx),
+		"project_id": webhook.Attributes.TargetProjectID,
+		"mr":         mrKey(webhook),
+		"action":     webhook.Attributes.Action,
+		"sha":        webhook.Attributes.LastCommit.ID,
+		"replay_of":  eventID,
+	})
+
+	message, code := processSerialized(ctx, webhook)
+	httpError(w, r, message, code)
+}
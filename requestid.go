@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type requestIDKey struct{}
+
+// incoming request IDs (eg. from a reverse proxy) are kept when they look sane
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+type accessLogRecord struct {
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	Remote     string  `json:"remote"`
+	Event      string  `json:"event,omitempty"`
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logEvent logs the line with the ID of the request it belongs to
+func logEvent(ctx context.Context, v ...interface{}) {
+	traceSimulation(ctx, v...)
+	if id := requestID(ctx); id != "" {
+		v = append(v, "request:", id)
+	}
+	log.Println(v...)
+}
+
+// withRequestLog assigns an ID to the request, returned in the X-Request-ID
+// header, and writes a JSON access log line once it is served
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRegexp.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(withRequestID(r.Context(), id)))
+
+		record, _ := json.Marshal(accessLogRecord{
+			RequestID:  id,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     recorder.status,
+			DurationMS: float64(time.Since(start).Nanoseconds()/1e3) / 1e3,
+			Remote:     r.RemoteAddr,
+			Event:      r.Header.Get("X-Gitlab-Event-UUID"),
+		})
+		log.Println("[ACCESS]", string(record))
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+/*
+The outcome of a webhook is answered as JSON, which shows up in the webhook log
+of GitLab and can be parsed by other tools:
+
+    {"decision": "triggered", "reason": "created pipeline id: 77", "code": 201,
+     "mr": "1!2", "pipeline_id": 77, "links": {"pipeline": "...", ...}}
+
+The decision is the disposition of the event (triggered, skipped, deferred or
+error). -response-format text answers with the plain-text message only.
+
+GitLab counts any response other than 2xx as a failure of the webhook, and
+disables the hook after repeated failures, so skipped events are answered with
+HTTP 200 and errors only with 4xx/5xx. -response-codes maps the decisions to
+other status codes, eg. error=200 never fails the webhook.
+*/
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var responseFormat = flag.String("response-format", "json", "Format of the responses to webhooks: json, or text for plain-text messages")
+var responseCodes = flag.String("response-codes", "", "Status codes of the responses to webhooks by decision, eg. skipped=200,deferred=200,error=200 (by default triggered is 201, skipped 200, deferred 202 and error the code of the error)")
+
+// responseCodeOf is the parsed -response-codes
+var responseCodeOf = map[string]int{}
+
+var decisions = []string{"triggered", "skipped", "deferred", "error"}
+
+type webhookResponse struct {
+	Decision        string            `json:"decision"`
+	Reason          string            `json:"reason"`
+	Code            int               `json:"code"`
+	RequestID       string            `json:"request_id,omitempty"`
+	ProjectID       int64             `json:"project_id,omitempty"`
+	MR              string            `json:"mr,omitempty"`
+	Action          string            `json:"action,omitempty"`
+	SHA             string            `json:"sha,omitempty"`
+	PipelineID      int               `json:"pipeline_id,omitempty"`
+	CancelledBuilds []int             `json:"cancelled_builds,omitempty"`
+	Links           map[string]string `json:"links,omitempty"`
+}
+
+func validateResponseFlags() error {
+	switch *responseFormat {
+	case "json", "text":
+	default:
+		return errors.New("invalid -response-format: " + *responseFormat + ", expected json or text")
+	}
+
+	codes := map[string]int{}
+	for _, mapping := range strings.Split(*responseCodes, ",") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+		parts := strings.SplitN(mapping, "=", 2)
+		decision := strings.TrimSpace(parts[0])
+		if !contains(decisions, decision) {
+			return fmt.Errorf("invalid decision in -response-codes: %q, expected one of %s", decision, strings.Join(decisions, ", "))
+		}
+		if len(parts) != 2 {
+			return fmt.Errorf("missing status code of %s in -response-codes", decision)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || code < 200 || code > 599 {
+			return fmt.Errorf("invalid status code of %s in -response-codes: %q", decision, parts[1])
+		}
+		codes[decision] = code
+	}
+	responseCodeOf = codes
+	return nil
+}
+
+// responseCode returns the status code answering the decision
+func responseCode(decision string, code int) int {
+	if mapped, ok := responseCodeOf[decision]; ok {
+		return mapped
+	}
+	return code
+}
+
+func mergeRequestURL(webhook webhookRequest) string {
+	if webhook.Attributes.URL != "" {
+		return webhook.Attributes.URL
+	}
+	if webhook.Attributes.Target.WebURL != "" {
+		return fmt.Sprintf("%s/-/merge_requests/%d", webhook.Attributes.Target.WebURL, webhook.Attributes.IID)
+	}
+	return ""
+}
+
+// respondWebhook answers the webhook with the outcome of the event, the
+// webhook is nil when the payload could not be decoded
+func respondWebhook(w http.ResponseWriter, r *http.Request, webhook *webhookRequest, record eventRecord) {
+	decision := record.Disposition
+	if decision == "" {
+		decision = disposition(record.Code, record.PipelineID)
+	}
+	code := responseCode(decision, record.Code)
+	if *responseFormat == "text" {
+		httpError(w, r, record.Reason, code)
+		return
+	}
+
+	response := webhookResponse{
+		Decision:        decision,
+		Reason:          record.Reason,
+		Code:            code,
+		RequestID:       requestID(r.Context()),
+		PipelineID:      record.PipelineID,
+		CancelledBuilds: record.Cancelled,
+		Links:           map[string]string{},
+	}
+	if webhook != nil {
+		response.ProjectID = webhook.Attributes.TargetProjectID
+		response.MR = mrKey(*webhook)
+		response.Action = webhook.Attributes.Action
+		response.SHA = webhook.Attributes.LastCommit.ID
+		if url := mergeRequestURL(*webhook); url != "" {
+			response.Links["merge_request"] = url
+		}
+	}
+	if record.PipelineURL != "" {
+		response.Links["pipeline"] = record.PipelineURL
+	}
+	if len(response.Links) == 0 {
+		response.Links = nil
+	}
+
+	logEvent(r.Context(), "[RESPONSE]", code, ":", redact(record.Reason))
+	writeJSON(w, code, response)
+}
+
+// webhookError answers the webhook which was not processed
+func webhookError(w http.ResponseWriter, r *http.Request, webhook *webhookRequest, message string, code int) {
+	respondWebhook(w, r, webhook, eventRecord{Reason: message, Code: code})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidateResponseCodes(t *testing.T) {
+	defer func(value string) { *responseCodes = value }(*responseCodes)
+	defer func() { responseCodeOf = map[string]int{} }()
+
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"", true},
+		{"skipped=202", true},
+		{" skipped = 202 , error=503", true},
+		{"skipped=202,", true},
+		{"ignored=202", false},
+		{"skipped", false},
+		{"skipped=", false},
+		{"skipped=abc", false},
+		{"skipped=199", false},
+		{"skipped=600", false},
+	}
+	for _, test := range tests {
+		*responseCodes = test.value
+		if err := validateResponseFlags(); (err == nil) != test.valid {
+			t.Errorf("-response-codes %q: error %v, expected valid: %v", test.value, err, test.valid)
+		}
+	}
+}
+
+func TestResponseCode(t *testing.T) {
+	defer func(value string) { *responseCodes = value }(*responseCodes)
+	defer func() { responseCodeOf = map[string]int{} }()
+
+	*responseCodes = "skipped=202,error=503"
+	if err := validateResponseFlags(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		decision string
+		code     int
+		expected int
+	}{
+		{"skipped", http.StatusOK, http.StatusAccepted},
+		{"error", http.StatusInternalServerError, http.StatusServiceUnavailable},
+		{"triggered", http.StatusCreated, http.StatusCreated},
+		{"deferred", http.StatusAccepted, http.StatusAccepted},
+	}
+	for _, test := range tests {
+		if code := responseCode(test.decision, test.code); code != test.expected {
+			t.Errorf("responseCode(%s, %d) = %d, expected %d", test.decision, test.code, code, test.expected)
+		}
+	}
+}
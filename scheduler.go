@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var maxPipelinesPerProject = flag.Int("max-pipelines-per-project", 0, "Maximum number of running pipelines triggered by the service per project, further triggers are queued (0 is unlimited)")
+var pipelinePollInterval = flag.Duration("pipeline-poll-interval", 30*time.Second, "How often the status of triggered pipelines is checked when -max-pipelines-per-project or -status-check-name is set")
+
+type projectSchedule struct {
+	reserved int
+	running  map[int]bool
+	queue    []webhookRequest
+}
+
+var schedules = struct {
+	sync.Mutex
+	projects map[int64]*projectSchedule
+}{projects: make(map[int64]*projectSchedule)}
+
+func pipelineFinished(status string) bool {
+	switch status {
+	case "success", "failed", "canceled", "skipped", "manual":
+		return true
+	}
+	return false
+}
+
+func getPipeline(ctx context.Context, projectID int64, pipelineID int) (pipeline pipeline, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines/%d", *gitlabURL, projectID, pipelineID)
+	_, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &pipeline)
+	return
+}
+
+func scheduleLocked(projectID int64) *projectSchedule {
+	schedule, ok := schedules.projects[projectID]
+	if !ok {
+		schedule = &projectSchedule{running: make(map[int]bool)}
+		schedules.projects[projectID] = schedule
+	}
+	return schedule
+}
+
+// acquirePipelineSlot reserves a slot for a new pipeline of the project, or
+// queues the webhook (replacing older queued events of the same MR) when the
+// limit is reached. It reports whether the slot was reserved.
+func acquirePipelineSlot(projectID int64, webhook webhookRequest) bool {
+	if *maxPipelinesPerProject <= 0 {
+		return true
+	}
+
+	schedules.Lock()
+	defer schedules.Unlock()
+
+	schedule := scheduleLocked(projectID)
+	free := schedule.reserved+len(schedule.running) < *maxPipelinesPerProject
+	if coordinator != nil {
+		shared, err := acquireSharedSlot(projectID)
+		if err == nil {
+			free = shared
+		} else {
+			coordinationFailed("pipeline slot", err)
+		}
+	}
+	if free {
+		schedule.reserved++
+		return true
+	}
+
+	for i, queued := range schedule.queue {
+		if mrKey(queued) == mrKey(webhook) {
+			schedule.queue = append(schedule.queue[:i], schedule.queue[i+1:]...)
+			break
+		}
+	}
+	schedule.queue = append(schedule.queue, webhook)
+	return false
+}
+
+// releasePipelineSlot turns the reservation into a running pipeline, or
+// frees it when the pipeline was not created (pipelineID is 0).
+func releasePipelineSlot(projectID int64, pipelineID int) {
+	if *maxPipelinesPerProject <= 0 {
+		return
+	}
+
+	schedules.Lock()
+	defer schedules.Unlock()
+
+	schedule := scheduleLocked(projectID)
+	schedule.reserved--
+	if pipelineID != 0 {
+		schedule.running[pipelineID] = true
+	}
+	if coordinator != nil {
+		if err := releaseSharedSlot(projectID, pipelineID); err != nil {
+			coordinationFailed("pipeline slot", err)
+		}
+	}
+}
+
+func runPipelineScheduler() {
+	for range time.Tick(*pipelinePollInterval) {
+		schedules.Lock()
+		running := make(map[int64][]int)
+		for projectID, schedule := range schedules.projects {
+			for pipelineID := range schedule.running {
+				running[projectID] = append(running[projectID], pipelineID)
+			}
+		}
+		schedules.Unlock()
+
+		// the pipelines of the other replicas are checked too, in case
+		// they went away
+		if coordinator != nil {
+			shared, err := sharedRunningPipelines()
+			if err != nil {
+				coordinationFailed("pipeline slot", err)
+			}
+			for projectID, pipelineIDs := range shared {
+				running[projectID] = mergePipelineIDs(running[projectID], pipelineIDs)
+			}
+		}
+
+		for projectID, pipelineIDs := range running {
+			for _, pipelineID := range pipelineIDs {
+				p, err := getPipeline(context.Background(), projectID, pipelineID)
+				if err != nil {
+					log.Println("[SCHEDULER] ERROR checking pipeline", pipelineID, "of project", projectID, ":", err)
+					continue
+				}
+				if pipelineFinished(p.Status) {
+					schedules.Lock()
+					if schedule, ok := schedules.projects[projectID]; ok {
+						delete(schedule.running, pipelineID)
+					}
+					schedules.Unlock()
+					if coordinator != nil {
+						if err := finishSharedPipeline(projectID, pipelineID); err != nil {
+							coordinationFailed("pipeline slot", err)
+						}
+					}
+				}
+			}
+		}
+
+		releaseQueuedTriggers()
+	}
+}
+
+func releaseQueuedTriggers() {
+	schedules.Lock()
+	defer schedules.Unlock()
+
+	for projectID, schedule := range schedules.projects {
+		free := *maxPipelinesPerProject - schedule.reserved - len(schedule.running)
+		if coordinator != nil && len(schedule.queue) > 0 {
+			if used, err := sharedPipelineSlots(projectID); err == nil {
+				free = *maxPipelinesPerProject - used
+			} else {
+				coordinationFailed("pipeline slot", err)
+			}
+		}
+		for ; free > 0 && len(schedule.queue) > 0; free-- {
+			webhook := schedule.queue[0]
+			schedule.queue = schedule.queue[1:]
+			go func() {
+				message, code := processSerialized(eventContext(), webhook)
+				log.Println("[SCHEDULER]", "released MR:", mrKey(webhook), code, ":", message)
+			}()
+		}
+		if schedule.reserved == 0 && len(schedule.running) == 0 && len(schedule.queue) == 0 {
+			delete(schedules.projects, projectID)
+		}
+	}
+}
+
+func mergePipelineIDs(ids, more []int) []int {
+	for _, id := range more {
+		found := false
+		for _, known := range ids {
+			found = found || known == id
+		}
+		if !found {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,142 @@
+package main
+
+/*
+Secrets can be read from files (eg. mounted Docker or Kubernetes secrets)
+instead of being passed in flags or environment variables: every secret flag
+has a -<name>-file counterpart. The files are re-read periodically, so rotated
+secrets are picked up without a restart.
+*/
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var secretFilesInterval = flag.Duration("secret-files-interval", 30*time.Second, "How often secret files are checked for changes (0 disables)")
+
+type secretFile struct {
+	name   string
+	value  *string
+	path   *string
+	loaded []byte
+}
+
+var secretFiles = []*secretFile{
+	newSecretFile("private-token", privateToken),
+	newSecretFile("token", triggerToken),
+	newSecretFile("admin-token", adminToken),
+	newSecretFile("admin-basic-auth", adminBasicAuth),
+	newSecretFile("metrics-token", metricsToken),
+	newSecretFile("metrics-basic-auth", metricsBasicAuth),
+	newSecretFile("oidc-client-secret", oidcClientSecret),
+	newSecretFile("webhook-secret", webhookSecret),
+	newSecretFile("vault-token", vaultToken),
+}
+
+// secrets guards the values of the secret flags, which change when their
+// files are re-read
+var secrets sync.RWMutex
+
+func newSecretFile(name string, value *string) *secretFile {
+	return &secretFile{
+		name:  name,
+		value: value,
+		path:  flag.String(name+"-file", "", "File to read -"+name+" from, instead of passing it directly"),
+	}
+}
+
+// secretValue returns the current value of the secret flag
+func secretValue(value *string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	return *value
+}
+
+// reload reads the secret from its file, and reports whether it changed
+func (s *secretFile) reload() (bool, error) {
+	data, err := ioutil.ReadFile(*s.path)
+	if err != nil {
+		return false, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return false, errors.New(*s.path + " is empty")
+	}
+
+	// compared and set under the lock, as the files are reloaded concurrently
+	// with the start of the watch
+	secrets.Lock()
+	defer secrets.Unlock()
+	if bytes.Equal(data, s.loaded) {
+		return false, nil
+	}
+	s.loaded = data
+	*s.value = string(data)
+	registerSecrets(*s.value)
+	return true, nil
+}
+
+// validWebhookSecret checks the secret token of the webhook, when configured
+func validWebhookSecret(r *http.Request) bool {
+	return validSecret(r, secretValue(webhookSecret))
+}
+
+func validSecret(r *http.Request, secret string) bool {
+	return secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+}
+
+func loadSecretFiles() error {
+	for _, s := range secretFiles {
+		if *s.path == "" {
+			continue
+		}
+		if secretValue(s.value) != "" {
+			return errors.New("specify either -" + s.name + " or -" + s.name + "-file")
+		}
+		if _, err := s.reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchSecretFiles picks up the changes of the secret files, and of the
+// -access-tokens-file
+func watchSecretFiles() {
+	var accessTokensData []byte
+	if *accessTokensFile != "" {
+		accessTokensData, _ = ioutil.ReadFile(*accessTokensFile)
+	}
+
+	for range time.Tick(*secretFilesInterval) {
+		for _, s := range secretFiles {
+			if *s.path == "" {
+				continue
+			}
+			if changed, err := s.reload(); err != nil {
+				log.Println("[SECRETS] ERROR reading", *s.path, ":", err)
+			} else if changed {
+				log.Println("[SECRETS]", "reloaded -"+s.name, "from", *s.path)
+			}
+		}
+
+		if *accessTokensFile == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(*accessTokensFile)
+		if err == nil && !bytes.Equal(data, accessTokensData) {
+			err = loadAccessTokens()
+			accessTokensData = data
+		}
+		if err != nil {
+			log.Println("[SECRETS] ERROR reloading", *accessTokensFile, ":", err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSecretFileReloadsOnce(t *testing.T) {
+	file, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("rotated-s3cr3t\n")
+	file.Close()
+
+	value, path := "", file.Name()
+	secret := &secretFile{name: "test", value: &value, path: &path}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	changes := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			changed, err := secret.reload()
+			if err != nil {
+				t.Error(err)
+			}
+			secretValue(&value)
+			mu.Lock()
+			defer mu.Unlock()
+			if changed {
+				changes++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if changes != 1 || secretValue(&value) != "rotated-s3cr3t" {
+		t.Errorf("%d changes to %q, expected one to the content of the file", changes, secretValue(&value))
+	}
+}
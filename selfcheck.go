@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+var selfCheck = flag.Bool("self-check", true, "Verify on startup that GitLab is reachable and the private token is valid and has the api scope")
+
+type gitlabUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	IsAdmin  bool   `json:"is_admin"`
+}
+
+type gitlabVersion struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision"`
+	// Enterprise is missing before GitLab 15.6
+	Enterprise *bool `json:"enterprise"`
+}
+
+type personalAccessToken struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Active bool     `json:"active"`
+}
+
+func getCurrentUser(ctx context.Context) (user gitlabUser, resp *http.Response, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/user", *gitlabURL)
+	resp, err = doJsonRequest(ctx, "GET", reqURL, "", nil, &user)
+	return
+}
+
+func getGitLabVersion(ctx context.Context) (version gitlabVersion, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/version", *gitlabURL)
+	_, err = doJsonRequest(ctx, "GET", reqURL, "", nil, &version)
+	return
+}
+
+func getPersonalAccessToken(ctx context.Context) (token personalAccessToken, resp *http.Response, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/personal_access_tokens/self", *gitlabURL)
+	resp, err = doJsonRequest(ctx, "GET", reqURL, "", nil, &token)
+	return
+}
+
+// runSelfCheck fails fast on an unreachable GitLab or an unusable private
+// token instead of on the first webhook.
+func runSelfCheck() error {
+	ctx := context.Background()
+
+	if secretValue(privateToken) == "" {
+		// only reachability can be checked with a trigger token
+		reqURL := fmt.Sprintf("%s/api/v4/version", *gitlabURL)
+		resp, err := doGitLabRequest(ctx, "", "GET", reqURL, "", nil, nil)
+		if resp == nil {
+			return fmt.Errorf("GitLab is not reachable at %s: %s", *gitlabURL, err)
+		}
+		return nil
+	}
+
+	user, resp, err := getCurrentUser(ctx)
+	if resp == nil {
+		return fmt.Errorf("GitLab is not reachable at %s: %s", *gitlabURL, err)
+	} else if err != nil {
+		return fmt.Errorf("private token is not valid: %s", err)
+	}
+
+	if *sudoAuthor && !user.IsAdmin {
+		return fmt.Errorf("-sudo-author requires an admin private token, but %s is not an admin", user.Username)
+	}
+
+	version, err := getGitLabVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("getting GitLab version: %s", err)
+	}
+	setGitLabVersion(version)
+
+	if gitlabSupports("token_self") {
+		if err := checkTokenScopes(ctx); err != nil {
+			return err
+		}
+	}
+
+	log.Println("[SELF-CHECK]", "GitLab:", version.Version, version.Revision, "user:", user.Username, "admin:", user.IsAdmin)
+	return nil
+}
+
+func checkTokenScopes(ctx context.Context) error {
+	token, resp, err := getPersonalAccessToken(ctx)
+	switch {
+	case err == nil && !contains(token.Scopes, "api"):
+		return fmt.Errorf("private token %q has scopes %v, but the api scope is required", token.Name, token.Scopes)
+	case err != nil && resp != nil && resp.StatusCode == http.StatusNotFound:
+		// not a personal access token
+		log.Println("[SELF-CHECK] scopes of the private token could not be checked")
+	case err != nil:
+		return fmt.Errorf("checking the private token: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var shadowMode = flag.Bool("shadow", false, "Run the decision logic without triggering or changing anything, and compare the decisions with pipelines created by another tool (see /admin/shadow)")
+var shadowGrace = flag.Duration("shadow-grace", 2*time.Minute, "How long to wait for the other tool to create a pipeline before comparing")
+
+const maxShadowRecords = 1000
+
+type shadowRecord struct {
+	Received           time.Time `json:"received"`
+	MR                 string    `json:"mr"`
+	Action             string    `json:"action"`
+	SHA                string    `json:"sha"`
+	Ref                string    `json:"ref"`
+	WouldTrigger       bool      `json:"would_trigger"`
+	Reason             string    `json:"reason"`
+	IncumbentPipelines []int     `json:"incumbent_pipelines"`
+	Verdict            string    `json:"verdict"`
+}
+
+var shadowRecords = struct {
+	sync.Mutex
+	records []*shadowRecord
+}{}
+
+func listCommitPipelines(ctx context.Context, projectID int64, sha, ref string, updatedAfter time.Time) (pipelines []pipeline, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines?sha=%s&ref=%s&updated_after=%s",
+		*gitlabURL, projectID, url.QueryEscape(sha), url.QueryEscape(ref), url.QueryEscape(updatedAfter.Format(time.RFC3339)))
+	_, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &pipelines)
+	return
+}
+
+// shadowIgnoresPipeline reports whether the pipeline of the commit is ignored
+// in shadow mode, being created after the event, likely by the incumbent tool
+// for the same event. The cached pipelines of commits are ignored likewise.
+func shadowIgnoresPipeline(webhook webhookRequest, p *pipeline) bool {
+	if !*shadowMode {
+		return false
+	}
+	created, err := time.Parse(time.RFC3339, p.CreatedAt)
+	return err == nil && !created.Before(eventTime(webhook))
+}
+
+// recordShadowDecision stores the decision about the event and compares it
+// with the pipelines of the incumbent tool once the grace period passed.
+func recordShadowDecision(webhook webhookRequest, message string, code int) {
+	record := &shadowRecord{
+		Received:     time.Now(),
+		MR:           mrKey(webhook),
+		Action:       webhook.Attributes.Action,
+		SHA:          webhook.Attributes.LastCommit.ID,
+		Ref:          pipelineRef(webhook),
+		WouldTrigger: code == http.StatusCreated,
+		Reason:       message,
+		Verdict:      "pending",
+	}
+
+	shadowRecords.Lock()
+	shadowRecords.records = append(shadowRecords.records, record)
+	if len(shadowRecords.records) > maxShadowRecords {
+		shadowRecords.records = shadowRecords.records[1:]
+	}
+	shadowRecords.Unlock()
+
+	if record.SHA == "" {
+		return
+	}
+
+	projectID := pipelineProjectID(webhook)
+	time.AfterFunc(*shadowGrace, func() {
+		// allow for clock skew between the service and GitLab
+		pipelines, err := listCommitPipelines(context.Background(), projectID, record.SHA, record.Ref, record.Received.Add(-time.Minute))
+		if err != nil {
+			log.Println("[SHADOW] ERROR listing pipelines of", record.SHA, ":", err)
+			return
+		}
+
+		shadowRecords.Lock()
+		defer shadowRecords.Unlock()
+
+		for _, p := range pipelines {
+			record.IncumbentPipelines = append(record.IncumbentPipelines, p.ID)
+		}
+		switch incumbent := len(pipelines) > 0; {
+		case incumbent == record.WouldTrigger:
+			record.Verdict = "match"
+		case record.WouldTrigger:
+			record.Verdict = "missing"
+		default:
+			record.Verdict = "extra"
+		}
+		if record.Verdict != "match" {
+			log.Println("[SHADOW]", "divergence:", record.Verdict, "MR:", record.MR, "commit:", record.SHA,
+				"would trigger:", record.WouldTrigger, "incumbent pipelines:", record.IncumbentPipelines, "reason:", record.Reason)
+		}
+	})
+}
+
+func handlerAdminShadow(w http.ResponseWriter, r *http.Request) {
+	shadowRecords.Lock()
+	defer shadowRecords.Unlock()
+
+	summary := map[string]int{}
+	divergences := []shadowRecord{}
+	records := []shadowRecord{}
+	for _, record := range shadowRecords.records {
+		summary[record.Verdict]++
+		if record.Verdict == "missing" || record.Verdict == "extra" {
+			divergences = append(divergences, *record)
+		}
+		records = append(records, *record)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"summary":     summary,
+		"divergences": divergences,
+		"records":     records,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+/*
+Simulation runs the decision logic for a webhook payload in dry-run mode and
+returns what the service would do, so configuration changes can be tested
+without side effects.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type simulatedPipeline struct {
+	ProjectID int64             `json:"project_id"`
+	Ref       string            `json:"ref"`
+	Variables map[string]string `json:"variables"`
+}
+
+type simulatedCancellation struct {
+	PipelineID int    `json:"pipeline_id"`
+	BuildID    int    `json:"build_id"`
+	Name       string `json:"name"`
+}
+
+type simulation struct {
+	sync.Mutex
+	Decision      string                  `json:"decision"`
+	Code          int                     `json:"code"`
+	WouldTrigger  bool                    `json:"would_trigger"`
+	Pipeline      *simulatedPipeline      `json:"pipeline,omitempty"`
+	Cancellations []simulatedCancellation `json:"cancellations"`
+	Trace         []string                `json:"trace"`
+}
+
+type simulationKey struct{}
+
+func withSimulation(ctx context.Context, sim *simulation) context.Context {
+	return context.WithValue(ctx, simulationKey{}, sim)
+}
+
+func simulationFrom(ctx context.Context) *simulation {
+	sim, _ := ctx.Value(simulationKey{}).(*simulation)
+	return sim
+}
+
+// traceSimulation adds the log line to the trace of the simulation
+func traceSimulation(ctx context.Context, v ...interface{}) {
+	if sim := simulationFrom(ctx); sim != nil {
+		sim.Lock()
+		sim.Trace = append(sim.Trace, redact(strings.TrimSuffix(fmt.Sprintln(v...), "\n")))
+		sim.Unlock()
+	}
+}
+
+// handlerSimulate processes the webhook payload of the request in dry-run
+// mode, bypassing the delivery deduplication, debouncing and queueing, and
+// returns the decision with its trace
+func handlerSimulate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, "we support POST method only, but it was:"+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var webhook webhookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, *maxBodySize)).Decode(&webhook); err != nil {
+		httpError(w, r, "error decoding json body of request:"+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	normalizeWebhook(&webhook)
+	if webhook.ObjectKind != "merge_request" {
+		httpError(w, r, "we support merge_request objects only, but it was:"+webhook.ObjectKind, http.StatusUnprocessableEntity)
+		return
+	}
+
+	sim := &simulation{Cancellations: []simulatedCancellation{}, Trace: []string{}}
+	ctx := withSimulation(withRequestID(eventContext(), requestID(r.Context())), sim)
+	message, code := processMergeRequest(ctx, webhook)
+
+	sim.Lock()
+	defer sim.Unlock()
+	sim.Decision, sim.Code = message, code
+	sim.WouldTrigger = sim.Pipeline != nil
+	writeJSON(w, http.StatusOK, sim)
+}
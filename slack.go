@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+var slackWebhookURL = flag.String("slack-webhook-url", "", "Slack incoming webhook URL notified about failed triggers, token errors and GitLab outages")
+var slackEvents = flag.String("slack-events", "errors", "Notifications routed to -slack-webhook-url: comma separated kinds, errors or successes")
+
+type slackNotifier struct {
+	url string
+}
+
+func (s slackNotifier) name() string {
+	return "slack"
+}
+
+func (s slackNotifier) send(batch []notification) error {
+	lines := make([]string, 0, len(batch))
+	for _, n := range batch {
+		lines = append(lines, n.text())
+	}
+	return postJSON(s.url, map[string]string{
+		"text": "MR trigger service on " + *gitlabURL + ":\n" + strings.Join(lines, "\n"),
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+/*
+Stale MRs are re-triggered on a schedule, eg. nightly, to validate them again
+against their moving target branches: the open MRs of -retrigger-stale-projects
+and -retrigger-stale-groups whose last pipeline is older than
+-retrigger-stale-after (or the retrigger_stale_after of the project override)
+get a new pipeline for their last commit.
+
+References:
+ - https://docs.gitlab.com/ee/api/merge_requests.html#list-project-merge-requests
+ - https://docs.gitlab.com/ee/api/pipelines.html#list-project-pipelines
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+var retriggerStaleSchedule = flag.String("retrigger-stale-schedule", "", "Cron expression of when stale open MRs are re-triggered, eg. 0 3 * * 1-5 (disabled when empty)")
+var retriggerStaleTimezone = flag.String("retrigger-stale-timezone", "Local", "Time zone of -retrigger-stale-schedule, eg. Europe/Budapest")
+var retriggerStaleAfter = flag.Duration("retrigger-stale-after", 7*24*time.Hour, "Open MRs whose last pipeline is older than this are re-triggered by -retrigger-stale-schedule, can be overridden per project (0 disables)")
+var retriggerStaleProjects = flag.String("retrigger-stale-projects", "", "Comma separated IDs or paths of projects whose stale MRs to re-trigger")
+var retriggerStaleGroups = flag.String("retrigger-stale-groups", "", "Comma separated IDs or paths of groups whose stale MRs to re-trigger")
+
+var staleSchedule cronSchedule
+var staleLocation = time.Local
+
+var staleRetriggersCounter = newCounter("stale_mr_retriggers_total", "Stale open MRs re-triggered, by project")
+
+func validateRetriggerStale() error {
+	if *retriggerStaleSchedule == "" {
+		return nil
+	}
+	schedule, err := parseCron(*retriggerStaleSchedule)
+	if err != nil {
+		return errors.New("invalid -retrigger-stale-schedule: " + err.Error())
+	}
+	location, err := time.LoadLocation(*retriggerStaleTimezone)
+	if err != nil {
+		return errors.New("invalid -retrigger-stale-timezone: " + err.Error())
+	}
+	if *retriggerStaleProjects == "" && *retriggerStaleGroups == "" {
+		return errors.New("-retrigger-stale-schedule requires -retrigger-stale-projects or -retrigger-stale-groups")
+	}
+	staleSchedule, staleLocation = schedule, location
+	return nil
+}
+
+// staleAfter returns how old the last pipeline of the MRs of the project may
+// get before they are re-triggered
+func staleAfter(projectID int64) time.Duration {
+	if after, err := time.ParseDuration(projectOverrideFor(projectID).RetriggerStaleAfter); err == nil {
+		return after
+	}
+	return *retriggerStaleAfter
+}
+
+func listOpenMergeRequests(ctx context.Context, scope, id string) (mrs []mergeRequest, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/%s/%s/merge_requests?state=opened&scope=all", *gitlabURL, scope, projectPathID(id))
+	err = getAllPages(ctx, 0, reqURL, &mrs)
+	return
+}
+
+// getLastPipeline returns the newest pipeline of the ref, if any
+func getLastPipeline(ctx context.Context, projectID int64, ref string) (*pipeline, error) {
+	var pipelines []pipeline
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines?ref=%s&order_by=id&sort=desc&per_page=1", *gitlabURL, projectID, url.QueryEscape(ref))
+	if _, err := doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &pipelines); err != nil {
+		return nil, err
+	}
+	if len(pipelines) == 0 {
+		return nil, nil
+	}
+	return &pipelines[0], nil
+}
+
+// retriggerStaleMR re-triggers the MR when its last pipeline is stale
+func retriggerStaleMR(ctx context.Context, mr mergeRequest) error {
+	after := staleAfter(mr.TargetProjectID)
+	if after <= 0 || mr.WorkInProgress || mr.Draft {
+		return nil
+	}
+
+	webhook, err := webhookFromMR(ctx, mr)
+	if err != nil {
+		return err
+	}
+	last, err := getLastPipeline(ctx, pipelineProjectID(webhook), pipelineRef(webhook))
+	if err != nil {
+		return fmt.Errorf("error getting the last pipeline: %s", err)
+	}
+	if last != nil {
+		created, err := time.Parse(time.RFC3339, last.CreatedAt)
+		if err != nil || time.Since(created) < after {
+			return nil
+		}
+	}
+
+	webhook.Retrigger = true
+	staleRetriggersCounter.inc(labels("project", fmt.Sprint(mr.TargetProjectID)))
+	message, code := processSerialized(ctx, webhook)
+	logEvent(ctx, "[STALE]", mrKey(webhook), code, ":", message)
+	return nil
+}
+
+func retriggerStaleMRs() {
+	var mrs []mergeRequest
+	for _, source := range []struct{ scope, list string }{{"projects", *retriggerStaleProjects}, {"groups", *retriggerStaleGroups}} {
+		for _, id := range splitList(source.list) {
+			open, err := listOpenMergeRequests(context.Background(), source.scope, id)
+			if err != nil {
+				log.Println("[STALE] ERROR listing MRs of", source.scope, id, ":", err)
+				continue
+			}
+			mrs = append(mrs, open...)
+		}
+	}
+
+	for _, mr := range mrs {
+		ctx := withRequestID(eventContext(), newRequestID())
+		if err := retriggerStaleMR(ctx, mr); err != nil {
+			logEvent(ctx, "[STALE] ERROR", fmt.Sprintf("%d!%d", mr.TargetProjectID, mr.IID), err)
+		}
+	}
+}
+
+// runStaleRetrigger re-triggers the stale MRs at the minutes of the schedule
+func runStaleRetrigger() {
+	log.Println("[STALE] re-triggering stale MRs at", *retriggerStaleSchedule)
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		if staleSchedule.matches(time.Now().In(staleLocation)) && isLeader() {
+			retriggerStaleMRs()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+/*
+External status checks (GitLab Ultimate) block merging until the service
+reports the check as passed. The service registers itself as a status check
+of the target projects and reports the outcome of the triggered pipeline, so
+the detached pipeline gates the MR like a merge request pipeline does.
+
+GitLab notifies the external URL of the check about MR changes, which is
+acknowledged on /status-check and otherwise ignored: the MR is handled on the
+webhook.
+
+References:
+ - https://docs.gitlab.com/ee/api/status_checks.html
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var statusCheckName = flag.String("status-check-name", "", "Name of the external status check registered in the target projects and reporting the outcome of the triggered pipelines (disabled when empty)")
+var statusCheckURL = flag.String("status-check-url", "", "External URL of the status check, the address of /status-check of the service, eg. https://trigger.example.com/status-check")
+var statusCheckTimeout = flag.Duration("status-check-timeout", 3*time.Hour, "How long triggered pipelines are followed to report their outcome to the status check")
+
+type statusCheck struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	ExternalURL string `json:"external_url"`
+}
+
+// statusCheckIDs caches the ID of the status check per project
+var statusCheckIDs = newTTLCache(triggerTokenCacheTTL)
+
+func validateStatusCheckFlags() error {
+	if *statusCheckName != "" && *statusCheckURL == "" {
+		return errors.New("-status-check-name requires -status-check-url")
+	}
+	return nil
+}
+
+func listStatusChecks(ctx context.Context, projectID int64) (checks []statusCheck, err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/external_status_checks", *gitlabURL, projectID)
+	err = getAllPages(ctx, projectID, reqURL, &checks)
+	return
+}
+
+func createStatusCheck(ctx context.Context, projectID int64) (check statusCheck, err error) {
+	jsonStr, _ := json.Marshal(map[string]string{"name": *statusCheckName, "external_url": *statusCheckURL})
+
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/external_status_checks", *gitlabURL, projectID)
+	_, err = doProjectRequest(ctx, projectID, "POST", reqURL, "application/json", bytes.NewBuffer(jsonStr), &check)
+	return
+}
+
+// ensureStatusCheck returns the ID of the status check of the project,
+// registering it when missing
+func ensureStatusCheck(ctx context.Context, projectID int64) (int, error) {
+	key := projectKey(ctx, projectID)
+	if id, ok := statusCheckIDs.get(key); ok {
+		return id.(int), nil
+	}
+
+	checks, err := listStatusChecks(ctx, projectID)
+	if err != nil {
+		return 0, err
+	}
+	for _, check := range checks {
+		if check.Name == *statusCheckName {
+			statusCheckIDs.set(key, check.ID)
+			return check.ID, nil
+		}
+	}
+
+	check, err := createStatusCheck(ctx, projectID)
+	if err != nil {
+		return 0, err
+	}
+	logEvent(ctx, "[STATUS-CHECK] registered status check", *statusCheckName, "id:", check.ID, "in project:", projectID)
+	statusCheckIDs.set(key, check.ID)
+	return check.ID, nil
+}
+
+func setStatusCheckResponse(ctx context.Context, projectID int64, mrIID int, checkID int, sha, status string) (err error) {
+	jsonStr, _ := json.Marshal(map[string]interface{}{"sha": sha, "external_status_check_id": checkID, "status": status})
+
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d/status_check_responses", *gitlabURL, projectID, mrIID)
+	_, err = doProjectRequest(ctx, projectID, "POST", reqURL, "application/json", bytes.NewBuffer(jsonStr), nil)
+	return
+}
+
+// reportStatusCheck follows the triggered pipeline and reports its outcome
+// to the status check of the MR: passed when it succeeded, failed otherwise.
+func reportStatusCheck(ctx context.Context, webhook webhookRequest, pipelineID int) {
+	projectID, mrIID := webhook.Attributes.TargetProjectID, webhook.Attributes.IID
+	checkID, err := ensureStatusCheck(ctx, projectID)
+	if err != nil {
+		logEvent(ctx, "[STATUS-CHECK] ERROR registering status check:", err)
+		return
+	}
+
+	deadline := time.Now().Add(*statusCheckTimeout)
+	for {
+		time.Sleep(*pipelinePollInterval)
+		p, err := getPipeline(ctx, pipelineProjectID(webhook), pipelineID)
+		if err != nil {
+			logEvent(ctx, "[STATUS-CHECK] ERROR checking pipeline", pipelineID, ":", err)
+		} else if pipelineFinished(p.Status) {
+			status := "failed"
+			if p.Status == "success" {
+				status = "passed"
+			}
+			if err := setStatusCheckResponse(ctx, projectID, mrIID, checkID, webhook.Attributes.LastCommit.ID, status); err != nil {
+				logEvent(ctx, "[STATUS-CHECK] ERROR reporting pipeline", pipelineID, ":", err)
+				return
+			}
+			logEvent(ctx, "[STATUS-CHECK] reported pipeline", pipelineID, "status:", p.Status, "as", status)
+			return
+		}
+		if time.Now().After(deadline) {
+			logEvent(ctx, "[STATUS-CHECK] pipeline", pipelineID, "did not finish in", *statusCheckTimeout)
+			return
+		}
+	}
+}
+
+// handlerStatusCheck acknowledges the notifications of GitLab to the external
+// URL of the status check
+func handlerStatusCheck(w http.ResponseWriter, r *http.Request) {
+	httpError(w, r, "ok", http.StatusOK)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// events buffered per subscriber, further ones are dropped for slow subscribers
+const streamBuffer = 100
+
+const streamKeepAlive = 30 * time.Second
+
+type streamEvent struct {
+	kind string
+	data []byte
+}
+
+var streamSubscribers = struct {
+	sync.Mutex
+	channels map[chan streamEvent]bool
+}{channels: make(map[chan streamEvent]bool)}
+
+// publishEvent records the event in the audit log and sends it to the
+// subscribers of /events/stream
+func publishEvent(kind string, data interface{}) {
+	writeAudit(kind, data)
+
+	streamSubscribers.Lock()
+	defer streamSubscribers.Unlock()
+
+	if len(streamSubscribers.channels) == 0 {
+		return
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	event := streamEvent{kind: kind, data: []byte(redact(string(encoded)))}
+	for ch := range streamSubscribers.channels {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func subscribe() chan streamEvent {
+	ch := make(chan streamEvent, streamBuffer)
+	streamSubscribers.Lock()
+	streamSubscribers.channels[ch] = true
+	streamSubscribers.Unlock()
+	return ch
+}
+
+func unsubscribe(ch chan streamEvent) {
+	streamSubscribers.Lock()
+	delete(streamSubscribers.channels, ch)
+	streamSubscribers.Unlock()
+}
+
+// handlerEventStream streams the activity as server-sent events: received
+// webhooks, their disposition (triggered, skipped, deferred, error) and
+// cancelled builds.
+func handlerEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := subscribe()
+	defer unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.kind, event.data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
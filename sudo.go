@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"flag"
+)
+
+var sudoAuthor = flag.Bool("sudo-author", false, "Create pipelines as the MR author with the Sudo header, so they are attributed to them (requires -create-pipelines and an admin --private-token)")
+
+type sudoKey struct{}
+
+// withSudo makes the GitLab API calls made with the context impersonate the
+// user, an empty username stops impersonating.
+func withSudo(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, sudoKey{}, username)
+}
+
+func sudoUser(ctx context.Context) string {
+	username, _ := ctx.Value(sudoKey{}).(string)
+	return username
+}
@@ -0,0 +1,192 @@
+package main
+
+/*
+When a target branch moves, the pipelines of the open MRs targeting it were run
+against its older state. With -retrigger-on-target-push, push events of the
+projects re-trigger the open MRs targeting the pushed branch, at most
+-retrigger-on-target-push-max of them (the recently updated ones first), and
+only the ones labelled -retrigger-on-target-push-label when it is set. The
+MRs are re-triggered one after another by a single worker, an MR queued by
+several pushes once.
+
+References:
+ - https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+ - https://docs.gitlab.com/ee/api/merge_requests.html#list-project-merge-requests
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var retriggerOnTargetPush = flag.Bool("retrigger-on-target-push", false, "Re-trigger the open MRs targeting a branch when it is pushed to, with push events delivered to the webhook")
+var retriggerOnTargetPushLabel = flag.String("retrigger-on-target-push-label", "", "Only MRs with this label are re-triggered by -retrigger-on-target-push (all of them when empty)")
+var retriggerOnTargetPushMax = flag.Int("retrigger-on-target-push-max", 10, "Maximum number of MRs re-triggered by a push of -retrigger-on-target-push, the recently updated ones first")
+
+type pushEvent struct {
+	ObjectKind string  `json:"object_kind"`
+	Ref        string  `json:"ref"`
+	After      string  `json:"after"`
+	ProjectID  int64   `json:"project_id"`
+	Project    project `json:"project"`
+}
+
+var targetPushRetriggersCounter = newCounter("target_push_retriggers_total", "MRs re-triggered by pushes to their target branch, by project")
+var targetPushQueueGauge = newGauge("target_push_queued_retriggers", "MRs waiting to be re-triggered by pushes to their target branch")
+
+type targetPushRetrigger struct {
+	mr          mergeRequest
+	profileName string
+	branch      string
+	requestID   string
+}
+
+// targetPushRetriggers are the MRs waiting to be re-triggered one after
+// another by a single worker, each MR at most once
+var targetPushRetriggers = struct {
+	sync.Mutex
+	queue   []targetPushRetrigger
+	pending map[string]bool
+	wake    chan struct{}
+}{pending: make(map[string]bool), wake: make(chan struct{}, 1)}
+
+func targetPushKey(profileName string, mr mergeRequest) string {
+	return fmt.Sprintf("%s/%d!%d", profileName, mr.TargetProjectID, mr.IID)
+}
+
+// queueTargetPushRetriggers queues the MRs which are not queued already, and
+// returns how many were queued
+func queueTargetPushRetriggers(retriggers []targetPushRetrigger) int {
+	targetPushRetriggers.Lock()
+	defer targetPushRetriggers.Unlock()
+
+	queued := 0
+	for _, retrigger := range retriggers {
+		key := targetPushKey(retrigger.profileName, retrigger.mr)
+		if targetPushRetriggers.pending[key] {
+			continue
+		}
+		targetPushRetriggers.pending[key] = true
+		targetPushRetriggers.queue = append(targetPushRetriggers.queue, retrigger)
+		queued++
+	}
+	targetPushQueueGauge.set("", float64(len(targetPushRetriggers.queue)))
+	select {
+	case targetPushRetriggers.wake <- struct{}{}:
+	default:
+	}
+	return queued
+}
+
+func nextTargetPushRetrigger() (targetPushRetrigger, bool) {
+	targetPushRetriggers.Lock()
+	defer targetPushRetriggers.Unlock()
+
+	if len(targetPushRetriggers.queue) == 0 {
+		return targetPushRetrigger{}, false
+	}
+	retrigger := targetPushRetriggers.queue[0]
+	targetPushRetriggers.queue = targetPushRetriggers.queue[1:]
+	delete(targetPushRetriggers.pending, targetPushKey(retrigger.profileName, retrigger.mr))
+	targetPushQueueGauge.set("", float64(len(targetPushRetriggers.queue)))
+	return retrigger, true
+}
+
+// runTargetPushRetriggers re-triggers the queued MRs one after another
+func runTargetPushRetriggers() {
+	for range targetPushRetriggers.wake {
+		for {
+			retrigger, ok := nextTargetPushRetrigger()
+			if !ok {
+				break
+			}
+			retriggerTargetPushMR(retrigger)
+		}
+	}
+}
+
+func retriggerTargetPushMR(retrigger targetPushRetrigger) {
+	mr := retrigger.mr
+	ctx := withRequestID(eventContext(), newRequestID())
+	ctx = withProfile(ctx, retrigger.profileName)
+	webhook, err := webhookFromMR(ctx, mr)
+	if err != nil {
+		logEvent(ctx, "[TARGET-PUSH] ERROR", fmt.Sprintf("%d!%d", mr.TargetProjectID, mr.IID), err)
+		return
+	}
+	webhook.Profile = retrigger.profileName
+	webhook.Retrigger = true
+	targetPushRetriggersCounter.inc(labels("project", fmt.Sprint(mr.TargetProjectID)))
+	message, code := processSerialized(ctx, webhook)
+	logEvent(ctx, "[TARGET-PUSH]", mrKey(webhook), "re-triggered by push of", retrigger.branch, "by request:", retrigger.requestID, code, ":", message)
+}
+
+// the after commit of pushes deleting the branch
+const deletedBranchSHA = "0000000000000000000000000000000000000000"
+
+func listMergeRequestsTargeting(ctx context.Context, projectID int64, branch string) (mrs []mergeRequest, err error) {
+	query := url.Values{}
+	query.Set("state", "opened")
+	query.Set("target_branch", branch)
+	query.Set("order_by", "updated_at")
+	query.Set("per_page", fmt.Sprint(*retriggerOnTargetPushMax))
+	if *retriggerOnTargetPushLabel != "" {
+		query.Set("labels", *retriggerOnTargetPushLabel)
+	}
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/merge_requests?%s", *gitlabURL, projectID, query.Encode())
+	_, err = doProjectRequest(ctx, projectID, "GET", reqURL, "", nil, &mrs)
+	return
+}
+
+// handleTargetPush queues the open MRs targeting the pushed branch to be
+// re-triggered in the background, and answers the push event
+func handleTargetPush(ctx context.Context, w http.ResponseWriter, r *http.Request, payload []byte, prof profile, profileName string) {
+	var push pushEvent
+	if err := json.Unmarshal(payload, &push); err != nil {
+		webhookError(w, r, nil, "error decoding push event:"+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if profileName != "" && !prof.binds(webhookRequest{Attributes: objectAttributes{TargetProjectID: push.ProjectID, Target: push.Project}}) {
+		webhookError(w, r, nil, fmt.Sprintf("project %d is not bound to profile %s", push.ProjectID, profileName), http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(push.Ref, "refs/heads/") || push.After == deletedBranchSHA {
+		webhookError(w, r, nil, "ignored push of "+push.Ref+" - not a pushed branch", http.StatusOK)
+		return
+	}
+	branch := strings.TrimPrefix(push.Ref, "refs/heads/")
+	keys := []string{fmt.Sprintf("push:%d:%s:%s", push.ProjectID, branch, push.After)}
+	if !markDelivery(push.ProjectID, keys) {
+		webhookError(w, r, nil, "duplicate delivery - skipping", http.StatusOK)
+		return
+	}
+
+	ctx = withProfile(ctx, profileName)
+	mrs, err := listMergeRequestsTargeting(ctx, push.ProjectID, branch)
+	if err != nil {
+		// the failed delivery is retried by GitLab
+		forgetDelivery(keys)
+		webhookError(w, r, nil, "error listing the MRs targeting "+branch+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(mrs) > *retriggerOnTargetPushMax {
+		mrs = mrs[:*retriggerOnTargetPushMax]
+	}
+	if len(mrs) == 0 {
+		webhookError(w, r, nil, "no open MRs target "+branch+" - skipping", http.StatusOK)
+		return
+	}
+
+	var retriggers []targetPushRetrigger
+	for _, mr := range mrs {
+		retriggers = append(retriggers, targetPushRetrigger{mr: mr, profileName: profileName, branch: branch, requestID: requestID(ctx)})
+	}
+	queued := queueTargetPushRetriggers(retriggers)
+	webhookError(w, r, nil, fmt.Sprintf("re-triggering %d MRs targeting %s (%d queued already)", queued, branch, len(mrs)-queued), http.StatusAccepted)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+var teamsWebhookURL = flag.String("teams-webhook-url", "", "Microsoft Teams incoming webhook URL notified about failed triggers, token errors and GitLab outages")
+var teamsEvents = flag.String("teams-events", "errors", "Notifications routed to -teams-webhook-url: comma separated kinds, errors or successes")
+
+type teamsNotifier struct {
+	url string
+}
+
+func (t teamsNotifier) name() string {
+	return "teams"
+}
+
+// send posts the batch as a message card, the format accepted by the
+// incoming webhooks of Teams
+func (t teamsNotifier) send(batch []notification) error {
+	lines := make([]string, 0, len(batch))
+	for _, n := range batch {
+		lines = append(lines, n.text())
+	}
+	return postJSON(t.url, map[string]string{
+		"@type":    "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"summary":  "MR trigger service notifications",
+		"title":    "MR trigger service on " + *gitlabURL,
+		"text":     strings.Join(lines, "\n\n"),
+	})
+}
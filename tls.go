@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"strings"
+)
+
+var tlsCertFile = flag.String("tls-cert", "", "TLS certificate file, serves HTTPS when set together with -tls-key")
+var tlsKeyFile = flag.String("tls-key", "", "TLS private key file")
+var tlsClientCAFile = flag.String("tls-client-ca", "", "CA bundle used to verify client certificates (enables mutual TLS)")
+var acmeHost = flag.String("acme-host", "", "Comma separated host names to obtain Let's Encrypt certificates for (serves HTTPS)")
+var acmeEmail = flag.String("acme-email", "", "Contact email for the ACME account")
+var acmeCacheDir = flag.String("acme-cache-dir", "acme-cache", "Directory where ACME certificates and account keys are cached")
+var acmeHTTPListen = flag.String("acme-http-listen", "", "Optional HTTP listen address answering http-01 challenges, eg. :80")
+
+func acmeEnabled() bool {
+	return *acmeHost != ""
+}
+
+func acmeHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(*acmeHost, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func tlsEnabled() bool {
+	return *tlsCertFile != "" || *tlsKeyFile != "" || acmeEnabled()
+}
+
+func validateTLSFlags() error {
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		return errors.New("specify both -tls-cert and -tls-key")
+	}
+	if acmeEnabled() && *tlsCertFile != "" {
+		return errors.New("-acme-host can not be combined with -tls-cert and -tls-key")
+	}
+	if *tlsClientCAFile != "" && !tlsEnabled() {
+		return errors.New("-tls-client-ca requires -tls-cert and -tls-key or -acme-host")
+	}
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + file)
+	}
+	return pool, nil
+}
+
+func serverTLSConfig() (config *tls.Config, err error) {
+	if acmeEnabled() {
+		if config, err = acmeTLSConfig(); err != nil {
+			return nil, err
+		}
+		config.MinVersion = tls.VersionTLS12
+	} else {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if *tlsClientCAFile == "" {
+		return config, nil
+	}
+
+	pool, err := loadCertPool(*tlsClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
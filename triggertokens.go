@@ -0,0 +1,155 @@
+package main
+
+/*
+Maintenance of the trigger tokens created by the service: the newest one of a
+project is replaced once it is older than -trigger-token-max-age, and the
+other ones (eg. duplicates created by concurrent webhooks) are deleted.
+Tokens not created by the service are never touched.
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var triggerTokenMaintenance = flag.Duration("trigger-token-maintenance", 0, "How often the trigger tokens created by the service are rotated and cleaned up (0 disables, see also /admin/trigger-tokens)")
+var triggerTokenMaxAge = flag.Duration("trigger-token-max-age", 90*24*time.Hour, "Age after which the trigger token created by the service is rotated")
+
+const triggerTokenDescription = "MR trigger (created automatically)"
+
+// triggerTokenProjects are the projects whose trigger tokens were used
+var triggerTokenProjects = struct {
+	sync.Mutex
+	ids map[int64]bool
+}{ids: make(map[int64]bool)}
+
+type tokenMaintenance struct {
+	ProjectID int64  `json:"project_id"`
+	Kept      int    `json:"kept,omitempty"`
+	Created   int    `json:"created,omitempty"`
+	Deleted   []int  `json:"deleted,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func rememberTriggerTokenProject(projectID int64) {
+	triggerTokenProjects.Lock()
+	defer triggerTokenProjects.Unlock()
+	triggerTokenProjects.ids[projectID] = true
+}
+
+func deleteToken(ctx context.Context, projectID int64, tokenID int) (err error) {
+	reqURL := fmt.Sprintf("%s/api/v4/projects/%d/triggers/%d", *gitlabURL, projectID, tokenID)
+	_, err = doProjectRequest(ctx, projectID, "DELETE", reqURL, "", nil, nil)
+	return
+}
+
+func tokenAge(token tokenResponse) time.Duration {
+	createdAt, err := time.Parse(time.RFC3339, token.CreatedAt)
+	if err != nil {
+		return 0
+	}
+	return time.Since(createdAt)
+}
+
+// maintainTriggerTokens rotates and cleans up the trigger tokens the service
+// created in the project
+func maintainTriggerTokens(ctx context.Context, projectID int64) (result tokenMaintenance) {
+	result.ProjectID = projectID
+
+	tokens, err := listTokens(ctx, projectID)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	var own []tokenResponse
+	for _, token := range tokens {
+		if token.Description == triggerTokenDescription && token.DeletedAt == "" {
+			own = append(own, token)
+		}
+	}
+	if len(own) == 0 {
+		return
+	}
+	sort.Slice(own, func(i, j int) bool { return own[i].ID > own[j].ID })
+
+	stale := own[1:]
+	if tokenAge(own[0]) > *triggerTokenMaxAge {
+		created, err := createToken(ctx, projectID)
+		if err != nil {
+			result.Error = err.Error()
+			return
+		}
+		result.Created = created.ID
+		stale = own
+	} else {
+		result.Kept = own[0].ID
+	}
+	triggerTokenCache.delete(fmt.Sprint(projectID))
+
+	for _, token := range stale {
+		if err := deleteToken(ctx, projectID, token.ID); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		result.Deleted = append(result.Deleted, token.ID)
+	}
+	log.Println("[TOKEN]", "maintained - project:", projectID, "kept:", result.Kept, "created:", result.Created, "deleted:", result.Deleted)
+	return
+}
+
+// maintainAllTriggerTokens maintains the tokens of the projects the service
+// used trigger tokens of
+func maintainAllTriggerTokens() (results []tokenMaintenance) {
+	triggerTokenProjects.Lock()
+	var ids []int64
+	for id := range triggerTokenProjects.ids {
+		ids = append(ids, id)
+	}
+	triggerTokenProjects.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	results = []tokenMaintenance{}
+	for _, id := range ids {
+		results = append(results, maintainTriggerTokens(context.Background(), id))
+	}
+	return
+}
+
+func runTriggerTokenMaintenance() {
+	for range time.Tick(*triggerTokenMaintenance) {
+		if isLeader() {
+			maintainAllTriggerTokens()
+		}
+	}
+}
+
+// handlerAdminTriggerTokens runs the maintenance on POST, for the project_id
+// parameter or all projects used so far
+func handlerAdminTriggerTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, "use POST to rotate and clean up trigger tokens", http.StatusMethodNotAllowed)
+		return
+	}
+	if secretValue(triggerToken) != "" || *createPipelines {
+		httpError(w, r, "trigger tokens are not managed by the service", http.StatusConflict)
+		return
+	}
+
+	if value := r.FormValue("project_id"); value != "" {
+		projectID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || projectID <= 0 {
+			httpError(w, r, "invalid project_id: "+value, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, []tokenMaintenance{maintainTriggerTokens(r.Context(), projectID)})
+		return
+	}
+	writeJSON(w, http.StatusOK, maintainAllTriggerTokens())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var validateCI = flag.Bool("validate-ci", false, "Validate the CI configuration of the ref with the CI lint API before triggering, and explain the errors in an MR comment instead of creating a failing pipeline")
+
+// ciLintNoteMarker identifies the comment explaining the errors of the CI
+// configuration, which is updated on later pushes
+const ciLintNoteMarker = "<!-- mr-trigger:ci-lint -->"
+
+// invalidCIConfigSkip returns the reason to skip the trigger when the CI
+// configuration of the ref is invalid. Errors of the lint API itself do not
+// withhold the pipeline.
+func invalidCIConfigSkip(ctx context.Context, webhook webhookRequest) (string, int) {
+	if !*validateCI {
+		return "", 0
+	}
+
+	ref := pipelineRef(webhook)
+	config, err := getMergedCIConfig(ctx, pipelineProjectID(webhook), ref)
+	if err != nil {
+		logEvent(ctx, "[LINT] ERROR validating CI configuration:", err)
+		return "", 0
+	}
+	if config.Valid {
+		return "", 0
+	}
+
+	logEvent(ctx, "[LINT] invalid CI configuration of", ref, "errors:", strings.Join(config.Errors, "; "))
+	commentInvalidCIConfig(ctx, webhook, ref, config.Errors)
+	return "skipped - invalid CI configuration of " + ref + ": " + strings.Join(config.Errors, "; "), http.StatusOK
+}
+
+func commentInvalidCIConfig(ctx context.Context, webhook webhookRequest, ref string, lintErrors []string) {
+	if *shadowMode || budgetExhausted(ctx) {
+		return
+	}
+	if dryRunning(ctx) {
+		logEvent(ctx, "[DRY-RUN] would comment invalid CI configuration on MR:", webhook.Attributes.IID)
+		return
+	}
+
+	body := fmt.Sprintf("CI pipeline was not triggered for commit %s, the CI configuration of `%s` is invalid:\n\n",
+		webhook.Attributes.LastCommit.ID, ref)
+	for _, e := range lintErrors {
+		body += "* " + e + "\n"
+	}
+	body += "\nFix `.gitlab-ci.yml` and push again."
+	if err := upsertMRNote(ctx, webhook.Attributes.TargetProjectID, webhook.Attributes.IID, ciLintNoteMarker, body); err != nil {
+		logEvent(ctx, "[MR] ERROR commenting invalid CI configuration:", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestInvalidCIConfigSkipLintsTheRefOfTheMR(t *testing.T) {
+	var lintQueries []url.Values
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/ci/lint") {
+			lintQueries = append(lintQueries, r.URL.Query())
+			json.NewEncoder(w).Encode(mergedCIConfig{Valid: true})
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer gitlab.Close()
+
+	defer func(gitlab, token string, validate bool) {
+		*gitlabURL, *privateToken, *validateCI = gitlab, token, validate
+	}(*gitlabURL, *privateToken, *validateCI)
+	*gitlabURL, *privateToken, *validateCI = gitlab.URL, "private-token", true
+
+	var webhook webhookRequest
+	webhook.Attributes.SourceProjectID = 1
+	webhook.Attributes.TargetProjectID = 1
+	webhook.Attributes.IID = 7
+	webhook.Attributes.Action = "update"
+	webhook.Attributes.SourceBranch = "feature/lint"
+	webhook.Attributes.TargetBranch = "main"
+
+	if message, _ := invalidCIConfigSkip(context.Background(), webhook); message != "" {
+		t.Fatalf("valid configuration skipped: %s", message)
+	}
+	if len(lintQueries) != 1 {
+		t.Fatalf("%d lint requests, expected 1", len(lintQueries))
+	}
+	if query := lintQueries[0]; query.Get("dry_run") != "true" || query.Get("ref") != "feature/lint" {
+		t.Errorf("lint request %v, expected a dry run of ref feature/lint", query)
+	}
+}
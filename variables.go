@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// mergeRequestVariables returns the standard MR_* variables of the pipeline
+func mergeRequestVariables(webhook webhookRequest) map[string]string {
+	return map[string]string{
+		"CI_MERGE_REQUEST": "true",
+		"MR_SOURCE_BRANCH": webhook.Attributes.SourceBranch,
+		"MR_TARGET_BRANCH": webhook.Attributes.TargetBranch,
+		"MR_ID":            strconv.Itoa(webhook.Attributes.ID),
+		"MR_IID":           strconv.Itoa(webhook.Attributes.IID),
+		"MR_STATE":         webhook.Attributes.State,
+	}
+}
+
+// triggerVariables returns the variables passed to the pipeline in addition
+// to the standard MR_* ones.
+func triggerVariables(webhook webhookRequest, mr mergeRequest, override projectOverride) map[string]string {
+	variables := make(map[string]string)
+
+	if webhook.Attributes.State == "merged" {
+		variables["MR_EVENT"] = "merged"
+		variables["MR_PIPELINE"] = "target"
+		if webhook.SourceCleanup {
+			variables["MR_PIPELINE"] = "source_cleanup"
+		}
+		variables["MR_SOURCE_SHA"] = mr.SHA
+		variables["MR_MERGE_COMMIT_SHA"] = mr.MergeCommitSHA
+		variables["MR_SQUASHED"] = strconv.FormatBool(mr.Squash && mr.SquashCommitSHA != "")
+		if mr.Squash && mr.SquashCommitSHA != "" {
+			variables["MR_SQUASH_COMMIT_SHA"] = mr.SquashCommitSHA
+		}
+	} else {
+		variables["MR_MERGE_STATUS"] = mr.MergeStatus
+		variables["MR_HAS_CONFLICTS"] = strconv.FormatBool(mr.hasConflicts())
+	}
+
+	if refStrategyFor(webhook) == refSHA {
+		variables["MR_PIN_SHA"] = webhook.Attributes.LastCommit.ID
+	}
+
+	for name, value := range override.Variables {
+		variables[name] = value
+	}
+	return variables
+}
+
+func sortedVariableNames(variables map[string]string) []string {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,140 @@
+package main
+
+/*
+Tokens can be fetched from a HashiCorp Vault KV secret (version 1 or 2) at
+-vault-path, with the keys:
+ - private_token: used as -private-token
+ - trigger_token_<project ID>: used as the trigger token of the project
+
+The secret is read again every -vault-refresh, renewing the Vault token too.
+
+References:
+ - https://developer.hashicorp.com/vault/api-docs/secret/kv/kv-v2
+ - https://developer.hashicorp.com/vault/api-docs/auth/token#renew-a-token-self
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var vaultAddr = flag.String("vault-addr", "", "Address of Vault to fetch the tokens from, eg. https://vault.example.com:8200")
+var vaultToken = flag.String("vault-token", "", "Vault token with read access to -vault-path")
+var vaultPath = flag.String("vault-path", "", "Path of the KV secret with the tokens, eg. secret/data/mr-trigger for KV version 2")
+var vaultRefresh = flag.Duration("vault-refresh", 5*time.Minute, "How often the secret is read again from Vault and the Vault token renewed")
+
+var vaultClient = &http.Client{Timeout: 30 * time.Second}
+
+var vaultTriggerTokens = struct {
+	sync.RWMutex
+	tokens map[int64]string
+}{tokens: make(map[int64]string)}
+
+func vaultEnabled() bool {
+	return *vaultAddr != ""
+}
+
+func vaultRequest(method, path string, data interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(*vaultAddr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", secretValue(vaultToken))
+
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status + " " + string(bytes.TrimSpace(body)))
+	}
+	return json.Unmarshal(body, data)
+}
+
+// readVaultSecret returns the key-value pairs of the secret, of either KV
+// version
+func readVaultSecret() (map[string]interface{}, error) {
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := vaultRequest("GET", *vaultPath, &secret); err != nil {
+		return nil, err
+	}
+	if nested, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, versioned := secret.Data["metadata"]; versioned {
+			return nested, nil
+		}
+	}
+	return secret.Data, nil
+}
+
+func loadVaultSecrets() error {
+	values, err := readVaultSecret()
+	if err != nil {
+		return fmt.Errorf("reading %s from Vault: %s", *vaultPath, err)
+	}
+
+	tokens := make(map[int64]string)
+	for key, value := range values {
+		var projectID int64
+		if _, err := fmt.Sscanf(key, "trigger_token_%d", &projectID); err == nil {
+			tokens[projectID] = fmt.Sprint(value)
+			registerSecrets(tokens[projectID])
+		}
+	}
+	vaultTriggerTokens.Lock()
+	vaultTriggerTokens.tokens = tokens
+	vaultTriggerTokens.Unlock()
+
+	if value, ok := values["private_token"].(string); ok && value != "" {
+		registerSecrets(value)
+		secrets.Lock()
+		*privateToken = value
+		secrets.Unlock()
+	}
+	return nil
+}
+
+func vaultTriggerToken(projectID int64) string {
+	vaultTriggerTokens.RLock()
+	defer vaultTriggerTokens.RUnlock()
+	return vaultTriggerTokens.tokens[projectID]
+}
+
+// configureVault loads the tokens from Vault on startup
+func configureVault() error {
+	if !vaultEnabled() {
+		return nil
+	}
+	if *vaultPath == "" || secretValue(vaultToken) == "" {
+		return errors.New("-vault-addr requires -vault-path and -vault-token")
+	}
+	if secretValue(privateToken) != "" {
+		return errors.New("specify either -private-token or -vault-addr")
+	}
+	return loadVaultSecrets()
+}
+
+func runVaultRefresh() {
+	for range time.Tick(*vaultRefresh) {
+		var renewed interface{}
+		if err := vaultRequest("POST", "auth/token/renew-self", &renewed); err != nil {
+			log.Println("[VAULT] ERROR renewing token:", err)
+		}
+		if err := loadVaultSecrets(); err != nil {
+			log.Println("[VAULT] ERROR", err)
+		}
+	}
+}
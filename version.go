@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// capability is an API feature available since a GitLab version, in the
+// Enterprise Edition only when enterprise is set
+type capability struct {
+	name       string
+	minVersion string
+	enterprise bool
+	// used reports whether the configuration of the service requires it
+	used func() bool
+}
+
+var capabilities = map[string]capability{
+	"project_access_tokens":  {"project access tokens (-project-access-tokens)", "13.10", false, func() bool { return *useProjectAccessTokens }},
+	"project_token_rotation": {"rotation of project access tokens", "16.0", false, nil},
+	"ci_lint_ref":            {"CI lint of a ref (-preflight, -validate-ci, -native-mr-pipelines)", "14.3", false, func() bool { return *preflight || *validateCI || *nativeMRPipelines != "" }},
+	"token_self":             {"inspecting the private token", "15.5", false, nil},
+	"merge_refs":             {"merge refs of MRs (the merge-ref ref strategy, -merge-trains merge-ref)", "11.10", false, usesMergeRefs},
+	"external_status_checks": {"external status checks (-status-check-name)", "14.0", true, func() bool { return *statusCheckName != "" }},
+	"merge_trains":           {"merge trains (-merge-trains)", "12.0", true, func() bool { return *mergeTrains != "" }},
+	"hook_test":              {"enabling disabled webhooks by a test delivery", "16.11", false, nil},
+	"group_hook_test":        {"enabling disabled group webhooks by a test delivery", "17.1", true, nil},
+	"hook_description":       {"descriptions of webhooks, fingerprinting their secret", "17.1", false, nil},
+}
+
+// gitlabServerVersion is detected on startup, empty when unknown
+var gitlabServerVersion string
+
+// gitlabServerEnterprise is detected on startup, nil when unknown (GitLab
+// before 15.6 does not tell its edition)
+var gitlabServerEnterprise *bool
+
+func setGitLabVersion(version gitlabVersion) {
+	gitlabServerVersion = version.Version
+	gitlabServerEnterprise = version.Enterprise
+}
+
+// usesMergeRefs reports whether the configuration triggers pipelines for the
+// merge refs of MRs
+func usesMergeRefs() bool {
+	rules, _ := parseRefStrategy(*refStrategy)
+	for _, strategy := range rules {
+		if strategy == refMergeRef {
+			return true
+		}
+	}
+	return *mergeTrains == mergeTrainsActionMergeRef
+}
+
+func parseVersion(version string) (parts [3]int) {
+	version = strings.SplitN(version, "-", 2)[0]
+	for i, part := range strings.SplitN(version, ".", 3) {
+		parts[i], _ = strconv.Atoi(part)
+	}
+	return
+}
+
+func versionAtLeast(version, min string) bool {
+	v, m := parseVersion(version), parseVersion(min)
+	for i := range v {
+		if v[i] != m[i] {
+			return v[i] > m[i]
+		}
+	}
+	return true
+}
+
+// gitlabSupports reports whether the capability is available, assuming it is
+// when the version or the edition of GitLab is not known.
+func gitlabSupports(name string) bool {
+	c := capabilities[name]
+	if c.enterprise && gitlabServerEnterprise != nil && !*gitlabServerEnterprise {
+		return false
+	}
+	return gitlabServerVersion == "" || versionAtLeast(gitlabServerVersion, c.minVersion)
+}
+
+// requirement describes the version or edition of GitLab the capability
+// requires
+func (c capability) requirement() string {
+	if c.enterprise {
+		return "GitLab EE " + c.minVersion
+	}
+	return "GitLab " + c.minVersion
+}
+
+// negotiateCapabilities detects the version of GitLab and refuses features
+// of the configuration which it does not support.
+func negotiateCapabilities() error {
+	if gitlabServerVersion == "" && secretValue(privateToken) != "" {
+		version, err := getGitLabVersion(context.Background())
+		if err != nil {
+			log.Println("[VERSION] WARNING GitLab version could not be detected, assuming all features are supported:", err)
+			return nil
+		}
+		setGitLabVersion(version)
+	}
+	if gitlabServerVersion == "" {
+		return nil
+	}
+
+	var keys []string
+	for key := range capabilities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := capabilities[key]
+		if gitlabSupports(key) {
+			continue
+		}
+		if c.used != nil && c.used() {
+			return fmt.Errorf("%s requires %s, but it is %s", c.name, c.requirement(), gitlabVersionName())
+		}
+		log.Println("[VERSION]", c.name, "is not available, it requires", c.requirement())
+	}
+	return nil
+}
+
+func gitlabVersionName() string {
+	if gitlabServerEnterprise != nil && !*gitlabServerEnterprise {
+		return gitlabServerVersion + " CE"
+	}
+	return gitlabServerVersion
+}
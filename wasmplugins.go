@@ -0,0 +1,79 @@
+package main
+
+/*
+WebAssembly plugins ship site-specific trigger logic independently of the
+releases of the service: each plugin gets the same input as the OPA policy and
+returns a decision allowing or denying the trigger, optionally with a reason
+and extra variables. Plugins run sandboxed, without access to the file system,
+the network or the environment, in the order of -wasm-plugins; the first one
+denying the trigger decides.
+
+The ABI of a plugin is a module exporting:
+ - memory
+ - alloc(size i32) i32: allocates size bytes for the input, returns their
+   address
+ - decide(ptr i32, len i32) i64: decides about the JSON input at ptr,
+   returns the address (high 32 bits) and the length (low 32 bits) of the
+   JSON decision: {"allow": true, "reason": "...", "variables": {"KEY": "value"}}
+
+The runtime (wazero) is built with -tags wazero only.
+
+References:
+ - https://wazero.io/
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+)
+
+var wasmPlugins = flag.String("wasm-plugins", "", "Comma separated WebAssembly plugins deciding whether to trigger, loaded on start and reload (requires building with -tags wazero)")
+var wasmPluginTimeout = flag.Duration("wasm-plugin-timeout", time.Second, "How long a decision of a WebAssembly plugin may take")
+
+// wasmPluginMemoryPages limits the memory of a plugin instance to 32 MiB
+const wasmPluginMemoryPages = 512
+
+func validateWasmPlugins() error {
+	if *wasmPlugins != "" && !wazeroBuilt {
+		return errors.New("-wasm-plugins: built without WebAssembly support, rebuild with -tags wazero")
+	}
+	return nil
+}
+
+// wasmPluginsSkip returns the reason to skip the trigger when a plugin
+// denied it, and adds the variables of the decisions to the override
+// otherwise
+func wasmPluginsSkip(ctx context.Context, webhook webhookRequest, mr mergeRequest, override *projectOverride) (string, int) {
+	names := wasmPluginNames()
+	if len(names) == 0 {
+		return "", 0
+	}
+
+	input, err := json.Marshal(policyInput(webhook, mr))
+	if err != nil {
+		return "error running WebAssembly plugins - " + err.Error(), http.StatusInternalServerError
+	}
+	for _, name := range names {
+		pluginCtx, cancel := context.WithTimeout(ctx, *wasmPluginTimeout)
+		decision, err := runWasmPlugin(pluginCtx, name, input)
+		cancel()
+		if err != nil {
+			logEvent(ctx, "[WASM] ERROR running plugin", name+":", err)
+			return "error running WebAssembly plugin " + name + " - " + err.Error(), http.StatusInternalServerError
+		}
+		if !decision.Allow {
+			reason := "skipped by WebAssembly plugin " + name
+			if decision.Reason != "" {
+				reason += ": " + decision.Reason
+			}
+			logEvent(ctx, "[WASM]", reason)
+			return reason, http.StatusOK
+		}
+		applyPolicyVariables(ctx, override, decision.Variables)
+	}
+	return "", 0
+}
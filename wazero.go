@@ -0,0 +1,134 @@
+//go:build wazero
+// +build wazero
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const wazeroBuilt = true
+
+type wasmPlugin struct {
+	name     string
+	compiled wazero.CompiledModule
+}
+
+var wasm struct {
+	sync.RWMutex
+	runtime wazero.Runtime
+	plugins []wasmPlugin
+}
+
+// loadWasmPlugins compiles the plugins of -wasm-plugins into a new runtime,
+// replacing the previous one when all of them compiled
+func loadWasmPlugins() error {
+	ctx := context.Background()
+	config := wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmPluginMemoryPages)
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+	// WASI without mounts, environment or arguments, for plugins built
+	// by toolchains expecting it
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	var plugins []wasmPlugin
+	for _, path := range splitList(*wasmPlugins) {
+		binary, err := ioutil.ReadFile(path)
+		if err != nil {
+			runtime.Close(ctx)
+			return err
+		}
+		compiled, err := runtime.CompileModule(ctx, binary)
+		if err != nil {
+			runtime.Close(ctx)
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		for _, export := range []string{"alloc", "decide"} {
+			if _, ok := compiled.ExportedFunctions()[export]; !ok {
+				runtime.Close(ctx)
+				return fmt.Errorf("%s: the function %s is not exported", path, export)
+			}
+		}
+		plugins = append(plugins, wasmPlugin{filepath.Base(path), compiled})
+	}
+
+	wasm.Lock()
+	previous := wasm.runtime
+	wasm.runtime, wasm.plugins = runtime, plugins
+	wasm.Unlock()
+	if previous != nil {
+		previous.Close(ctx)
+	}
+	if len(plugins) > 0 {
+		log.Println("[WASM]", "loaded", len(plugins), "plugins")
+	}
+	return nil
+}
+
+func wasmPluginNames() []string {
+	wasm.RLock()
+	defer wasm.RUnlock()
+	var names []string
+	for _, plugin := range wasm.plugins {
+		names = append(names, plugin.name)
+	}
+	return names
+}
+
+// runWasmPlugin decides about the input with a new instance of the plugin, so
+// no state is kept between decisions
+func runWasmPlugin(ctx context.Context, name string, input []byte) (decision policyDecision, err error) {
+	wasm.RLock()
+	defer wasm.RUnlock()
+
+	var compiled wazero.CompiledModule
+	for _, plugin := range wasm.plugins {
+		if plugin.name == name {
+			compiled = plugin.compiled
+		}
+	}
+	if compiled == nil {
+		return decision, errors.New("the plugin is not loaded anymore")
+	}
+
+	// reactor modules are initialized by _initialize, if any
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	module, err := wasm.runtime.InstantiateModule(ctx, compiled, config)
+	if err != nil {
+		return
+	}
+	defer module.Close(ctx)
+
+	results, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return
+	}
+	ptr := uint32(results[0])
+	if !module.Memory().Write(ptr, input) {
+		return decision, errors.New("input out of the memory of the plugin")
+	}
+
+	results, err = module.ExportedFunction("decide").Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return
+	}
+	output, ok := module.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return decision, errors.New("decision out of the memory of the plugin")
+	}
+	if err = json.Unmarshal(output, &decision); err != nil {
+		return decision, errors.New("invalid decision: " + err.Error())
+	}
+	return
+}
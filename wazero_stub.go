@@ -0,0 +1,23 @@
+//go:build !wazero
+// +build !wazero
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+const wazeroBuilt = false
+
+func loadWasmPlugins() error {
+	return nil
+}
+
+func wasmPluginNames() []string {
+	return nil
+}
+
+func runWasmPlugin(ctx context.Context, name string, input []byte) (policyDecision, error) {
+	return policyDecision{}, errors.New("built without WebAssembly support, rebuild with -tags wazero")
+}